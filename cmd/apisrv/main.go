@@ -11,6 +11,8 @@ import (
 	"github.com/mobingilabs/pullr/pkg/api"
 	"github.com/mobingilabs/pullr/pkg/api/auth"
 	"github.com/mobingilabs/pullr/pkg/api/v1"
+	"github.com/mobingilabs/pullr/pkg/builder"
+	"github.com/mobingilabs/pullr/pkg/codebuild"
 	"github.com/mobingilabs/pullr/pkg/domain"
 	"github.com/mobingilabs/pullr/pkg/github"
 	"github.com/mobingilabs/pullr/pkg/mongodb"
@@ -118,15 +120,61 @@ func main() {
 		fatal(fmt.Errorf("authsvc init: %v", err))
 	}
 
-	buildsvc := domain.NewBuildService(jobq, storage.BuildStorage(), conf.BuildSvc.Queue)
+	buildsvc := domain.NewBuildService(jobq, storage.BuildStorage(), storage.VersionStorage(), conf.BuildSvc.Queue)
+	capabilities, err := builder.Capabilities(conf.Builder)
+	if err != nil {
+		fatal(err)
+	}
+	buildsvc.SetCapabilities(capabilities)
 	oauthsvc := domain.NewOAuthService(storage.OAuthStorage(), oauthProviders)
 	sourcesvc := domain.NewSourceService(storage.OAuthStorage(), sourceClients)
+
+	var secretsvc *domain.SecretService
+	if conf.Secrets.Key != "" {
+		secretsvc, err = domain.NewSecretService(storage.SecretStorage(), conf.Secrets.Key)
+		if err != nil {
+			fatal(fmt.Errorf("secretsvc init: %v", err))
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		fatal(fmt.Errorf("hostname: %v", err))
+	}
+	scheduler := domain.NewScheduler(hostname, time.Minute, storage, sourcesvc, buildsvc, logger)
+	go scheduler.Run(context.Background())
+
+	registryClient := builder.NewRegistryClient(conf)
+	watcher := domain.NewBaseImageWatcher(hostname, domain.BaseImageWatcherConfig{
+		Interval:     time.Minute * 15,
+		Cooldown:     time.Hour,
+		MaxRebuilds:  10,
+		RegistryHost: domain.RegistryHost(conf.Registry.URL),
+	}, storage, registryClient, sourcesvc, buildsvc, logger)
+	go watcher.Run(context.Background())
+
 	apiconfig := v1.NewConfig()
 	apiconfig.Storage = storage
 	apiconfig.SourceService = sourcesvc
 	apiconfig.OAuthService = oauthsvc
 	apiconfig.AuthService = authsvc
 	apiconfig.BuildService = buildsvc
+	apiconfig.Scheduler = scheduler
+	apiconfig.SecretService = secretsvc
+
+	// Codebuild projects of the deleted images are removed by the api
+	if conf.Builder.Driver == "codebuild" {
+		codebuildConfig, err := codebuild.ConfigFromMap(conf.Builder.Options)
+		if err != nil {
+			fatal(fmt.Errorf("builder driver: %s: %v", conf.Builder.Driver, err))
+		}
+
+		pipeline, err := codebuild.NewPipeline(conf.Registry.URL, codebuildConfig)
+		if err != nil {
+			fatal(fmt.Errorf("builder driver: %s: %v", conf.Builder.Driver, err))
+		}
+		apiconfig.BuildCleaner = pipeline
+	}
 
 	apisrv := api.NewApiServer(apiconfig, auth.NewDefaultAuthenticator(authsvc), logger)
 
@@ -6,10 +6,12 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"time"
 
-	"github.com/mobingilabs/pullr/pkg/codebuild"
+	"github.com/mobingilabs/pullr/pkg/builder"
 	"github.com/mobingilabs/pullr/pkg/domain"
 	"github.com/mobingilabs/pullr/pkg/mongodb"
 	"github.com/mobingilabs/pullr/pkg/rabbitmq"
@@ -97,14 +99,47 @@ func main() {
 	}
 	cancel()
 
-	buildsvc := domain.NewBuildService(jobq, storage.BuildStorage(), conf.BuildSvc.Queue)
+	buildsvc := domain.NewBuildService(jobq, storage.BuildStorage(), storage.VersionStorage(), conf.BuildSvc.Queue)
 
-	pipeline, err := codebuild.NewPipeline(conf.Registry.URL)
+	var secretsvc *domain.SecretService
+	if conf.Secrets.Key != "" {
+		secretsvc, err = domain.NewSecretService(storage.SecretStorage(), conf.Secrets.Key)
+		if err != nil {
+			fatal(fmt.Errorf("secretsvc init: %v", err))
+		}
+	}
+
+	admin := http.NewServeMux()
+	pipeline, err := builder.NewPipeline(conf.Builder, builder.Deps{
+		Conf:      conf,
+		Logger:    logger,
+		Storage:   storage,
+		SecretSvc: secretsvc,
+		Admin:     admin,
+	})
 	if err != nil {
 		fatal(err)
 	}
+	buildsvc.SetCapabilities(domain.CapabilitiesOf(pipeline))
+
+	if conf.BuildSvc.AdminAddr != "" {
+		addr, err := adminAddr(conf.BuildSvc.AdminAddr, conf.BuildSvc.AdminToken)
+		if err != nil {
+			fatal(fmt.Errorf("admin server: %v", err))
+		}
+
+		go func() {
+			logger.Infof("Admin endpoints listening on %s", addr)
+			if err := http.ListenAndServe(addr, requireToken(conf.BuildSvc.AdminToken, admin)); err != nil {
+				logger.Errorf("admin server: %v", err)
+			}
+		}()
+	}
 
 	buildStorage := storage.BuildStorage()
+	registryClient := builder.NewRegistryClient(conf)
+	sourcesvc := domain.NewSourceService(storage.OAuthStorage(), nil)
+	downstreams := domain.NewDownstreamTrigger(storage.ImageStorage(), sourcesvc, buildsvc)
 	sigCtx, cancel := run.ContextWithSig(context.Background(), os.Interrupt, os.Kill)
 
 	if err := buildsvc.Listen(); err != nil {
@@ -129,32 +164,65 @@ func main() {
 		}
 
 		go func() {
-			jobRecord := domain.BuildRecord{
-				StartedAt: time.Now(),
-				Status:    domain.BuildInProgress,
-				Tag:       buildjob.Tag,
+			jobRecord := domain.NewBuildRecord(buildjob)
+			if _, err := buildStorage.Get(buildjob.ImageOwner, buildjob.ImageKey, buildjob.ID); err == nil {
+				// Job is redelivered after a failed attempt, the retry gets
+				// its own record next to the failed one
+				jobRecord = jobRecord.WithNewID()
 			}
 			buildStorage.Put(buildjob.ImageOwner, buildjob.ImageKey, jobRecord)
 			logger.Infof("got job: %v", buildjob)
 
 			var pipelineOutput bytes.Buffer
 			pipelineCtx, cancel := context.WithTimeout(sigCtx, conf.BuildSvc.Timeout)
-			status, err := pipeline.Run(pipelineCtx, os.Stderr, buildjob)
+			status, err := pipeline.Run(pipelineCtx, io.MultiWriter(os.Stderr, &pipelineOutput), buildjob)
 			if err != nil {
 				cancel()
 				nerrs++
 				logger.Error(err)
+				// Job is retried with a new record, this one is kept failed
+				// instead of waiting forever
+				fmt.Fprintf(&pipelineOutput, "Build failed: %v\n", err)
+				jobRecord = jobRecord.WithStatus(domain.BuildFailed).WithLogs(pipelineOutput.String())
+				buildStorage.Update(buildjob.ImageOwner, buildjob.ImageKey, jobRecord.ID, jobRecord)
 				job.Reject(true)
 				return
 			}
 			cancel()
 
-			jobRecord = jobRecord.WithStatus(status).WithLogs(pipelineOutput.String())
-			buildStorage.UpdateLast(buildjob.ImageOwner, buildjob.ImageKey, jobRecord)
+			// Pipeline adds the floating version tags to the job
+			jobRecord = jobRecord.WithStatus(status).WithTags(buildjob.AllTags()).WithLogs(pipelineOutput.String())
+			if status == domain.BuildSucceed && len(buildjob.Platforms) > 0 {
+				digests, err := domain.JobPlatformDigests(sigCtx, registryClient, conf.Registry.URL, buildjob)
+				if err != nil {
+					logger.Errorf("platform digests: %v", err)
+				}
+				jobRecord = jobRecord.WithDigests(digests)
+			}
+			buildStorage.Update(buildjob.ImageOwner, buildjob.ImageKey, jobRecord.ID, jobRecord)
+
+			if err := domain.NotifyBuild(sigCtx, buildjob, jobRecord); err != nil {
+				logger.Errorf("build notifications: %v", err)
+			}
+
+			if status == domain.BuildSucceed {
+				if err := buildsvc.RecordVersion(buildjob); err != nil {
+					logger.Errorf("record version: %v", err)
+				}
+				if err := downstreams.Trigger(buildjob); err != nil {
+					logger.Errorf("downstream builds: %v", err)
+				}
+			}
 
 			if err := job.Finish(); err != nil {
 				logger.Errorf("jobq finish: %v", err)
 			}
 		}()
 	}
+
+	if closer, ok := pipeline.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Errorf("pipeline close: %v", err)
+		}
+	}
 }
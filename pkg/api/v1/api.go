@@ -16,13 +16,19 @@ type Api struct {
 	authsvc   *domain.DefaultAuthService
 	oauthsvc  *domain.OAuthService
 	sourcesvc *domain.SourceService
+	scheduler *domain.Scheduler
+	secretsvc *domain.SecretService
+	cleaner   domain.BuildResourceCleaner
 
 	// Storages
-	imageStorage domain.ImageStorage
-	userStorage  domain.UserStorage
-	buildStorage domain.BuildStorage
-	oauthStorage domain.OAuthStorage
-	authStorage  domain.AuthStorage
+	imageStorage    domain.ImageStorage
+	userStorage     domain.UserStorage
+	buildStorage    domain.BuildStorage
+	oauthStorage    domain.OAuthStorage
+	authStorage     domain.AuthStorage
+	scheduleStorage domain.ScheduleStorage
+	baseStorage     domain.BaseImageStorage
+	versionStorage  domain.VersionStorage
 }
 
 // NewApi add api v1 routes to the given routing group
@@ -34,11 +40,17 @@ func NewApi(config Config, authenticator auth.Authenticator, group *echo.Group)
 		config.AuthService,
 		config.OAuthService,
 		config.SourceService,
+		config.Scheduler,
+		config.SecretService,
+		config.BuildCleaner,
 		config.Storage.ImageStorage(),
 		config.Storage.UserStorage(),
 		config.Storage.BuildStorage(),
 		config.Storage.OAuthStorage(),
 		config.Storage.AuthStorage(),
+		config.Storage.ScheduleStorage(),
+		config.Storage.BaseImageStorage(),
+		config.Storage.VersionStorage(),
 	}
 
 	// Authentication endpoints
@@ -63,13 +75,23 @@ func NewApi(config Config, authenticator auth.Authenticator, group *echo.Group)
 	// Image endpoints
 	restricted.GET("/images", authenticator.Wrap(api.ImageList))
 	restricted.POST("/images", authenticator.Wrap(api.ImageCreate))
+	restricted.GET("/images/graph", authenticator.Wrap(api.ImageGraph))
 	restricted.GET("/images/:key", authenticator.Wrap(api.ImageGet))
 	restricted.POST("/images/:key", authenticator.Wrap(api.ImageUpdate))
 	restricted.DELETE("/images/:key", authenticator.Wrap(api.ImageDelete))
+	restricted.DELETE("/images/:key/cache", authenticator.Wrap(api.ImageCachePurge))
+	restricted.GET("/images/:key/tag_preview", authenticator.Wrap(api.ImageTagPreview))
+	restricted.GET("/images/:key/schedules", authenticator.Wrap(api.ImageSchedules))
+	restricted.GET("/images/:key/base_images", authenticator.Wrap(api.ImageBaseImages))
+	restricted.GET("/images/:key/secrets", authenticator.Wrap(api.SecretList))
+	restricted.PUT("/images/:key/secrets/:name", authenticator.Wrap(api.SecretPut))
+	restricted.DELETE("/images/:key/secrets/:name", authenticator.Wrap(api.SecretDelete))
 
 	// Build endpoints
 	restricted.GET("/builds", authenticator.Wrap(api.BuildList))
 	restricted.GET("/builds/:key", authenticator.Wrap(api.BuildHistory))
+	restricted.POST("/images/:key/builds", authenticator.Wrap(api.BuildTrigger))
+	restricted.POST("/images/:key/builds/:id/rebuild", authenticator.Wrap(api.BuildRebuild))
 
 	// SourceClient endpoints
 	group.POST("/source/:provider/:username/webhook", api.SourceWebhook)
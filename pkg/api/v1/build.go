@@ -1,11 +1,13 @@
 package v1
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
 	"github.com/labstack/echo"
 	"github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/gova"
 )
 
 // BuildList response with list of images sorted by their last build times.
@@ -73,3 +75,152 @@ func (a *Api) BuildHistory(secrets domain.AuthSecrets, c echo.Context) error {
 
 	return c.JSON(http.StatusOK, responsePayload{records, pagination})
 }
+
+// BuildTrigger queues a build job for the image found by the :key parameter.
+// Body should have one of the branch, tag or commit fields to select the
+// source to build. Image tag is decided by image's tag rules unless it is
+// given explicitly with the tag_name field.
+func (a *Api) BuildTrigger(secrets domain.AuthSecrets, c echo.Context) error {
+	type requestPayload struct {
+		Branch  string `json:"branch"`
+		Tag     string `json:"tag"`
+		Commit  string `json:"commit"`
+		TagName string `json:"tag_name"`
+	}
+	type responsePayload struct {
+		ID         string   `json:"id"`
+		ImageKey   string   `json:"image_key"`
+		Tag        string   `json:"tag"`
+		Tags       []string `json:"tags"`
+		CommitRef  string   `json:"ref"`
+		CommitHash string   `json:"hash"`
+	}
+
+	imgKey := strings.TrimSpace(c.Param("key"))
+	if imgKey == "" {
+		return domain.ErrNotFound
+	}
+
+	var req requestPayload
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	var refType domain.SourceRefType
+	var ref string
+	nrefs := 0
+	if req.Branch = strings.TrimSpace(req.Branch); req.Branch != "" {
+		refType, ref = domain.SourceBranch, req.Branch
+		nrefs++
+	}
+	if req.Tag = strings.TrimSpace(req.Tag); req.Tag != "" {
+		refType, ref = domain.SourceTag, req.Tag
+		nrefs++
+	}
+	if req.Commit = strings.TrimSpace(req.Commit); req.Commit != "" {
+		refType, ref = "", req.Commit
+		nrefs++
+	}
+	if nrefs != 1 {
+		return domain.ErrBuildBadRef
+	}
+	if req.TagName = strings.TrimSpace(req.TagName); req.TagName != "" {
+		validator := &gova.Validator{}
+		validator.DockerTag("tag_name", req.TagName)
+		if !validator.Valid() {
+			return validator.Errors()
+		}
+	}
+
+	img, err := a.imageStorage.Get(secrets.Username, imgKey)
+	if err != nil {
+		return err
+	}
+
+	commit, err := a.sourcesvc.ResolveRef(context.Background(), secrets.Username, img.Repository, refType, ref)
+	if err != nil {
+		return err
+	}
+
+	token, err := a.sourcesvc.Token(secrets.Username, img.Repository.Provider)
+	if err != nil {
+		return err
+	}
+
+	tag := domain.ImageTag{Name: req.TagName}
+	if tag.Name == "" {
+		var ok bool
+		if tag, ok = img.MatchingTag(commit); !ok {
+			return domain.ErrBuildNoMatchingTag
+		}
+	}
+
+	job, err := domain.NewMatchedBuildJob(img, tag, commit, token, secrets.Username)
+	if err != nil {
+		return err
+	}
+
+	if err := a.buildsvc.Queue(job); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, responsePayload{job.ID, job.ImageKey, job.Tag, job.Tags, job.CommitRef, job.CommitHash})
+}
+
+// BuildRebuild queues a build job which reproduces the build record found by
+// the :id parameter with the same commit, dockerfile and tag. Layer cache can
+// be bypassed by setting no_cache field of the optional body, malformed
+// bodies are rejected.
+func (a *Api) BuildRebuild(secrets domain.AuthSecrets, c echo.Context) error {
+	type requestPayload struct {
+		NoCache bool `json:"no_cache"`
+	}
+	type responsePayload struct {
+		ID         string `json:"id"`
+		ImageKey   string `json:"image_key"`
+		Tag        string `json:"tag"`
+		CommitRef  string `json:"ref"`
+		CommitHash string `json:"hash"`
+		RebuildOf  string `json:"rebuild_of"`
+	}
+
+	imgKey := strings.TrimSpace(c.Param("key"))
+	recordID := strings.TrimSpace(c.Param("id"))
+	if imgKey == "" || recordID == "" {
+		return domain.ErrNotFound
+	}
+
+	// Body is optional, a request without a body rebuilds with the cache
+	var req requestPayload
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+	}
+
+	img, err := a.imageStorage.Get(secrets.Username, imgKey)
+	if err != nil {
+		return err
+	}
+
+	record, err := a.buildStorage.Get(secrets.Username, imgKey, recordID)
+	if err != nil {
+		return err
+	}
+
+	token, err := a.sourcesvc.Token(secrets.Username, img.Repository.Provider)
+	if err != nil {
+		return err
+	}
+
+	job, err := domain.RebuildJob(img, record, token, secrets.Username, req.NoCache)
+	if err != nil {
+		return err
+	}
+
+	if err := a.buildsvc.Queue(job); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, responsePayload{job.ID, job.ImageKey, job.Tag, job.CommitRef, job.CommitHash, job.RebuildOf})
+}
@@ -18,6 +18,13 @@ type Config struct {
 	AuthService   *domain.DefaultAuthService
 	OAuthService  *domain.OAuthService
 	SourceService *domain.SourceService
+	Scheduler     *domain.Scheduler
+	// SecretService is optional, secret endpoints respond with unsupported
+	// error if it is nil
+	SecretService *domain.SecretService
+	// BuildCleaner is optional, it removes the builder resources of the
+	// deleted images
+	BuildCleaner domain.BuildResourceCleaner
 }
 
 // NewConfig creates an api configuration object with defaults
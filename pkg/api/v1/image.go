@@ -50,12 +50,17 @@ func (a *Api) ImageCreate(secrets domain.AuthSecrets, c echo.Context) error {
 	}
 
 	// Ignore owner & key fields
-	img.Key = domain.ImageKey(img.Repository)
+	img.Key = domain.ImageKey(img)
 	img.Owner = secrets.Username
 	img.CreatedAt = time.Now()
 	img.UpdatedAt = img.CreatedAt
 
-	valid, err := img.Valid()
+	graph, err := a.dependencyGraph(secrets.Username)
+	if err != nil {
+		return err
+	}
+
+	valid, err := img.Valid(graph)
 	if !valid {
 		return err
 	}
@@ -65,15 +70,27 @@ func (a *Api) ImageCreate(secrets domain.AuthSecrets, c echo.Context) error {
 		return domain.ErrImageExists
 	}
 
+	// One webhook serves all the images of a repository
+	siblings, err := a.imageStorage.FindByRepository(secrets.Username, img.Repository)
+	if err != nil && err != domain.ErrNotFound {
+		return err
+	}
+
 	err = a.imageStorage.Put(img)
 	if err != nil {
 		return err
 	}
 
-	webhookURL := fmt.Sprintf("https://%s/api/v1/source/%s/%s/webhook", c.Request().Host, img.Repository.Provider, secrets.Username)
-	err = a.sourcesvc.RegisterWebhook(context.Background(), webhookURL, secrets.Username, img.Repository)
-	if err != nil {
-		_ = a.imageStorage.Delete(secrets.Username, img.Key)
+	if len(siblings) == 0 {
+		webhookURL := fmt.Sprintf("https://%s/api/v1/source/%s/%s/webhook", c.Request().Host, img.Repository.Provider, secrets.Username)
+		err = a.sourcesvc.RegisterWebhook(context.Background(), webhookURL, secrets.Username, img.Repository)
+		if err != nil {
+			_ = a.imageStorage.Delete(secrets.Username, img.Key)
+			return err
+		}
+	}
+
+	if err := a.syncSchedules(img); err != nil {
 		return err
 	}
 
@@ -96,7 +113,8 @@ func (a *Api) ImageGet(secrets domain.AuthSecrets, c echo.Context) error {
 }
 
 // ImageUpdate accepts partial domain.Image as it is body and updates the
-// matching image record found in storage with the body
+// matching image record found in storage with the body. Repository and name
+// of the image can't be changed as the image's key is derived from them.
 func (a *Api) ImageUpdate(secrets domain.AuthSecrets, c echo.Context) error {
 	imgKey := strings.TrimSpace(c.Param("key"))
 	if imgKey == "" {
@@ -113,12 +131,21 @@ func (a *Api) ImageUpdate(secrets domain.AuthSecrets, c echo.Context) error {
 		return err
 	}
 
-	update.Key = domain.ImageKey(update.Repository)
+	update.Key = domain.ImageKey(update)
+	if update.Key != imgKey {
+		return domain.ErrImageKeyChanged
+	}
 	update.Owner = secrets.Username
 	update.CreatedAt = orig.CreatedAt
 	update.UpdatedAt = time.Now()
+	update.CacheGeneration = orig.CacheGeneration
+
+	graph, err := a.dependencyGraph(secrets.Username)
+	if err != nil {
+		return err
+	}
 
-	valid, err := update.Valid()
+	valid, err := update.Valid(graph)
 	if !valid {
 		return err
 	}
@@ -128,7 +155,11 @@ func (a *Api) ImageUpdate(secrets domain.AuthSecrets, c echo.Context) error {
 		return err
 	}
 
-	update, err = a.imageStorage.Get(secrets.Username, update.Key)
+	if err := a.syncSchedules(update); err != nil {
+		return err
+	}
+
+	update, err = a.imageStorage.Get(secrets.Username, imgKey)
 	if err != nil {
 		return err
 	}
@@ -143,5 +174,201 @@ func (a *Api) ImageDelete(secrets domain.AuthSecrets, c echo.Context) error {
 		return domain.ErrNotFound
 	}
 
-	return a.imageStorage.Delete(secrets.Username, imgKey)
+	if err := a.imageStorage.Delete(secrets.Username, imgKey); err != nil {
+		return err
+	}
+
+	if err := a.baseStorage.Delete(secrets.Username, imgKey); err != nil {
+		return err
+	}
+
+	if err := a.versionStorage.Delete(secrets.Username, imgKey); err != nil {
+		return err
+	}
+
+	if a.secretsvc != nil {
+		if err := a.secretsvc.DeleteAll(secrets.Username, imgKey); err != nil {
+			return err
+		}
+	}
+
+	if a.cleaner != nil {
+		if err := a.cleaner.CleanImage(c.Request().Context(), secrets.Username, imgKey); err != nil {
+			return err
+		}
+	}
+
+	return a.removeSchedules(secrets.Username, imgKey)
+}
+
+// ImageCachePurge purges the layer cache of the image found by the :key
+// parameter. Image's cache generation is changed so the next builds don't
+// use the previous caches, caches kept by the builder are removed too.
+func (a *Api) ImageCachePurge(secrets domain.AuthSecrets, c echo.Context) error {
+	imgKey := strings.TrimSpace(c.Param("key"))
+	if imgKey == "" {
+		return domain.ErrNotFound
+	}
+
+	img, err := a.imageStorage.Get(secrets.Username, imgKey)
+	if err != nil {
+		return err
+	}
+
+	img.CacheGeneration++
+	img.UpdatedAt = time.Now()
+	if err := a.imageStorage.Update(secrets.Username, imgKey, img); err != nil {
+		return err
+	}
+
+	if purger, ok := a.cleaner.(domain.BuildCachePurger); ok {
+		if err := purger.PurgeCache(c.Request().Context(), secrets.Username, imgKey); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, img)
+}
+
+// ImageSchedules responds with the scheduled builds of the image found by the
+// :key parameter along with their last and next run times.
+func (a *Api) ImageSchedules(secrets domain.AuthSecrets, c echo.Context) error {
+	imgKey := strings.TrimSpace(c.Param("key"))
+	if imgKey == "" {
+		return domain.ErrNotFound
+	}
+
+	schedules, err := a.scheduleStorage.List(secrets.Username, imgKey)
+	if err != nil && err != domain.ErrNotFound {
+		return err
+	}
+	if schedules == nil {
+		schedules = []domain.Schedule{}
+	}
+
+	return c.JSON(http.StatusOK, schedules)
+}
+
+// ImageBaseImages responds with the base images used by the image found by
+// the :key parameter along with their digests at the last build.
+func (a *Api) ImageBaseImages(secrets domain.AuthSecrets, c echo.Context) error {
+	imgKey := strings.TrimSpace(c.Param("key"))
+	if imgKey == "" {
+		return domain.ErrNotFound
+	}
+
+	bases, err := a.baseStorage.List(secrets.Username, imgKey)
+	if err != nil && err != domain.ErrNotFound {
+		return err
+	}
+	if bases == nil {
+		bases = []domain.BaseImage{}
+	}
+
+	return c.JSON(http.StatusOK, bases)
+}
+
+// ImageTagPreview responds with the docker tags the image found by the :key
+// parameter would be built with for the ref given by the branch or tag query
+// parameter. Commit hash used by the tag templates can be given with the
+// commit query parameter.
+func (a *Api) ImageTagPreview(secrets domain.AuthSecrets, c echo.Context) error {
+	type responsePayload struct {
+		Ref     string               `json:"ref"`
+		RefType domain.SourceRefType `json:"ref_type"`
+		Matched domain.ImageTag      `json:"matched"`
+		Tag     string               `json:"tag"`
+		Tags    []string             `json:"tags"`
+	}
+
+	imgKey := strings.TrimSpace(c.Param("key"))
+	if imgKey == "" {
+		return domain.ErrNotFound
+	}
+
+	branch := strings.TrimSpace(c.QueryParam("branch"))
+	gitTag := strings.TrimSpace(c.QueryParam("tag"))
+	if (branch == "") == (gitTag == "") {
+		return domain.ErrBuildBadRef
+	}
+
+	img, err := a.imageStorage.Get(secrets.Username, imgKey)
+	if err != nil {
+		return err
+	}
+
+	commit := &domain.CommitInfo{
+		Ref:        branch,
+		RefType:    domain.SourceBranch,
+		Hash:       strings.TrimSpace(c.QueryParam("commit")),
+		CreatedAt:  time.Now(),
+		Repository: img.Repository,
+	}
+	if gitTag != "" {
+		commit.Ref, commit.RefType = gitTag, domain.SourceTag
+	}
+
+	tag, ok := img.MatchingTag(commit)
+	if !ok {
+		return domain.ErrBuildNoMatchingTag
+	}
+
+	tags, err := tag.Tags(commit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, responsePayload{commit.Ref, commit.RefType, tag, tags[0], tags})
+}
+
+// ImageGraph responds with the user's images and the upstream relations
+// between them
+func (a *Api) ImageGraph(secrets domain.AuthSecrets, c echo.Context) error {
+	imgs, err := a.imageStorage.All(secrets.Username)
+	if err != nil && err != domain.ErrNotFound {
+		return err
+	}
+
+	type node struct {
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	}
+
+	type responsePayload struct {
+		Nodes []node                  `json:"nodes"`
+		Edges []domain.DependencyEdge `json:"edges"`
+	}
+
+	nodes := make([]node, len(imgs))
+	for i, img := range imgs {
+		nodes[i] = node{img.Key, img.Name}
+	}
+
+	graph := domain.NewDependencyGraph(imgs)
+	return c.JSON(http.StatusOK, responsePayload{nodes, graph.Edges()})
+}
+
+func (a *Api) dependencyGraph(username string) (domain.DependencyGraph, error) {
+	imgs, err := a.imageStorage.All(username)
+	if err != nil && err != domain.ErrNotFound {
+		return domain.DependencyGraph{}, err
+	}
+
+	return domain.NewDependencyGraph(imgs), nil
+}
+
+func (a *Api) syncSchedules(img domain.Image) error {
+	if a.scheduler == nil {
+		return nil
+	}
+
+	return a.scheduler.Sync(img)
+}
+
+func (a *Api) removeSchedules(username, imgKey string) error {
+	if a.scheduler == nil {
+		return nil
+	}
+
+	return a.scheduler.Remove(username, imgKey)
 }
@@ -0,0 +1,89 @@
+package v1
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// SecretList responds with the names of the build secrets of the image found
+// by the :key parameter. Secret values are never reported back.
+func (a *Api) SecretList(secrets domain.AuthSecrets, c echo.Context) error {
+	if a.secretsvc == nil {
+		return domain.ErrSecretsDisabled
+	}
+
+	imgKey := strings.TrimSpace(c.Param("key"))
+	if imgKey == "" {
+		return domain.ErrNotFound
+	}
+
+	list, err := a.secretsvc.List(secrets.Username, imgKey)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// SecretPut creates or replaces the build secret found by the :name parameter
+// of the image found by the :key parameter. Body should have the value field.
+func (a *Api) SecretPut(secrets domain.AuthSecrets, c echo.Context) error {
+	type requestPayload struct {
+		Value string `json:"value"`
+	}
+
+	if a.secretsvc == nil {
+		return domain.ErrSecretsDisabled
+	}
+	if !a.buildsvc.Capabilities().Secrets {
+		return domain.ErrBuildSecretsUnsupported
+	}
+
+	imgKey := strings.TrimSpace(c.Param("key"))
+	name := strings.TrimSpace(c.Param("name"))
+	if imgKey == "" || name == "" {
+		return domain.ErrNotFound
+	}
+
+	var req requestPayload
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if _, err := a.imageStorage.Get(secrets.Username, imgKey); err != nil {
+		return err
+	}
+
+	if err := a.secretsvc.Set(secrets.Username, imgKey, name, req.Value); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// SecretDelete deletes the build secret found by the :name parameter of the
+// image found by the :key parameter
+func (a *Api) SecretDelete(secrets domain.AuthSecrets, c echo.Context) error {
+	if a.secretsvc == nil {
+		return domain.ErrSecretsDisabled
+	}
+
+	imgKey := strings.TrimSpace(c.Param("key"))
+	name := strings.TrimSpace(c.Param("name"))
+	if imgKey == "" || name == "" {
+		return domain.ErrNotFound
+	}
+
+	if err := a.secretsvc.Delete(secrets.Username, imgKey, name); err != nil {
+		return err
+	}
+
+	if cleaner, ok := a.cleaner.(domain.BuildSecretCleaner); ok {
+		return cleaner.CleanSecret(c.Request().Context(), secrets.Username, imgKey, name)
+	}
+
+	return nil
+}
@@ -2,13 +2,18 @@ package v1
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo"
 	"github.com/mobingilabs/pullr/pkg/domain"
 )
 
-// SourceWebhook handles webhook request. It queues a build job if it is required.
+// SourceWebhook handles webhook request. It queues a build job for each image
+// of the repository with a tag matching the pushed ref. Images watching paths
+// are built only if the push changed any of their files. Repository config
+// found in the pushed commit is applied to the images before matching them,
+// broken configs are recorded as failed builds.
 func (a *Api) SourceWebhook(c echo.Context) error {
 	usr, err := a.userStorage.Get(c.Param("username"))
 	if err != nil {
@@ -22,41 +27,103 @@ func (a *Api) SourceWebhook(c echo.Context) error {
 		return err
 	}
 
-	imgKey := domain.ImageKey(commit.Repository)
-	img, err := a.imageStorage.Get(usr.Username, imgKey)
-	if err != nil {
+	imgs, err := a.imageStorage.FindByRepository(usr.Username, commit.Repository)
+	if err != nil && err != domain.ErrNotFound {
 		return err
 	}
-
-	tag, ok := img.MatchingTag(commit)
-	if !ok {
-		return c.NoContent(http.StatusOK)
+	if len(imgs) == 0 {
+		return domain.ErrNotFound
 	}
 
-	tokens, err := a.oauthStorage.GetTokens(usr.Username)
+	token, err := a.sourcesvc.Token(usr.Username, c.Param("provider"))
 	if err != nil {
 		return err
 	}
 
-	token, ok := tokens[c.Param("provider")]
-	if !ok {
-		return domain.ErrAuthUnauthorized
+	confData, err := a.sourcesvc.FileContent(context.Background(), usr.Username, commit.Repository, commit.Hash, domain.RepoConfigPath)
+	if err != nil && err != domain.ErrNotFound {
+		return err
 	}
+	hasConf := err == nil
 
-	job := domain.BuildJob{
-		ImageKey:    imgKey,
-		ImageName:   img.Name,
-		Dockerfile:  img.DockerfilePath,
-		Tag:         tag.Tag(commit),
-		ImageRepo:   img.Repository,
-		CommitHash:  commit.Hash,
-		CommitRef:   commit.Ref,
-		ImageOwner:  usr.Username,
-		VcsToken:    token.Token,
-		VcsUsername: token.Identity,
+	var conf domain.RepoConfig
+	var graph domain.DependencyGraph
+	if hasConf {
+		// Images with the repository config applied are validated against
+		// the owner's other images
+		graph, err = a.dependencyGraph(usr.Username)
+		if err != nil {
+			return err
+		}
+
+		var parseErr error
+		conf, parseErr = domain.ParseRepoConfig(confData)
+		if parseErr != nil {
+			for _, img := range imgs {
+				if _, ok := img.MatchingTag(commit); ok {
+					if err := a.recordFailedBuild(img, commit, parseErr); err != nil {
+						return err
+					}
+				}
+			}
+			return c.NoContent(http.StatusOK)
+		}
 	}
 
-	return a.buildsvc.Queue(job)
+	// Changed files are fetched once and only if an image needs them. If
+	// they can't be determined images are built to be on the safe side.
+	var changedFiles []string
+	var changesErr error
+	changesLoaded := false
+
+	// An image failing to queue shouldn't prevent the others from building
+	var queueErr error
+	for _, stored := range imgs {
+		img := stored
+		if hasConf {
+			img = conf.Apply(stored)
+			if valid, err := img.Valid(graph); !valid {
+				_, storedOk := stored.MatchingTag(commit)
+				_, confOk := img.MatchingTag(commit)
+				if storedOk || confOk {
+					err = a.recordFailedBuild(stored, commit, fmt.Errorf("%s: %v", domain.RepoConfigPath, err))
+					if err != nil && queueErr == nil {
+						queueErr = err
+					}
+				}
+				continue
+			}
+		}
+
+		tag, ok := img.MatchingTag(commit)
+		if !ok {
+			continue
+		}
+
+		if img.WatchesPaths() {
+			if !changesLoaded {
+				changedFiles, changesErr = a.sourcesvc.ChangedFiles(context.Background(), usr.Username, commit)
+				changesLoaded = true
+			}
+			if changesErr == nil && !img.PathsChanged(changedFiles) {
+				continue
+			}
+		}
+
+		job, err := domain.NewMatchedBuildJob(img, tag, commit, token, "")
+		if err == nil {
+			err = a.buildsvc.Queue(job)
+		}
+		if err != nil && queueErr == nil {
+			queueErr = err
+		}
+	}
+
+	if queueErr != nil {
+		return queueErr
+	}
+
+	return c.NoContent(http.StatusOK)
 }
 
 // SourceOrganisations responses with source client user's list of organisations
@@ -83,3 +150,10 @@ func (a *Api) SourceRepositories(secrets domain.AuthSecrets, c echo.Context) err
 
 	return c.JSON(http.StatusOK, repos)
 }
+
+// recordFailedBuild records a failed build of the commit for the image which
+// couldn't be built, so the failure is visible in the image's builds
+func (a *Api) recordFailedBuild(img domain.Image, commit *domain.CommitInfo, reason error) error {
+	record := domain.NewFailedBuildRecord(commit, "", reason)
+	return a.buildStorage.Put(img.Owner, img.Key, record)
+}
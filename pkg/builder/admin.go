@@ -0,0 +1,57 @@
+package builder
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mobingilabs/pullr/pkg/docker"
+)
+
+// hostPoolHandler serves the build host metrics and the maintenance mode:
+//
+//	GET    /hosts              metrics of the hosts
+//	POST   /hosts/{name}/drain stops leasing the host to new builds
+//	DELETE /hosts/{name}/drain resumes leasing the host
+func hostPoolHandler(pool *docker.HostPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hosts" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(pool.Stats())
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/hosts/")
+		if !strings.HasSuffix(name, "/drain") {
+			http.NotFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(name, "/drain")
+
+		var drain bool
+		switch r.Method {
+		case http.MethodPost:
+			drain = true
+		case http.MethodDelete:
+			drain = false
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := pool.Drain(name, drain); err == docker.ErrHostNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
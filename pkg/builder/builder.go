@@ -0,0 +1,215 @@
+// Package builder creates the build pipelines of the image builder drivers
+// selected by the configuration. Both api server and build service select
+// the drivers from here, so they agree on what the drivers can build.
+package builder
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mobingilabs/pullr/pkg/buildkit"
+	"github.com/mobingilabs/pullr/pkg/codebuild"
+	"github.com/mobingilabs/pullr/pkg/docker"
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/github"
+	"github.com/mobingilabs/pullr/pkg/kubernetes"
+	"github.com/mobingilabs/pullr/pkg/machine"
+	"github.com/mobingilabs/pullr/pkg/registry"
+)
+
+// Deps are the services shared by the pipeline drivers
+type Deps struct {
+	Conf      *domain.Config
+	Logger    domain.Logger
+	Storage   domain.StorageDriver
+	SecretSvc *domain.SecretService
+	// Admin is the mux of the admin endpoints, drivers register their
+	// endpoints to it
+	Admin *http.ServeMux
+}
+
+// driver creates build pipelines of a builder driver
+type driver struct {
+	create func(options map[string]string, deps Deps) (domain.Pipeline, error)
+	// capabilities are the optional build features the pipelines report
+	// back, they are known without creating the pipeline
+	capabilities domain.BuilderCapabilities
+}
+
+// drivers are the supported builder drivers by their names
+var drivers = map[string]driver{
+	"docker":     {newDockerPipeline, docker.Capabilities},
+	"machine":    {newMachinePipeline, machine.Capabilities},
+	"buildkit":   {newBuildkitPipeline, buildkit.Capabilities},
+	"kubernetes": {newKubernetesPipeline, kubernetes.Capabilities},
+	"codebuild":  {newCodebuildPipeline, codebuild.Capabilities},
+}
+
+// NewPipeline creates the build pipeline of the configured builder driver
+func NewPipeline(conf domain.DriverConfig, deps Deps) (domain.Pipeline, error) {
+	d, err := lookup(conf.Driver)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline, err := d.create(conf.Options, deps)
+	if err != nil {
+		return nil, fmt.Errorf("builder driver: %s: %v", conf.Driver, err)
+	}
+
+	return pipeline, nil
+}
+
+// Capabilities reports back the optional build features of the configured
+// builder driver without creating its pipeline
+func Capabilities(conf domain.DriverConfig) (domain.BuilderCapabilities, error) {
+	d, err := lookup(conf.Driver)
+	if err != nil {
+		return domain.BuilderCapabilities{}, err
+	}
+
+	return d.capabilities, nil
+}
+
+func lookup(name string) (driver, error) {
+	if name == "" {
+		return driver{}, fmt.Errorf("builder driver is required, use one of %s", driverNames())
+	}
+
+	d, ok := drivers[name]
+	if !ok {
+		return driver{}, fmt.Errorf("builder driver: %s: not supported, use one of %s", name, driverNames())
+	}
+
+	return d, nil
+}
+
+func newDockerPipeline(options map[string]string, deps Deps) (domain.Pipeline, error) {
+	config, err := docker.ConfigFromMap(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Hosts) == 0 {
+		return newHostedPipeline(docker.NewFactory(config.Host, config.CertPath), deps), nil
+	}
+
+	pool, err := docker.NewHostPool(config.Hosts, config.HealthInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := hostPoolHandler(pool)
+	deps.Admin.Handle("/hosts", handler)
+	deps.Admin.Handle("/hosts/", handler)
+	return newHostedPipeline(pool, deps), nil
+}
+
+func newMachinePipeline(options map[string]string, deps Deps) (domain.Pipeline, error) {
+	config, err := machine.ConfigFromMap(options)
+	if err != nil {
+		return nil, err
+	}
+
+	factory, err := machine.New(config, deps.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHostedPipeline(factory, deps), nil
+}
+
+func newBuildkitPipeline(options map[string]string, deps Deps) (domain.Pipeline, error) {
+	config, err := buildkit.ConfigFromMap(options)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := deps.Conf.Registry
+	factory := buildkit.NewFactory(config, registry.URL, registry.Username, registry.Password)
+	return newHostedPipeline(factory, deps), nil
+}
+
+func newKubernetesPipeline(options map[string]string, deps Deps) (domain.Pipeline, error) {
+	config, err := kubernetes.ConfigFromMap(options)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := deps.Conf.Registry
+	factory, err := kubernetes.NewFactory(config, deps.Conf.BuildSvc.CloneDir, registry.URL, registry.Username, registry.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHostedPipeline(factory, deps), nil
+}
+
+func newCodebuildPipeline(options map[string]string, deps Deps) (domain.Pipeline, error) {
+	config, err := codebuild.ConfigFromMap(options)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline, err := codebuild.NewPipeline(deps.Conf.Registry.URL, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]domain.SourceClient{
+		"github": github.NewClient(deps.Logger),
+	}
+	pipeline.TrackBaseImages(deps.Storage.BaseImageStorage(), NewRegistryClient(deps.Conf), sources)
+
+	if deps.SecretSvc != nil {
+		pipeline.UseSecrets(deps.SecretSvc)
+	}
+	pipeline.UseVersions(deps.Storage.VersionStorage())
+
+	return pipeline, nil
+}
+
+// newHostedPipeline creates a pipeline cloning the repositories locally and
+// building them with the image builders of the factory
+func newHostedPipeline(factory domain.ImageBuilderFactory, deps Deps) *domain.HostedPipeline {
+	config := domain.PipelineConfig{
+		CloneDir:         deps.Conf.BuildSvc.CloneDir,
+		RegistryURL:      deps.Conf.Registry.URL,
+		RegistryUser:     deps.Conf.Registry.Username,
+		RegistryPassword: deps.Conf.Registry.Password,
+	}
+	cloners := map[string]domain.RepositoryCloner{
+		"github": &github.Cloner{},
+	}
+	pipeline := domain.NewPipeline(config, deps.Logger, cloners, factory)
+
+	pipeline.TrackBaseImages(deps.Storage.BaseImageStorage(), NewRegistryClient(deps.Conf))
+
+	if deps.SecretSvc != nil {
+		pipeline.UseSecrets(deps.SecretSvc)
+	}
+	pipeline.UseVersions(deps.Storage.VersionStorage())
+
+	return pipeline
+}
+
+// NewRegistryClient creates a registry client logged in to the registry the
+// images are pushed to
+func NewRegistryClient(conf *domain.Config) *registry.Client {
+	client := registry.NewClient(nil)
+	client.Login(conf.Registry.URL, conf.Registry.Username, conf.Registry.Password)
+	return client
+}
+
+// driverNames reports back the names of the supported drivers
+func driverNames() string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
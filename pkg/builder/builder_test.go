@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/dummy"
+)
+
+func TestCapabilities(t *testing.T) {
+	deps := Deps{
+		Conf:    &domain.Config{Registry: domain.RegistryConfig{URL: "https://registry.example.com"}},
+		Logger:  &domain.TestLogger{},
+		Storage: dummy.NewStorageDriver(nil),
+		Admin:   http.NewServeMux(),
+	}
+
+	// Drivers which can be created without reaching their build hosts
+	configs := []domain.DriverConfig{
+		{Driver: "docker", Options: map[string]string{}},
+		{Driver: "docker", Options: map[string]string{"hosts": "tcp://10.0.0.2:2375,tcp://10.0.0.3:2375"}},
+		{Driver: "buildkit", Options: map[string]string{"addr": "tcp://buildkitd:1234"}},
+	}
+	for _, conf := range configs {
+		pipeline, err := NewPipeline(conf, deps)
+		if err != nil {
+			t.Fatalf("%s: %v", conf.Driver, err)
+		}
+
+		capabilities, err := Capabilities(conf)
+		if err != nil {
+			t.Fatalf("%s: %v", conf.Driver, err)
+		}
+		if reported := domain.CapabilitiesOf(pipeline); reported != capabilities {
+			t.Errorf("%s: pipeline reports %+v, expected %+v", conf.Driver, reported, capabilities)
+		}
+	}
+
+	if _, err := Capabilities(domain.DriverConfig{Driver: "unknown"}); err == nil {
+		t.Error("expected an error for unknown driver")
+	}
+}
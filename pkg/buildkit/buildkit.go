@@ -0,0 +1,398 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// Config are the options for building images with a buildkit daemon
+type Config struct {
+	// Addr is the buildkitd address like "tcp://buildkitd:1234" or
+	// "unix:///run/buildkit/buildkitd.sock"
+	Addr string
+	// CertPath is the directory of the tls certificates "ca.pem", "cert.pem"
+	// and "key.pem", tls is disabled if it is empty
+	CertPath string
+	// Cache enables importing and exporting the build cache from the
+	// registry, cache of an image is kept in its "buildcache" tag. Cache
+	// strategies of the images override it.
+	Cache bool
+	// CacheDir is the directory the local caches of the images are kept in,
+	// images with local cache are built without a cache if it is empty
+	CacheDir string
+	// Platforms are the comma separated default target platforms like
+	// "linux/amd64,linux/arm64", buildkitd's platform is used if it is empty.
+	// Platforms of the multi platform images override them.
+	Platforms string
+	// SSH is the ssh agent socket or the private key forwarded to the builds
+	// as the default ssh mount, ssh forwarding is disabled if it is empty
+	SSH string
+	// Buildctl is the path of the buildctl executable
+	Buildctl string
+}
+
+// ConfigFromMap transforms generic configuration into buildkit specific
+// configuration
+func ConfigFromMap(in map[string]string) (*Config, error) {
+	var config Config
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           &config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(in); err != nil {
+		return nil, err
+	}
+
+	if config.Addr == "" {
+		return nil, errors.New("addr is required")
+	}
+	if config.Buildctl == "" {
+		config.Buildctl = "buildctl"
+	}
+	if config.SSH != "" {
+		if _, err := os.Stat(config.SSH); err != nil {
+			return nil, fmt.Errorf("ssh: %v", err)
+		}
+	}
+
+	return &config, nil
+}
+
+// Factory creates image builders using the same buildkit daemon
+type Factory struct {
+	config   *Config
+	registry registryAuth
+}
+
+// registryAuth is the registry the build cache is kept in
+type registryAuth struct {
+	host     string
+	username string
+	password string
+}
+
+// NewFactory creates a buildkit image builder factory. Build cache is kept
+// in the given registry if it is enabled in the config.
+func NewFactory(config *Config, registry, username, password string) *Factory {
+	return &Factory{config, registryAuth{domain.RegistryHost(registry), username, password}}
+}
+
+// Capabilities are the optional build features of the buildkit builders
+var Capabilities = domain.BuilderCapabilities{Platforms: true, Secrets: true}
+
+// Create creates a buildkit image builder
+func (f *Factory) Create() (domain.ImageBuilder, error) {
+	return &Builder{config: f.config, cache: f.registry}, nil
+}
+
+// Capabilities reports back the optional build features of the builders
+func (f *Factory) Capabilities() domain.BuilderCapabilities {
+	return Capabilities
+}
+
+// Builder builds images with buildkitd. Images are kept in buildkitd's cache
+// after they are built and they are pushed to the registry directly without
+// a docker daemon.
+type Builder struct {
+	config *Config
+	cache  registryAuth
+
+	// Build is repeated with the registry output when the image is pushed,
+	// every step comes from the first build's cache even for the builds
+	// without cache
+	ctxPath string
+	opts    domain.ImageBuildOptions
+	built   bool
+}
+
+// Close is a no-op, buildkitd cleans up its own resources
+func (b *Builder) Close() error {
+	return nil
+}
+
+// BuildImage builds the image from the source located at ctxPath. Failing
+// builds are reported with BuildFailed status and a nil error.
+func (b *Builder) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	b.ctxPath = ctxPath
+	b.opts = opts
+	b.built = false
+
+	err := b.solve(ctx, out, b.cache, false, nil)
+	if _, ok := err.(*solveError); ok {
+		fmt.Fprintf(out, "Build failed: %v\n", err)
+		return domain.BuildFailed, nil
+	} else if err != nil {
+		return domain.BuildFailed, err
+	}
+
+	b.built = true
+	return domain.BuildSucceed, nil
+}
+
+// PushImage pushes the image built by BuildImage to the registry with all
+// the tags. Registry credentials are passed to buildctl in a temporary
+// docker config instead of its arguments.
+func (b *Builder) PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error {
+	if !b.built {
+		return errors.New("buildkit: push: image is not built")
+	}
+
+	target := registryAuth{domain.RegistryHost(registry), username, password}
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = fmt.Sprintf("%s/%s", target.host, tag)
+	}
+
+	// The push solve should reuse the results of the first solve from
+	// buildkitd's cache instead of building the image again
+	opts := b.opts
+	b.opts.NoCache = false
+	defer func() { b.opts = opts }()
+
+	err := b.solve(ctx, out, target, true, []string{
+		"--output", fmt.Sprintf(`type=image,"name=%s",push=true`, strings.Join(names, ",")),
+	})
+	if err != nil {
+		return fmt.Errorf("buildkit: push: %v", err)
+	}
+
+	if b.opts.Cache.Strategy == domain.CacheLocal && b.config.CacheDir != "" {
+		b.pruneLocalCache()
+	}
+
+	return nil
+}
+
+// pruneLocalCache removes the local caches of the image's previous cache
+// generations
+func (b *Builder) pruneLocalCache() {
+	current := filepath.Join(b.config.CacheDir, filepath.FromSlash(b.opts.Cache.Key))
+	dirs, _ := filepath.Glob(filepath.Join(filepath.Dir(current), "*"))
+	for _, dir := range dirs {
+		if dir != current {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// solve runs buildctl with the build options of the builder. Registry
+// credentials are passed to buildctl in a temporary docker config instead of
+// its arguments.
+func (b *Builder) solve(ctx context.Context, out io.Writer, registry registryAuth, exportCache bool, extraArgs []string) error {
+	args, cleanup, err := b.buildArgs(registry.host, exportCache)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	env := os.Environ()
+	if registry.host != "" {
+		configDir, err := dockerConfig(registry)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(configDir)
+		env = append(env, "DOCKER_CONFIG="+configDir)
+	}
+
+	// Output of buildctl and the progress display are written concurrently
+	out = &syncWriter{w: out}
+	cmd := exec.CommandContext(ctx, b.config.Buildctl, append(args, extraArgs...)...)
+	cmd.Env = env
+	cmd.Stdout = out
+
+	progress, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	display := newProgressDisplay(out)
+	decodeErr := display.decode(progress)
+	waitErr := cmd.Wait()
+	display.summary()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if solveErr := display.err(); solveErr != nil {
+		return solveErr
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+	if waitErr != nil {
+		return &solveError{message: waitErr.Error()}
+	}
+
+	return nil
+}
+
+// buildArgs reports back the buildctl arguments for the build options. The
+// returned cleanup function removes the temporary secret files.
+func (b *Builder) buildArgs(registryHost string, exportCache bool) ([]string, func(), error) {
+	noop := func() {}
+	opts := b.opts
+
+	args := []string{"--addr", b.config.Addr}
+	if b.config.CertPath != "" {
+		args = append(args,
+			"--tlscacert", filepath.Join(b.config.CertPath, "ca.pem"),
+			"--tlscert", filepath.Join(b.config.CertPath, "cert.pem"),
+			"--tlskey", filepath.Join(b.config.CertPath, "key.pem"),
+		)
+	}
+
+	dockerfile := filepath.Join(b.ctxPath, opts.Dockerfile)
+	args = append(args, "build",
+		"--progress", "rawjson",
+		"--frontend", "dockerfile.v0",
+		"--local", "context="+filepath.Join(b.ctxPath, opts.Context),
+		"--local", "dockerfile="+filepath.Dir(dockerfile),
+		"--opt", "filename="+filepath.Base(dockerfile),
+	)
+
+	if opts.Target != "" {
+		args = append(args, "--opt", "target="+opts.Target)
+	}
+	for _, arg := range opts.BuildArgs {
+		args = append(args, "--opt", fmt.Sprintf("build-arg:%s=%s", arg.Name, arg.Value))
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if len(opts.Platforms) > 0 {
+		args = append(args, "--opt", "platform="+strings.Join(opts.Platforms, ","))
+	} else if b.config.Platforms != "" {
+		args = append(args, "--opt", "platform="+b.config.Platforms)
+	}
+	if b.config.SSH != "" {
+		args = append(args, "--ssh", "default="+b.config.SSH)
+	}
+
+	args = append(args, b.cacheArgs(registryHost, exportCache)...)
+
+	if len(opts.Secrets) == 0 {
+		return args, noop, nil
+	}
+
+	secretsDir, err := ioutil.TempDir("", "pullr-secrets")
+	if err != nil {
+		return nil, noop, err
+	}
+	cleanup := func() { os.RemoveAll(secretsDir) }
+
+	for _, secret := range opts.Secrets {
+		src := filepath.Join(secretsDir, secret.Name)
+		if err := ioutil.WriteFile(src, []byte(secret.Value), 0600); err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		args = append(args, "--secret", fmt.Sprintf("id=%s,src=%s", secret.Name, src))
+	}
+
+	return args, cleanup, nil
+}
+
+// cacheArgs reports back the buildctl arguments importing the build cache,
+// cache is exported too if exportCache is true
+func (b *Builder) cacheArgs(registryHost string, exportCache bool) []string {
+	cache := b.opts.Cache
+	if cache.Strategy == "" && b.config.Cache && registryHost != "" && len(b.opts.Tags) > 0 {
+		repo := b.opts.Tags[0]
+		if colon := strings.LastIndex(repo, ":"); colon > strings.LastIndex(repo, "/") {
+			repo = repo[:colon]
+		}
+		cache = domain.BuildCache{Strategy: domain.CacheRegistry, Ref: fmt.Sprintf("%s/%s:buildcache", registryHost, repo)}
+	}
+
+	var args []string
+	switch cache.Strategy {
+	case domain.CacheRegistry:
+		if cache.Ref == "" {
+			break
+		}
+		args = append(args, "--import-cache", "type=registry,ref="+cache.Ref)
+		if exportCache {
+			args = append(args, "--export-cache", "type=registry,mode=max,ref="+cache.Ref)
+		}
+	case domain.CacheInline:
+		if cache.Ref != "" {
+			args = append(args, "--import-cache", "type=registry,ref="+cache.Ref)
+		}
+		if exportCache {
+			args = append(args, "--export-cache", "type=inline")
+		}
+	case domain.CacheLocal:
+		if b.config.CacheDir == "" || cache.Key == "" {
+			break
+		}
+		dir := filepath.Join(b.config.CacheDir, filepath.FromSlash(cache.Key))
+		if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+			args = append(args, "--import-cache", "type=local,src="+dir)
+		}
+		if exportCache {
+			args = append(args, "--export-cache", "type=local,mode=max,dest="+dir)
+		}
+	}
+
+	return args
+}
+
+// syncWriter serializes the writes to the underlying writer
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// dockerConfig writes a docker config directory with the registry
+// credentials, the directory should be removed after using it
+func dockerConfig(registry registryAuth) (string, error) {
+	dir, err := ioutil.TempDir("", "pullr-docker-config")
+	if err != nil {
+		return "", err
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(registry.username + ":" + registry.password))
+	data, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry.host: map[string]string{"auth": auth},
+		},
+	})
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "config.json"), data, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
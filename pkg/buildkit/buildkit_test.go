@@ -0,0 +1,248 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+const progressSuccess = `{"vertexes":[{"digest":"sha256:a","name":"[1/2] FROM docker.io/library/alpine","started":"2018-05-01T10:00:00Z"}]}
+{"vertexes":[{"digest":"sha256:a","name":"[1/2] FROM docker.io/library/alpine","started":"2018-05-01T10:00:00Z","completed":"2018-05-01T10:00:00Z","cached":true}]}
+{"vertexes":[{"digest":"sha256:b","name":"[2/2] RUN make","started":"2018-05-01T10:00:01Z"}]}
+{"logs":[{"vertex":"sha256:b","stream":1,"data":"%s"}]}
+{"vertexes":[{"digest":"sha256:b","name":"[2/2] RUN make","started":"2018-05-01T10:00:01Z","completed":"2018-05-01T10:00:03.5Z"}]}
+`
+
+const progressFailure = `{"vertexes":[{"digest":"sha256:b","name":"[2/2] RUN make","started":"2018-05-01T10:00:01Z"}]}
+{"vertexes":[{"digest":"sha256:b","name":"[2/2] RUN make","started":"2018-05-01T10:00:01Z","completed":"2018-05-01T10:00:02Z","error":"exit code: 2"}]}
+`
+
+// fakeBuildctl writes a buildctl script which records its arguments and
+// docker config, and writes the given progress stream
+func fakeBuildctl(t *testing.T, dir, progress string, exitCode int) string {
+	progressFile := filepath.Join(dir, "progress.json")
+	if err := ioutil.WriteFile(progressFile, []byte(progress), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf(`#!/bin/sh
+for arg in "$@"; do echo "$arg"; done >> %[1]s/args
+case "$*" in *--secret*) cat "$(echo "$*" | sed 's/.*src=\([^ ]*\).*/\1/')" > %[1]s/secret ;; esac
+[ -n "$DOCKER_CONFIG" ] && cat "$DOCKER_CONFIG/config.json" > %[1]s/config.json
+cat %[2]s >&2
+exit %[3]d
+`, dir, progressFile, exitCode)
+
+	buildctl := filepath.Join(dir, "buildctl")
+	if err := ioutil.WriteFile(buildctl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return buildctl
+}
+
+func readFile(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBuildAndPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-buildkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logs := base64.StdEncoding.EncodeToString([]byte("compiling\ndone"))
+	config := &Config{
+		Addr:      "tcp://buildkitd:1234",
+		Cache:     true,
+		Platforms: "linux/amd64,linux/arm64",
+		Buildctl:  fakeBuildctl(t, dir, fmt.Sprintf(progressSuccess, logs), 0),
+	}
+	builder, _ := NewFactory(config, "https://reg.pullr.io", "user", "pass").Create()
+
+	var out bytes.Buffer
+	status, err := builder.BuildImage(context.Background(), &out, "/src", domain.ImageBuildOptions{
+		Dockerfile: "docker/Dockerfile",
+		Context:    "app",
+		Target:     "release",
+		BuildArgs:  []domain.BuildArg{{Name: "VERSION", Value: "1.0"}},
+		Secrets:    []domain.BuildSecret{{Name: "TOKEN", Value: "s3cr3t"}},
+		Tags:       []string{"owner/app:1.0", "owner/app:latest"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildSucceed {
+		t.Errorf("expected succeed status, got %s", status)
+	}
+
+	expectedOut := `#1 [1/2] FROM docker.io/library/alpine
+#1 CACHED
+#2 [2/2] RUN make
+#2 compiling
+#2 done
+#2 DONE 2.5s
+Step timings:
+      2.5s  [2/2] RUN make
+`
+	if out.String() != expectedOut {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expectedOut, out.String())
+	}
+
+	args := readFile(t, filepath.Join(dir, "args"))
+	for _, arg := range []string{
+		"--addr\ntcp://buildkitd:1234\nbuild\n",
+		"--local\ncontext=/src/app\n",
+		"--local\ndockerfile=/src/docker\n--opt\nfilename=Dockerfile\n",
+		"--opt\ntarget=release\n",
+		"--opt\nbuild-arg:VERSION=1.0\n",
+		"--opt\nplatform=linux/amd64,linux/arm64\n",
+		"--import-cache\ntype=registry,ref=reg.pullr.io/owner/app:buildcache\n",
+		"--secret\nid=TOKEN,src=",
+	} {
+		if !strings.Contains(args, arg) {
+			t.Errorf("expected build args to contain %q, got:\n%s", arg, args)
+		}
+	}
+	if strings.Contains(args, "--export-cache") || strings.Contains(args, "s3cr3t") {
+		t.Errorf("unexpected build args:\n%s", args)
+	}
+	if secret := readFile(t, filepath.Join(dir, "secret")); secret != "s3cr3t" {
+		t.Errorf("expected secret file to have the secret, got %q", secret)
+	}
+
+	os.Remove(filepath.Join(dir, "args"))
+	err = builder.PushImage(context.Background(), ioutil.Discard, []string{"owner/app:1.0", "owner/app:latest"}, "https://reg.pullr.io", "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args = readFile(t, filepath.Join(dir, "args"))
+	for _, arg := range []string{
+		"--export-cache\ntype=registry,mode=max,ref=reg.pullr.io/owner/app:buildcache\n",
+		"--output\ntype=image,\"name=reg.pullr.io/owner/app:1.0,reg.pullr.io/owner/app:latest\",push=true\n",
+	} {
+		if !strings.Contains(args, arg) {
+			t.Errorf("expected push args to contain %q, got:\n%s", arg, args)
+		}
+	}
+	if strings.Contains(args, "pass") {
+		t.Errorf("registry password leaked into the args:\n%s", args)
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if config := readFile(t, filepath.Join(dir, "config.json")); !strings.Contains(config, `"reg.pullr.io":{"auth":"`+auth+`"}`) {
+		t.Errorf("unexpected docker config: %s", config)
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-buildkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Addr: "tcp://buildkitd:1234", Buildctl: fakeBuildctl(t, dir, progressFailure, 1)}
+	builder, _ := NewFactory(config, "", "", "").Create()
+
+	var out bytes.Buffer
+	status, err := builder.BuildImage(context.Background(), &out, "/src", domain.ImageBuildOptions{Dockerfile: "Dockerfile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildFailed {
+		t.Errorf("expected failed status, got %s", status)
+	}
+	if !strings.Contains(out.String(), "Build failed: [2/2] RUN make: exit code: 2") {
+		t.Errorf("expected failing step in output, got:\n%s", out.String())
+	}
+
+	if err := builder.PushImage(context.Background(), &out, []string{"o/a:1"}, "reg", "u", "p"); err == nil {
+		t.Error("expected pushing a failed build to fail")
+	}
+}
+
+func TestPushWithoutCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-buildkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Addr: "tcp://buildkitd:1234", Buildctl: fakeBuildctl(t, dir, "", 0)}
+	builder, _ := NewFactory(config, "", "", "").Create()
+
+	opts := domain.ImageBuildOptions{Dockerfile: "Dockerfile", NoCache: true, Tags: []string{"owner/app:1.0"}}
+	if _, err := builder.BuildImage(context.Background(), ioutil.Discard, "/src", opts); err != nil {
+		t.Fatal(err)
+	}
+	if args := readFile(t, filepath.Join(dir, "args")); !strings.Contains(args, "--no-cache\n") {
+		t.Errorf("expected build without cache, got:\n%s", args)
+	}
+
+	os.Remove(filepath.Join(dir, "args"))
+	if err := builder.PushImage(context.Background(), ioutil.Discard, opts.Tags, "reg.pullr.io", "u", "p"); err != nil {
+		t.Fatal(err)
+	}
+	if args := readFile(t, filepath.Join(dir, "args")); strings.Contains(args, "--no-cache") {
+		t.Errorf("expected push to reuse the build's cache, got:\n%s", args)
+	}
+}
+
+func TestCacheArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-buildkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Builder{config: &Config{CacheDir: dir}}
+	b.opts.Tags = []string{"owner/app:1.0"}
+
+	b.opts.Cache = domain.BuildCache{Strategy: domain.CacheInline, Ref: "reg.pullr.io/owner/app:0.9"}
+	if args := fmt.Sprint(b.cacheArgs("reg.pullr.io", true)); args != "[--import-cache type=registry,ref=reg.pullr.io/owner/app:0.9 --export-cache type=inline]" {
+		t.Errorf("unexpected inline cache args: %s", args)
+	}
+
+	b.opts.Cache = domain.BuildCache{Strategy: domain.CacheLocal, Key: "owner/app/1"}
+	cacheDir := filepath.Join(dir, "owner", "app", "1")
+	if args := fmt.Sprint(b.cacheArgs("", true)); args != "[--export-cache type=local,mode=max,dest="+cacheDir+"]" {
+		t.Errorf("expected missing local cache not to be imported, got %s", args)
+	}
+
+	writeTestFile := func(name string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(filepath.Join(cacheDir, "index.json"))
+	writeTestFile(filepath.Join(dir, "owner", "app", "0", "index.json"))
+	if args := fmt.Sprint(b.cacheArgs("", false)); args != "[--import-cache type=local,src="+cacheDir+"]" {
+		t.Errorf("unexpected local cache args: %s", args)
+	}
+
+	b.pruneLocalCache()
+	if _, err := os.Stat(filepath.Join(dir, "owner", "app", "0")); !os.IsNotExist(err) {
+		t.Error("expected previous cache generation to be removed")
+	}
+	if _, err := os.Stat(cacheDir); err != nil {
+		t.Errorf("expected current cache generation to be kept: %v", err)
+	}
+}
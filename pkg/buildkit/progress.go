@@ -0,0 +1,177 @@
+package buildkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// solveStatus is an item of buildctl's rawjson progress stream
+type solveStatus struct {
+	Vertexes []vertex    `json:"vertexes"`
+	Logs     []vertexLog `json:"logs"`
+}
+
+// vertex is a step of the build graph
+type vertex struct {
+	Digest    string     `json:"digest"`
+	Name      string     `json:"name"`
+	Started   *time.Time `json:"started"`
+	Completed *time.Time `json:"completed"`
+	Cached    bool       `json:"cached"`
+	Error     string     `json:"error"`
+}
+
+// vertexLog is the output of a step, data is base64 encoded in json
+type vertexLog struct {
+	Vertex string `json:"vertex"`
+	Data   []byte `json:"data"`
+}
+
+// solveError is a failing build step
+type solveError struct {
+	step    string
+	message string
+}
+
+func (e *solveError) Error() string {
+	if e.step == "" {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %s", e.step, e.message)
+}
+
+// step is the display state of a vertex
+type step struct {
+	index     int
+	name      string
+	started   *time.Time
+	completed *time.Time
+	cached    bool
+	partial   string
+}
+
+// progressDisplay writes the solve status stream as plain log lines like
+// "#3 [2/4] RUN make" and keeps the timings of the steps
+type progressDisplay struct {
+	out      io.Writer
+	steps    map[string]*step
+	order    []*step
+	firstErr *solveError
+}
+
+func newProgressDisplay(out io.Writer) *progressDisplay {
+	return &progressDisplay{out: out, steps: make(map[string]*step)}
+}
+
+// decode reads the progress stream until it ends
+func (d *progressDisplay) decode(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var status solveStatus
+		if err := decoder.Decode(&status); err == io.EOF {
+			return nil
+		} else if err != nil {
+			// Drain the rest, so buildctl isn't blocked on a full pipe
+			io.Copy(d.out, io.MultiReader(decoder.Buffered(), r))
+			return err
+		}
+
+		d.update(status)
+	}
+}
+
+func (d *progressDisplay) step(digest, name string) *step {
+	s, ok := d.steps[digest]
+	if !ok {
+		s = &step{index: len(d.order) + 1}
+		d.steps[digest] = s
+		d.order = append(d.order, s)
+	}
+	if name != "" {
+		s.name = name
+	}
+
+	return s
+}
+
+func (d *progressDisplay) update(status solveStatus) {
+	for _, v := range status.Vertexes {
+		s := d.step(v.Digest, v.Name)
+		if s.started == nil && v.Started != nil {
+			s.started = v.Started
+			fmt.Fprintf(d.out, "#%d %s\n", s.index, s.name)
+		}
+
+		if s.completed != nil || v.Completed == nil {
+			continue
+		}
+		s.completed = v.Completed
+		s.cached = v.Cached
+		d.flush(s)
+
+		switch {
+		case v.Error != "":
+			fmt.Fprintf(d.out, "#%d ERROR: %s\n", s.index, v.Error)
+			if d.firstErr == nil {
+				d.firstErr = &solveError{s.name, v.Error}
+			}
+		case v.Cached:
+			fmt.Fprintf(d.out, "#%d CACHED\n", s.index)
+		default:
+			fmt.Fprintf(d.out, "#%d DONE %s\n", s.index, s.duration())
+		}
+	}
+
+	for _, l := range status.Logs {
+		s := d.step(l.Vertex, "")
+		lines := strings.Split(s.partial+string(l.Data), "\n")
+		s.partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			fmt.Fprintf(d.out, "#%d %s\n", s.index, strings.TrimRight(line, "\r"))
+		}
+	}
+}
+
+// flush writes the last incomplete log line of the step
+func (d *progressDisplay) flush(s *step) {
+	if s.partial != "" {
+		fmt.Fprintf(d.out, "#%d %s\n", s.index, s.partial)
+		s.partial = ""
+	}
+}
+
+// err reports back the first failing step
+func (d *progressDisplay) err() error {
+	if d.firstErr == nil {
+		return nil
+	}
+	return d.firstErr
+}
+
+// summary writes the durations of the steps which are not cached
+func (d *progressDisplay) summary() {
+	header := false
+	for _, s := range d.order {
+		d.flush(s)
+		if s.started == nil || s.completed == nil || s.cached {
+			continue
+		}
+
+		if !header {
+			fmt.Fprintln(d.out, "Step timings:")
+			header = true
+		}
+		fmt.Fprintf(d.out, "  %8s  %s\n", s.duration(), s.name)
+	}
+}
+
+func (s *step) duration() time.Duration {
+	if s.started == nil || s.completed == nil {
+		return 0
+	}
+
+	return s.completed.Sub(*s.started).Round(time.Millisecond)
+}
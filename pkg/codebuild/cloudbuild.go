@@ -1,11 +1,15 @@
 package codebuild
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -13,16 +17,63 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	awscb "github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codebuild/codebuildiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/mitchellh/mapstructure"
 	"github.com/mobingilabs/pullr/pkg/domain"
 )
 
+// buildScript builds and pushes the image. Cache images are pulled from
+// PULLR_CACHE_FROM or loaded from PULLR_CACHE_FILE before the build, they are
+// pushed to PULLR_CACHE_TO or saved to PULLR_CACHE_FILE after it. Missing
+// caches don't fail the builds.
 const buildScript = `
-docker build -f $PULLR_DOCKERFILE -t $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:$PULLR_TAG .;
+set -e;
 docker login -u $PULLR_REGISTRY_USER -p $PULLR_REGISTRY_PASSWORD $PULLR_REGISTRY;
-docker push $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:$PULLR_TAG;
+if test -n \"$PULLR_CACHE_FROM\"; then docker pull $PULLR_CACHE_FROM || true; fi;
+if test -f \"$PULLR_CACHE_FILE\"; then docker load -i $PULLR_CACHE_FILE || true; fi;
+docker build $PULLR_BUILD_FLAGS -f $PULLR_DOCKERFILE -t $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:$PULLR_TAG $PULLR_BUILD_CONTEXT;
+for tag in $PULLR_TAGS; do docker tag $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:$PULLR_TAG $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:\$tag; docker push $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:\$tag; done;
+if test -n \"$PULLR_CACHE_TO\"; then docker tag $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:$PULLR_TAG $PULLR_CACHE_TO; docker push $PULLR_CACHE_TO || true; fi;
+if test -n \"$PULLR_CACHE_FILE\"; then mkdir -p \$(dirname $PULLR_CACHE_FILE); docker tag $PULLR_REGISTRY/$PULLR_OWNER/$PULLR_NAME:$PULLR_TAG pullr-cache:latest; docker save -o $PULLR_CACHE_FILE pullr-cache:latest; fi;
 `
 
+// Local cache is saved as the localCacheImage by the build script, the saved
+// file is kept in the codebuild project's s3 cache
+const (
+	localCacheImage = "pullr-cache:latest"
+	localCacheDir   = "/root/.pullr-cache"
+	localCacheFile  = localCacheDir + "/image.tar"
+)
+
+// defaultImage is the codebuild image of the projects if it is not
+// configured
+const defaultImage = "aws/codebuild/docker:17.09.0"
+
+// buildKitImage is the codebuild image used for the builds with secrets,
+// secret mounts require a docker version supporting BuildKit
+const buildKitImage = "aws/codebuild/standard:5.0"
+
+// Builds are polled with exponential backoff between pollInterval and
+// maxPollInterval
+var (
+	pollInterval    = time.Second * 2
+	maxPollInterval = time.Second * 30
+)
+
+// maxPollErrors is the number of failing polls in a row after a build is
+// considered lost
+const maxPollErrors = 5
+
+// stopTimeout is the time limit for stopping a cancelled build
+const stopTimeout = time.Second * 30
+
+// maxDeleteParameters is the most parameters deleted by a single request
+const maxDeleteParameters = 10
+
 const buildSpecTemplate = `
 version: 0.2
 
@@ -30,160 +81,724 @@ phases:
   build:
     commands:
       - sh -c "%s"
+
+cache:
+  paths:
+    - '%s/**/*'
 `
 
-// Pipeline builds and pushes docker images to registries by using aws codebuild service
-type Pipeline struct {
-	cb       *awscb.CodeBuild
-	logs     *cloudwatchlogs.CloudWatchLogs
-	registry string
+// Config are the options for running builds on aws codebuild
+type Config struct {
+	// Region is the aws region, AWS_REGION environment variable is used if
+	// it is empty
+	Region string
+	// ServiceRole is the iam role of the codebuild projects,
+	// PULLR_CODEBUILD_SERVICE_ROLE environment variable is used if it is
+	// empty
+	ServiceRole string
+	// ComputeType is the default compute type of the projects like
+	// "BUILD_GENERAL1_SMALL", images can override it with the "computetype"
+	// builder option
+	ComputeType string
+	// Image is the default codebuild image of the projects, images can
+	// override it with the "image" builder option
+	Image string
+	// CacheBucket is the s3 bucket the local caches of the images are kept
+	// in, images with local cache are built without a cache if it is empty
+	CacheBucket string
 }
 
-func NewPipeline(registry string) (*Pipeline, error) {
-	region := os.Getenv("AWS_REGION")
-	if region == "" {
-		return nil, errors.New("AWS_REGION environment variable is required")
+// ConfigFromMap transforms generic configuration into codebuild specific
+// configuration
+func ConfigFromMap(in map[string]string) (*Config, error) {
+	config := Config{ComputeType: awscb.ComputeTypeBuildGeneral1Small, Image: defaultImage}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused: true,
+		Result:      &config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(in); err != nil {
+		return nil, err
+	}
+
+	if config.Region == "" {
+		config.Region = os.Getenv("AWS_REGION")
+	}
+	if config.ServiceRole == "" {
+		config.ServiceRole = os.Getenv("PULLR_CODEBUILD_SERVICE_ROLE")
+	}
+
+	if config.Region == "" {
+		return nil, errors.New("region option or AWS_REGION environment variable is required")
 	}
+	if config.ServiceRole == "" {
+		return nil, errors.New("servicerole option or PULLR_CODEBUILD_SERVICE_ROLE environment variable is required")
+	}
+	if !validComputeType(config.ComputeType) {
+		return nil, fmt.Errorf("unsupported compute type: %s", config.ComputeType)
+	}
+
+	return &config, nil
+}
+
+// Pipeline builds and pushes docker images to registries by using aws codebuild service
+type Pipeline struct {
+	cb          codebuildiface.CodeBuildAPI
+	logs        cloudwatchlogsiface.CloudWatchLogsAPI
+	ssm         ssmiface.SSMAPI
+	registry    string
+	serviceRole string
+	computeType string
+	image       string
+	cacheBucket string
+	secrets     *domain.SecretService
+	versions    domain.VersionStorage
 
-	sess, err := session.NewSession()
+	// Optional base image tracking
+	baseImages    domain.BaseImageStorage
+	imageRegistry domain.ImageRegistry
+	sources       map[string]domain.SourceClient
+}
+
+// NewPipeline creates a codebuild pipeline pushing the images to the given
+// registry
+func NewPipeline(registry string, config *Config) (*Pipeline, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(config.Region))
 	if err != nil {
 		return nil, err
 	}
 
-	return &Pipeline{awscb.New(sess), cloudwatchlogs.New(sess), registry}, nil
+	return &Pipeline{
+		cb:          awscb.New(sess),
+		logs:        cloudwatchlogs.New(sess),
+		ssm:         ssm.New(sess),
+		registry:    registry,
+		serviceRole: config.ServiceRole,
+		computeType: config.ComputeType,
+		image:       config.Image,
+		cacheBucket: config.CacheBucket,
+	}, nil
+}
+
+// Capabilities are the optional build features of the codebuild pipelines
+var Capabilities = domain.BuilderCapabilities{Secrets: true}
+
+// Capabilities reports back the optional build features of the pipeline
+func (p *Pipeline) Capabilities() domain.BuilderCapabilities {
+	return Capabilities
+}
+
+// UseSecrets makes the pipeline expose the image secrets to the builds. The
+// secrets are stored in the parameter store and the codebuild service role
+// should be allowed to read them.
+func (p *Pipeline) UseSecrets(secrets *domain.SecretService) {
+	p.secrets = secrets
+}
+
+// TrackBaseImages makes the pipeline record base images of the built images
+// along with their current digests. Repositories aren't cloned locally, so
+// the Dockerfiles are read with the source clients.
+func (p *Pipeline) TrackBaseImages(storage domain.BaseImageStorage, registry domain.ImageRegistry, sources map[string]domain.SourceClient) {
+	p.baseImages = storage
+	p.imageRegistry = registry
+	p.sources = sources
+}
+
+// UseVersions makes the pipeline publish the floating version tags of the
+// semantic version builds against the versions recorded in the storage
+func (p *Pipeline) UseVersions(versions domain.VersionStorage) {
+	p.versions = versions
 }
 
 // Run starts an aws codebuild build operation
 func (p *Pipeline) Run(ctx context.Context, logOut io.Writer, job *domain.BuildJob) (domain.BuildStatus, error) {
-	projectName := aws.String(cbProject(job))
-	projRes, err := p.cb.BatchGetProjects(&awscb.BatchGetProjectsInput{
-		Names: []*string{projectName},
-	})
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awscb.ErrCodeResourceNotFoundException {
-			if err := p.createProject(job); err != nil {
-				return domain.BuildFailed, err
-			}
-		} else {
+	if len(job.Platforms) > 0 {
+		fmt.Fprintf(logOut, "Build failed: %v\n", domain.ErrBuildPlatformsUnsupported)
+		return domain.BuildFailed, nil
+	}
+
+	var secrets []domain.BuildSecret
+	if p.secrets != nil {
+		var err error
+		secrets, err = p.secrets.BuildSecrets(job.ImageOwner, job.ImageKey)
+		if err != nil {
 			return domain.BuildFailed, err
 		}
+
+		redactor := domain.NewRedactingWriter(logOut, domain.SecretValues(secrets))
+		defer redactor.Flush()
+		logOut = redactor
+	}
+
+	if p.baseImages != nil {
+		// Base images don't change the build status
+		if err := p.recordBaseImages(ctx, job); err != nil {
+			fmt.Fprintf(logOut, "Base images could not be recorded: %v\n", err)
+		}
+	}
+
+	project, err := p.desiredProject(job)
+	if err != nil {
+		// Invalid image options would fail every retry of the job
+		fmt.Fprintf(logOut, "Build failed: %v\n", err)
+		return domain.BuildFailed, nil
+	}
+
+	if err := p.ensureProject(ctx, project); err != nil {
+		return domain.BuildFailed, err
+	}
+
+	buildCtx := job.BuildContext
+	if buildCtx == "" {
+		buildCtx = "."
+	}
+
+	secretEnv, params, err := p.putSecrets(ctx, job, secrets)
+	// Parameters are read when the build starts, they are kept only until
+	// the build is done
+	defer func() {
+		if err := p.removeParameters(params); err != nil {
+			fmt.Fprintf(logOut, "Build secrets could not be removed: %v\n", err)
+		}
+	}()
+	if err != nil {
+		return domain.BuildFailed, err
 	}
-	if len(projRes.Projects) == 0 {
-		if err := p.createProject(job); err != nil {
+
+	// Images are pushed by the build, so the floating tags are decided
+	// right before starting it
+	if p.versions != nil {
+		if err := domain.AddFloatingTags(p.versions, job); err != nil {
 			return domain.BuildFailed, err
 		}
 	}
 
-	res, err := p.cb.StartBuild(&awscb.StartBuildInput{
-		ProjectName: projectName,
-		EnvironmentVariablesOverride: []*awscb.EnvironmentVariable{
-			cbEnv("PULLR_REGISTRY", p.registry),
-			cbEnv("PULLR_TAG", job.Tag),
-			cbEnv("PULLR_OWNER", job.ImageOwner),
-			cbEnv("PULLR_NAME", job.ImageName),
-			cbEnv("PULLR_DOCKERFILE", job.Dockerfile),
-			cbEnvSecret("PULLR_REGISTRY_USER"),
-			cbEnvSecret("PULLR_REGISTRY_PASSWORD"),
-		},
-		SourceVersion: aws.String(job.CommitHash),
-	})
+	cacheEnv, cacheFrom := p.cacheEnv(job)
+	env := append([]*awscb.EnvironmentVariable{
+		cbEnv("PULLR_REGISTRY", p.registry),
+		cbEnv("PULLR_TAG", job.Tag),
+		cbEnv("PULLR_TAGS", strings.Join(job.AllTags(), " ")),
+		cbEnv("PULLR_OWNER", job.ImageOwner),
+		cbEnv("PULLR_NAME", job.ImageName),
+		cbEnv("PULLR_DOCKERFILE", shellQuote(job.Dockerfile)),
+		cbEnv("PULLR_BUILD_FLAGS", buildFlags(job, secrets, cacheFrom)),
+		cbEnv("PULLR_BUILD_CONTEXT", shellQuote(buildCtx)),
+		cbEnvSecret("PULLR_REGISTRY_USER"),
+		cbEnvSecret("PULLR_REGISTRY_PASSWORD"),
+	}, cacheEnv...)
+
+	input := &awscb.StartBuildInput{
+		ProjectName:                  project.Name,
+		EnvironmentVariablesOverride: append(env, secretEnv...),
+		SourceVersion:                aws.String(job.CommitHash),
+	}
+	if len(secrets) > 0 && aws.StringValue(project.Environment.Image) == defaultImage {
+		input.ImageOverride = aws.String(buildKitImage)
+	}
+
+	res, err := p.cb.StartBuildWithContext(ctx, input)
 	if err != nil {
 		return domain.BuildFailed, err
 	}
 
-	numGetErr := 0
-	status := domain.BuildInProgress
-	var logs *awscb.LogsLocation = nil
+	return p.waitBuild(ctx, logOut, aws.StringValue(res.Build.Id))
+}
+
+// waitBuild polls the build with backoff until it completes and streams its
+// logs meanwhile. Build is stopped if the context is done before it
+// completes.
+func (p *Pipeline) waitBuild(ctx context.Context, logOut io.Writer, id string) (domain.BuildStatus, error) {
+	var tail *logTail
+	interval := pollInterval
+	pollErrs := 0
 	for {
-		res2, err := p.cb.BatchGetBuilds(&awscb.BatchGetBuildsInput{Ids: []*string{res.Build.Id}})
+		select {
+		case <-ctx.Done():
+			p.stopBuild(id)
+			flushLogs(tail, logOut)
+			if ctx.Err() == context.DeadlineExceeded {
+				fmt.Fprintln(logOut, "Build failed: build timed out")
+				return domain.BuildTimeout, nil
+			}
+			return domain.BuildFailed, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+
+		res, err := p.cb.BatchGetBuildsWithContext(ctx, &awscb.BatchGetBuildsInput{Ids: []*string{aws.String(id)}})
 		if err != nil {
-			numGetErr++
-			if numGetErr > 5 {
+			if ctx.Err() != nil {
+				continue
+			}
+			if pollErrs++; pollErrs > maxPollErrors {
 				return domain.BuildFailed, err
 			}
-
-			time.Sleep(time.Second * 10)
 			continue
-		} else if len(res2.Builds) != 1 {
+		} else if len(res.Builds) != 1 {
 			return domain.BuildFailed, errors.New("started build could not found in codebuild")
 		}
+		pollErrs = 0
 
-		build := res2.Builds[0]
-		if *build.BuildComplete {
-			logs = build.Logs
-			switch *build.BuildStatus {
-			case awscb.StatusTypeSucceeded:
-				status = domain.BuildSucceed
-			case awscb.StatusTypeFailed:
-				status = domain.BuildFailed
-			case awscb.StatusTypeTimedOut:
-				status = domain.BuildTimeout
-			default:
-				// TODO: should we mark it as in progress if we don't know the status
-				status = domain.BuildInProgress
-			}
-			break
+		build := res.Builds[0]
+		if tail == nil && build.Logs != nil && build.Logs.GroupName != nil && build.Logs.StreamName != nil {
+			tail = &logTail{api: p.logs, group: *build.Logs.GroupName, stream: *build.Logs.StreamName}
+		}
+		if tail != nil {
+			// Logs are best effort, they don't change the build status
+			tail.fetch(ctx, logOut)
+		}
+
+		if !aws.BoolValue(build.BuildComplete) {
+			continue
+		}
+		flushLogs(tail, logOut)
+
+		status := aws.StringValue(build.BuildStatus)
+		switch status {
+		case awscb.StatusTypeSucceeded:
+			return domain.BuildSucceed, nil
+		case awscb.StatusTypeFailed:
+			return domain.BuildFailed, nil
+		case awscb.StatusTypeTimedOut:
+			return domain.BuildTimeout, nil
+		case awscb.StatusTypeFault:
+			fmt.Fprintln(logOut, "Build failed: codebuild fault")
+			return domain.BuildFailed, nil
+		case awscb.StatusTypeStopped:
+			fmt.Fprintln(logOut, "Build failed: build is stopped")
+			return domain.BuildFailed, nil
+		default:
+			return domain.BuildFailed, fmt.Errorf("codebuild: unknown build status: %s", status)
 		}
 	}
+}
 
-	if logs != nil {
-		logsInput := cloudwatchlogs.GetLogEventsInput{
-			LogGroupName:  logs.GroupName,
-			LogStreamName: logs.StreamName,
+func (p *Pipeline) recordBaseImages(ctx context.Context, job *domain.BuildJob) error {
+	source, ok := p.sources[job.ImageRepo.Provider]
+	if !ok {
+		return domain.ErrSourceUnsupportedProvider
+	}
+
+	dockerfile, err := source.FileContent(ctx, job.VcsToken, job.ImageRepo, job.CommitHash, job.Dockerfile)
+	if err != nil {
+		return err
+	}
+
+	return domain.RecordBaseImages(ctx, p.baseImages, p.imageRegistry, job.ImageOwner, job.ImageKey, bytes.NewReader(dockerfile))
+}
+
+// cacheEnv reports back the cache environment variables of the build script
+// and the image the build uses as its cache
+func (p *Pipeline) cacheEnv(job *domain.BuildJob) ([]*awscb.EnvironmentVariable, string) {
+	env := []*awscb.EnvironmentVariable{
+		cbEnv("PULLR_CACHE_FROM", ""),
+		cbEnv("PULLR_CACHE_TO", ""),
+		cbEnv("PULLR_CACHE_FILE", ""),
+	}
+	if job.NoCache {
+		return env, ""
+	}
+
+	ref := job.CacheRef(domain.RegistryHost(p.registry))
+	switch job.Cache {
+	case domain.CacheInline:
+		if ref == "" {
+			return env, ""
 		}
-		timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*10)
-		p.logs.GetLogEventsPagesWithContext(timeoutCtx, &logsInput, func(output *cloudwatchlogs.GetLogEventsOutput, lastPage bool) bool {
-			for _, ev := range output.Events {
-				if _, err := io.WriteString(logOut, *ev.Message); err != nil {
-					return false
-				}
-			}
-			return true
-		})
-		cancel()
+		env[0].Value = aws.String(ref)
+		return env, ref
+	case domain.CacheRegistry:
+		env[0].Value = aws.String(ref)
+		env[1].Value = aws.String(ref)
+		return env, ref
+	case domain.CacheLocal:
+		if p.cacheBucket == "" {
+			return env, ""
+		}
+		env[2].Value = aws.String(localCacheFile)
+		return env, localCacheImage
 	}
 
-	return status, nil
+	return env, ""
+}
+
+// stopBuild stops the build, context of the build is already done so the
+// build is stopped with its own time limit
+func (p *Pipeline) stopBuild(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	p.cb.StopBuildWithContext(ctx, &awscb.StopBuildInput{Id: aws.String(id)})
+}
+
+// flushLogs fetches the log events written after the last fetch of a
+// finished build, the fetch has its own time limit as the build's context
+// may be done
+func flushLogs(tail *logTail, out io.Writer) {
+	if tail == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	tail.fetch(ctx, out)
+}
+
+// logTail streams the events of a cloudwatch log stream incrementally
+type logTail struct {
+	api    cloudwatchlogsiface.CloudWatchLogsAPI
+	group  string
+	stream string
+	token  *string
+}
+
+// fetch writes the log events since the previous fetch
+func (t *logTail) fetch(ctx context.Context, out io.Writer) error {
+	for {
+		res, err := t.api.GetLogEventsWithContext(ctx, &cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  aws.String(t.group),
+			LogStreamName: aws.String(t.stream),
+			StartFromHead: aws.Bool(true),
+			NextToken:     t.token,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, ev := range res.Events {
+			if _, err := io.WriteString(out, aws.StringValue(ev.Message)); err != nil {
+				return err
+			}
+		}
+
+		// Same token is returned at the end of the stream
+		if res.NextForwardToken == nil || aws.StringValue(res.NextForwardToken) == aws.StringValue(t.token) {
+			return nil
+		}
+		t.token = res.NextForwardToken
+		if len(res.Events) == 0 {
+			return nil
+		}
+	}
 }
 
-func (p *Pipeline) createProject(job *domain.BuildJob) error {
-	name := cbProject(job)
-	sourceType := aws.String("")
+// desiredProject reports back the codebuild project of the image with the
+// image's builder options applied
+func (p *Pipeline) desiredProject(job *domain.BuildJob) (*awscb.Project, error) {
+	sourceType := ""
 	switch job.ImageRepo.Provider {
 	case "github":
-		sourceType = aws.String("GITHUB")
+		sourceType = awscb.SourceTypeGithub
 	default:
-		return fmt.Errorf("unsupported source repository provider: %s", job.ImageRepo.Provider)
+		return nil, fmt.Errorf("unsupported source repository provider: %s", job.ImageRepo.Provider)
 	}
 
 	repoURL, err := job.ImageRepo.URL()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	buildScriptOneLine := strings.Replace(buildScript, "\n", "", -1)
-	buildSpec := fmt.Sprintf(buildSpecTemplate, buildScriptOneLine)
+	computeType, image := p.computeType, p.image
+	if value := job.BuilderOptions["computetype"]; value != "" {
+		computeType = value
+	}
+	if value := job.BuilderOptions["image"]; value != "" {
+		image = value
+	}
+	if !validComputeType(computeType) {
+		return nil, fmt.Errorf("unsupported compute type: %s", computeType)
+	}
 
-	_, err = p.cb.CreateProject(&awscb.CreateProjectInput{
-		Name: aws.String(name),
+	return &awscb.Project{
+		Name: aws.String(projectName(job.ImageOwner, job.ImageKey)),
 		Source: &awscb.ProjectSource{
 			Location:  aws.String(repoURL),
-			Type:      sourceType,
-			Buildspec: aws.String(buildSpec),
+			Type:      aws.String(sourceType),
+			Buildspec: aws.String(buildSpec()),
 		},
 		Environment: &awscb.ProjectEnvironment{
 			Type:           aws.String(awscb.EnvironmentTypeLinuxContainer),
-			Image:          aws.String("aws/codebuild/docker:17.09.0"),
+			Image:          aws.String(image),
 			PrivilegedMode: aws.Bool(true),
-			ComputeType:    aws.String(awscb.ComputeTypeBuildGeneral1Small),
+			ComputeType:    aws.String(computeType),
 		},
 		Artifacts:   &awscb.ProjectArtifacts{Type: aws.String(awscb.ArtifactsTypeNoArtifacts)},
-		Cache:       &awscb.ProjectCache{Type: aws.String(awscb.CacheTypeNoCache)},
-		ServiceRole: aws.String(os.Getenv("PULLR_CODEBUILD_SERVICE_ROLE")),
+		Cache:       p.projectCache(job),
+		ServiceRole: aws.String(p.serviceRole),
+	}, nil
+}
+
+// projectCache reports back the cache of the image's project. Local caches
+// are kept in the cache bucket under the image's cache generation, so a new
+// generation starts with an empty cache.
+func (p *Pipeline) projectCache(job *domain.BuildJob) *awscb.ProjectCache {
+	if job.Cache != domain.CacheLocal || p.cacheBucket == "" {
+		return &awscb.ProjectCache{Type: aws.String(awscb.CacheTypeNoCache)}
+	}
+
+	return &awscb.ProjectCache{
+		Type:     aws.String(awscb.CacheTypeS3),
+		Location: aws.String(fmt.Sprintf("%s/pullr/%s/%d", p.cacheBucket, projectName(job.ImageOwner, job.ImageKey), job.CacheGeneration)),
+	}
+}
+
+// ensureProject creates the project if it doesn't exist, or updates it if
+// its settings differ from the desired project
+func (p *Pipeline) ensureProject(ctx context.Context, desired *awscb.Project) error {
+	res, err := p.cb.BatchGetProjectsWithContext(ctx, &awscb.BatchGetProjectsInput{
+		Names: []*string{desired.Name},
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awscb.ErrCodeResourceNotFoundException {
+		res, err = &awscb.BatchGetProjectsOutput{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(res.Projects) == 0 {
+		_, err := p.cb.CreateProjectWithContext(ctx, &awscb.CreateProjectInput{
+			Name:        desired.Name,
+			Source:      desired.Source,
+			Environment: desired.Environment,
+			Artifacts:   desired.Artifacts,
+			Cache:       desired.Cache,
+			ServiceRole: desired.ServiceRole,
+		})
+		return err
+	}
+
+	if !projectDiffers(res.Projects[0], desired) {
+		return nil
+	}
+
+	_, err = p.cb.UpdateProjectWithContext(ctx, &awscb.UpdateProjectInput{
+		Name:        desired.Name,
+		Source:      desired.Source,
+		Environment: desired.Environment,
+		Cache:       desired.Cache,
+		ServiceRole: desired.ServiceRole,
 	})
 	return err
 }
 
+// projectDiffers reports whether the settings managed by pullr differ
+// between the projects
+func projectDiffers(actual, desired *awscb.Project) bool {
+	if actual.Source == nil || actual.Environment == nil {
+		return true
+	}
+
+	actualCache := actual.Cache
+	if actualCache == nil {
+		actualCache = &awscb.ProjectCache{Type: aws.String(awscb.CacheTypeNoCache)}
+	}
+
+	return aws.StringValue(actual.Source.Location) != aws.StringValue(desired.Source.Location) ||
+		aws.StringValue(actual.Source.Type) != aws.StringValue(desired.Source.Type) ||
+		aws.StringValue(actual.Source.Buildspec) != aws.StringValue(desired.Source.Buildspec) ||
+		aws.StringValue(actual.Environment.Image) != aws.StringValue(desired.Environment.Image) ||
+		aws.StringValue(actual.Environment.ComputeType) != aws.StringValue(desired.Environment.ComputeType) ||
+		aws.BoolValue(actual.Environment.PrivilegedMode) != aws.BoolValue(desired.Environment.PrivilegedMode) ||
+		aws.StringValue(actual.ServiceRole) != aws.StringValue(desired.ServiceRole) ||
+		aws.StringValue(actualCache.Type) != aws.StringValue(desired.Cache.Type) ||
+		aws.StringValue(actualCache.Location) != aws.StringValue(desired.Cache.Location)
+}
+
+// CleanImage deletes the codebuild project of the image along with the build
+// secret parameters left behind by its builds
+func (p *Pipeline) CleanImage(ctx context.Context, owner, imageKey string) error {
+	_, err := p.cb.DeleteProjectWithContext(ctx, &awscb.DeleteProjectInput{
+		Name: aws.String(projectName(owner, imageKey)),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awscb.ErrCodeResourceNotFoundException {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return p.cleanParameters(ctx, owner, imageKey, "")
+}
+
+// CleanSecret deletes the parameters of the build secret left behind by the
+// builds of the image
+func (p *Pipeline) CleanSecret(ctx context.Context, owner, imageKey, name string) error {
+	return p.cleanParameters(ctx, owner, imageKey, name)
+}
+
+// PurgeCache invalidates the s3 cache of the image's codebuild project
+func (p *Pipeline) PurgeCache(ctx context.Context, owner, imageKey string) error {
+	_, err := p.cb.InvalidateProjectCacheWithContext(ctx, &awscb.InvalidateProjectCacheInput{
+		ProjectName: aws.String(projectName(owner, imageKey)),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awscb.ErrCodeResourceNotFoundException {
+		return nil
+	}
+
+	return err
+}
+
+func validComputeType(computeType string) bool {
+	switch computeType {
+	case awscb.ComputeTypeBuildGeneral1Small, awscb.ComputeTypeBuildGeneral1Medium, awscb.ComputeTypeBuildGeneral1Large:
+		return true
+	}
+
+	return false
+}
+
+// putSecrets stores the build secrets in the parameter store and reports
+// back the environment variables referencing them. Names of the stored
+// parameters are reported back even if storing some of them failed.
+func (p *Pipeline) putSecrets(ctx context.Context, job *domain.BuildJob, secrets []domain.BuildSecret) ([]*awscb.EnvironmentVariable, []string, error) {
+	if len(secrets) == 0 {
+		return nil, nil, nil
+	}
+
+	// Parameters of the concurrent builds of an image are kept apart
+	path := parameterPath(job.ImageOwner, job.ImageKey)
+	if job.ID != "" {
+		path += "/" + job.ID
+	}
+
+	var names []string
+	env := []*awscb.EnvironmentVariable{cbEnv("DOCKER_BUILDKIT", "1")}
+	for _, secret := range secrets {
+		name := path + "/" + secret.Name
+		_, err := p.ssm.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+			Name:      aws.String(name),
+			Value:     aws.String(secret.Value),
+			Type:      aws.String(ssm.ParameterTypeSecureString),
+			Overwrite: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, names, fmt.Errorf("secret %s: %v", secret.Name, err)
+		}
+		names = append(names, name)
+
+		env = append(env, &awscb.EnvironmentVariable{
+			Name:  aws.String(secretEnvName(secret.Name)),
+			Value: aws.String(name),
+			Type:  aws.String(awscb.EnvironmentVariableTypeParameterStore),
+		})
+	}
+
+	return env, names, nil
+}
+
+// removeParameters deletes the parameters stored for a build, context of the
+// build may be done so the parameters are deleted with their own time limit
+func (p *Pipeline) removeParameters(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	return p.deleteParameters(ctx, names)
+}
+
+// cleanParameters deletes the secret parameters stored under the image's
+// path. Only the parameters of the named secret are deleted unless the name
+// is empty.
+func (p *Pipeline) cleanParameters(ctx context.Context, owner, imageKey, secret string) error {
+	var names []string
+	input := &ssm.GetParametersByPathInput{
+		Path:      aws.String(parameterPath(owner, imageKey)),
+		Recursive: aws.Bool(true),
+	}
+	err := p.ssm.GetParametersByPathPagesWithContext(ctx, input, func(page *ssm.GetParametersByPathOutput, last bool) bool {
+		for _, param := range page.Parameters {
+			name := aws.StringValue(param.Name)
+			if secret == "" || strings.HasSuffix(name, "/"+secret) {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.deleteParameters(ctx, names)
+}
+
+// deleteParameters deletes the parameters in batches of the most the
+// parameter store accepts, parameters already gone are ignored
+func (p *Pipeline) deleteParameters(ctx context.Context, names []string) error {
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > maxDeleteParameters {
+			batch = batch[:maxDeleteParameters]
+		}
+		names = names[len(batch):]
+
+		_, err := p.ssm.DeleteParametersWithContext(ctx, &ssm.DeleteParametersInput{
+			Names: aws.StringSlice(batch),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parameterPath is the parameter store path of the image's build secrets
+func parameterPath(owner, imageKey string) string {
+	return fmt.Sprintf("/pullr/%s/%s", owner, strings.Replace(imageKey, ":", "/", -1))
+}
+
+func secretEnvName(name string) string {
+	return fmt.Sprintf("PULLR_SECRET_%s", name)
+}
+
+// buildFlags reports back the docker build flags of the job. Build script
+// is run by a shell wrapped in another shell, so flag values are quoted for
+// the inner one. Layers of the cacheFrom image are reused by the build.
+func buildFlags(job *domain.BuildJob, secrets []domain.BuildSecret, cacheFrom string) string {
+	var flags []string
+	if job.NoCache {
+		flags = append(flags, "--no-cache")
+	}
+	if cacheFrom != "" {
+		flags = append(flags, "--cache-from", shellQuote(cacheFrom))
+		if len(secrets) > 0 {
+			// BuildKit images are usable as caches only with inline metadata
+			flags = append(flags, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+		}
+	}
+	if job.Target != "" {
+		flags = append(flags, "--target", shellQuote(job.Target))
+	}
+	for _, arg := range job.BuildArgs {
+		flags = append(flags, "--build-arg", shellQuote(fmt.Sprintf("%s=%s", arg.Name, arg.Value)))
+	}
+	for _, secret := range secrets {
+		flags = append(flags, "--secret", fmt.Sprintf("id=%s,env=%s", secret.Name, secretEnvName(secret.Name)))
+	}
+
+	return strings.Join(flags, " ")
+}
+
+// shellQuote quotes s with single quotes for sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func buildSpec() string {
+	buildScriptOneLine := strings.Replace(buildScript, "\n", "", -1)
+	return fmt.Sprintf(buildSpecTemplate, buildScriptOneLine, localCacheDir)
+}
+
 func cbEnv(key, value string) *awscb.EnvironmentVariable {
 	return &awscb.EnvironmentVariable{
 		Name:  aws.String(key),
@@ -200,8 +815,23 @@ func cbEnvSecret(key string) *awscb.EnvironmentVariable {
 	}
 }
 
-func cbProject(job *domain.BuildJob) string {
-	// AWS CodeBuild only supports A-Za-z0-9\-\_ characters as project name
-	normalizedKey := strings.Replace(job.ImageKey, ":", "_", -1)
-	return fmt.Sprintf("pullr__%s__%s", job.ImageOwner, normalizedKey)
+// maxProjectNameLength is the maximum length of codebuild project names
+const maxProjectNameLength = 255
+
+// invalidProjectNameChars matches the characters codebuild doesn't accept in
+// project names
+var invalidProjectNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// projectName reports back the codebuild project name of the image. Invalid
+// characters are replaced with "_", too long names are truncated and
+// suffixed with the hash of the full name to keep them unique.
+func projectName(owner, imageKey string) string {
+	name := fmt.Sprintf("pullr__%s__%s", owner, imageKey)
+	if len(name) > maxProjectNameLength {
+		sum := sha256.Sum256([]byte(name))
+		suffix := hex.EncodeToString(sum[:8])
+		name = name[:maxProjectNameLength-len(suffix)-1] + "_" + suffix
+	}
+
+	return invalidProjectNameChars.ReplaceAllString(name, "_")
 }
@@ -0,0 +1,415 @@
+package codebuild
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	awscb "github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codebuild/codebuildiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+func init() {
+	pollInterval = time.Millisecond
+	maxPollInterval = time.Millisecond * 4
+}
+
+// fakeCodeBuild reports back the given build statuses in order, the last
+// status is repeated
+type fakeCodeBuild struct {
+	codebuildiface.CodeBuildAPI
+
+	mu       sync.Mutex
+	statuses []string
+	errs     int
+	polls    int
+	stopped  []string
+
+	projects    map[string]*awscb.Project
+	created     int
+	updated     int
+	deleted     []string
+	invalidated []string
+}
+
+func (f *fakeCodeBuild) BatchGetProjectsWithContext(ctx aws.Context, in *awscb.BatchGetProjectsInput, opts ...request.Option) (*awscb.BatchGetProjectsOutput, error) {
+	var res awscb.BatchGetProjectsOutput
+	if project, ok := f.projects[aws.StringValue(in.Names[0])]; ok {
+		res.Projects = append(res.Projects, project)
+	}
+	return &res, nil
+}
+
+func (f *fakeCodeBuild) CreateProjectWithContext(ctx aws.Context, in *awscb.CreateProjectInput, opts ...request.Option) (*awscb.CreateProjectOutput, error) {
+	f.created++
+	f.projects[*in.Name] = &awscb.Project{Name: in.Name, Source: in.Source, Environment: in.Environment, Cache: in.Cache, ServiceRole: in.ServiceRole}
+	return &awscb.CreateProjectOutput{}, nil
+}
+
+func (f *fakeCodeBuild) UpdateProjectWithContext(ctx aws.Context, in *awscb.UpdateProjectInput, opts ...request.Option) (*awscb.UpdateProjectOutput, error) {
+	f.updated++
+	f.projects[*in.Name] = &awscb.Project{Name: in.Name, Source: in.Source, Environment: in.Environment, Cache: in.Cache, ServiceRole: in.ServiceRole}
+	return &awscb.UpdateProjectOutput{}, nil
+}
+
+func (f *fakeCodeBuild) DeleteProjectWithContext(ctx aws.Context, in *awscb.DeleteProjectInput, opts ...request.Option) (*awscb.DeleteProjectOutput, error) {
+	f.deleted = append(f.deleted, *in.Name)
+	return &awscb.DeleteProjectOutput{}, nil
+}
+
+func (f *fakeCodeBuild) InvalidateProjectCacheWithContext(ctx aws.Context, in *awscb.InvalidateProjectCacheInput, opts ...request.Option) (*awscb.InvalidateProjectCacheOutput, error) {
+	f.invalidated = append(f.invalidated, *in.ProjectName)
+	return &awscb.InvalidateProjectCacheOutput{}, nil
+}
+
+func (f *fakeCodeBuild) BatchGetBuildsWithContext(ctx aws.Context, in *awscb.BatchGetBuildsInput, opts ...request.Option) (*awscb.BatchGetBuildsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.polls++
+	if f.errs > 0 {
+		f.errs--
+		return nil, errors.New("throttled")
+	}
+
+	status := f.statuses[0]
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+
+	return &awscb.BatchGetBuildsOutput{Builds: []*awscb.Build{{
+		Id:            in.Ids[0],
+		BuildStatus:   aws.String(status),
+		BuildComplete: aws.Bool(status != awscb.StatusTypeInProgress),
+		Logs:          &awscb.LogsLocation{GroupName: aws.String("/aws/codebuild/p"), StreamName: aws.String("s")},
+	}}}, nil
+}
+
+func (f *fakeCodeBuild) StopBuildWithContext(ctx aws.Context, in *awscb.StopBuildInput, opts ...request.Option) (*awscb.StopBuildOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = append(f.stopped, aws.StringValue(in.Id))
+	return &awscb.StopBuildOutput{}, nil
+}
+
+// fakeLogs serves a log stream growing by a line at every call
+type fakeLogs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	lines int
+}
+
+func (f *fakeLogs) GetLogEventsWithContext(ctx aws.Context, in *cloudwatchlogs.GetLogEventsInput, opts ...request.Option) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	from := 0
+	if in.NextToken != nil {
+		fmt.Sscanf(*in.NextToken, "f/%d", &from)
+	}
+
+	var events []*cloudwatchlogs.OutputLogEvent
+	if from < f.lines {
+		events = append(events, &cloudwatchlogs.OutputLogEvent{Message: aws.String(fmt.Sprintf("line %d\n", from))})
+		from++
+	} else {
+		f.lines++
+	}
+
+	return &cloudwatchlogs.GetLogEventsOutput{
+		Events:           events,
+		NextForwardToken: aws.String(fmt.Sprintf("f/%d", from)),
+	}, nil
+}
+
+// fakeSSM keeps the parameters in memory
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	params map[string]string
+}
+
+func (f *fakeSSM) PutParameterWithContext(ctx aws.Context, in *ssm.PutParameterInput, opts ...request.Option) (*ssm.PutParameterOutput, error) {
+	f.params[*in.Name] = *in.Value
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func (f *fakeSSM) GetParametersByPathPagesWithContext(ctx aws.Context, in *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool, opts ...request.Option) error {
+	var res ssm.GetParametersByPathOutput
+	for name := range f.params {
+		if strings.HasPrefix(name, *in.Path+"/") {
+			res.Parameters = append(res.Parameters, &ssm.Parameter{Name: aws.String(name)})
+		}
+	}
+	fn(&res, true)
+	return nil
+}
+
+func (f *fakeSSM) DeleteParametersWithContext(ctx aws.Context, in *ssm.DeleteParametersInput, opts ...request.Option) (*ssm.DeleteParametersOutput, error) {
+	if len(in.Names) > maxDeleteParameters {
+		return nil, errors.New("too many parameters")
+	}
+	for _, name := range in.Names {
+		delete(f.params, *name)
+	}
+	return &ssm.DeleteParametersOutput{}, nil
+}
+
+func TestWaitBuild(t *testing.T) {
+	cb := &fakeCodeBuild{statuses: []string{
+		awscb.StatusTypeInProgress, awscb.StatusTypeInProgress, awscb.StatusTypeSucceeded,
+	}, errs: 2}
+	p := &Pipeline{cb: cb, logs: &fakeLogs{}}
+
+	var out bytes.Buffer
+	status, err := p.waitBuild(context.Background(), &out, "build:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildSucceed {
+		t.Errorf("expected succeed status, got %s", status)
+	}
+	// Last line is written after the build is completed
+	if out.String() != "line 0\nline 1\nline 2\n" {
+		t.Errorf("expected logs to be streamed once, got %q", out.String())
+	}
+}
+
+func TestWaitBuildStatuses(t *testing.T) {
+	expected := map[string]domain.BuildStatus{
+		awscb.StatusTypeSucceeded: domain.BuildSucceed,
+		awscb.StatusTypeFailed:    domain.BuildFailed,
+		awscb.StatusTypeFault:     domain.BuildFailed,
+		awscb.StatusTypeStopped:   domain.BuildFailed,
+		awscb.StatusTypeTimedOut:  domain.BuildTimeout,
+	}
+
+	for cbStatus, expectedStatus := range expected {
+		p := &Pipeline{cb: &fakeCodeBuild{statuses: []string{cbStatus}}, logs: &fakeLogs{}}
+		status, err := p.waitBuild(context.Background(), &bytes.Buffer{}, "build:1")
+		if err != nil {
+			t.Errorf("%s: %v", cbStatus, err)
+		}
+		if status != expectedStatus {
+			t.Errorf("%s: expected %s status, got %s", cbStatus, expectedStatus, status)
+		}
+	}
+}
+
+func TestWaitBuildCancel(t *testing.T) {
+	cb := &fakeCodeBuild{statuses: []string{awscb.StatusTypeInProgress}}
+	p := &Pipeline{cb: cb, logs: &fakeLogs{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	var out bytes.Buffer
+	status, err := p.waitBuild(ctx, &out, "build:1")
+	if err != nil || status != domain.BuildTimeout {
+		t.Errorf("expected timeout status without an error, got %s: %v", status, err)
+	}
+	if !strings.Contains(out.String(), "Build failed: build timed out") {
+		t.Errorf("expected timeout in the logs, got %q", out.String())
+	}
+	if len(cb.stopped) != 1 || cb.stopped[0] != "build:1" {
+		t.Errorf("expected build to be stopped, got %v", cb.stopped)
+	}
+	if cb.polls > 10 {
+		t.Errorf("expected polls to back off, got %d polls", cb.polls)
+	}
+}
+
+func TestWaitBuildCancelled(t *testing.T) {
+	cb := &fakeCodeBuild{statuses: []string{awscb.StatusTypeInProgress}}
+	p := &Pipeline{cb: cb, logs: &fakeLogs{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := p.waitBuild(ctx, &bytes.Buffer{}, "build:1"); err != context.Canceled {
+		t.Errorf("expected cancelled error, got %v", err)
+	}
+	if len(cb.stopped) != 1 {
+		t.Errorf("expected build to be stopped, got %v", cb.stopped)
+	}
+}
+
+func TestWaitBuildLost(t *testing.T) {
+	cb := &fakeCodeBuild{statuses: []string{awscb.StatusTypeInProgress}, errs: maxPollErrors + 1}
+	p := &Pipeline{cb: cb, logs: &fakeLogs{}}
+
+	if _, err := p.waitBuild(context.Background(), &bytes.Buffer{}, "build:1"); err == nil {
+		t.Error("expected build to be lost after failing polls")
+	}
+}
+
+func TestEnsureProject(t *testing.T) {
+	cb := &fakeCodeBuild{projects: make(map[string]*awscb.Project)}
+	p := &Pipeline{cb: cb, ssm: &fakeSSM{params: make(map[string]string)}, serviceRole: "role", computeType: awscb.ComputeTypeBuildGeneral1Small, image: defaultImage}
+	job := &domain.BuildJob{
+		ImageOwner: "user",
+		ImageKey:   "github:owner:app",
+		ImageRepo:  domain.SourceRepository{Provider: "github", Owner: "owner", Name: "app"},
+	}
+
+	ensure := func() {
+		project, err := p.desiredProject(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.ensureProject(context.Background(), project); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ensure()
+	ensure()
+	if cb.created != 1 || cb.updated != 0 {
+		t.Errorf("expected project to be created once, created %d updated %d", cb.created, cb.updated)
+	}
+
+	job.BuilderOptions = map[string]string{"computetype": awscb.ComputeTypeBuildGeneral1Large, "image": "aws/codebuild/standard:5.0"}
+	ensure()
+	project := cb.projects["pullr__user__github_owner_app"]
+	if cb.updated != 1 || *project.Environment.ComputeType != awscb.ComputeTypeBuildGeneral1Large || *project.Environment.Image != "aws/codebuild/standard:5.0" {
+		t.Errorf("expected image options to update the project, got %+v", project.Environment)
+	}
+
+	p.serviceRole = "new-role"
+	ensure()
+	if cb.updated != 2 || *cb.projects["pullr__user__github_owner_app"].ServiceRole != "new-role" {
+		t.Error("expected service role change to update the project")
+	}
+
+	job.Cache = domain.CacheLocal
+	ensure()
+	if cb.updated != 2 {
+		t.Error("expected local cache without a cache bucket not to update the project")
+	}
+
+	p.cacheBucket = "cache-bucket"
+	job.CacheGeneration = 3
+	ensure()
+	cache := cb.projects["pullr__user__github_owner_app"].Cache
+	if cb.updated != 3 || *cache.Type != awscb.CacheTypeS3 || *cache.Location != "cache-bucket/pullr/pullr__user__github_owner_app/3" {
+		t.Errorf("expected local cache to update the project cache, got %+v", cache)
+	}
+
+	if err := p.PurgeCache(context.Background(), "user", "github:owner:app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.invalidated) != 1 || cb.invalidated[0] != "pullr__user__github_owner_app" {
+		t.Errorf("expected project cache to be invalidated, got %v", cb.invalidated)
+	}
+
+	job.BuilderOptions["computetype"] = "HUGE"
+	if _, err := p.desiredProject(job); err == nil {
+		t.Error("expected unsupported compute type to fail")
+	}
+
+	if err := p.CleanImage(context.Background(), "user", "github:owner:app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.deleted) != 1 || cb.deleted[0] != "pullr__user__github_owner_app" {
+		t.Errorf("expected project to be deleted, got %v", cb.deleted)
+	}
+}
+
+func TestSecretParameters(t *testing.T) {
+	params := &fakeSSM{params: map[string]string{"/pullr/user/github/owner/other/b0/KEY": "v"}}
+	p := &Pipeline{cb: &fakeCodeBuild{}, ssm: params}
+
+	var secrets []domain.BuildSecret
+	for i := 0; i < 12; i++ {
+		secrets = append(secrets, domain.BuildSecret{Name: fmt.Sprintf("KEY%d", i), Value: "v"})
+	}
+
+	first := &domain.BuildJob{ID: "b1", ImageOwner: "user", ImageKey: "github:owner:app"}
+	env, names, err := p.putSecrets(context.Background(), first, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 12 || len(env) != 13 {
+		t.Fatalf("expected 12 parameters, got %d with %d env vars", len(names), len(env))
+	}
+	if names[0] != "/pullr/user/github/owner/app/b1/KEY0" || aws.StringValue(env[1].Value) != names[0] {
+		t.Errorf("unexpected parameter %s referenced by %s", names[0], aws.StringValue(env[1].Value))
+	}
+
+	second := &domain.BuildJob{ID: "b2", ImageOwner: "user", ImageKey: "github:owner:app"}
+	if _, _, err := p.putSecrets(context.Background(), second, secrets[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.removeParameters(names); err != nil {
+		t.Fatal(err)
+	}
+	if len(params.params) != 3 {
+		t.Errorf("expected only the parameters of the other builds to be left, got %v", params.params)
+	}
+
+	if err := p.CleanSecret(context.Background(), "user", "github:owner:app", "KEY1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params.params["/pullr/user/github/owner/app/b2/KEY1"]; ok || len(params.params) != 2 {
+		t.Errorf("expected the secret's parameters to be deleted, got %v", params.params)
+	}
+
+	if err := p.CleanImage(context.Background(), "user", "github:owner:app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params.params["/pullr/user/github/owner/other/b0/KEY"]; !ok || len(params.params) != 1 {
+		t.Errorf("expected only the image's parameters to be deleted, got %v", params.params)
+	}
+}
+
+func TestProjectName(t *testing.T) {
+	tests := map[string]string{
+		"github:owner:app":           "pullr__user__github_owner_app",
+		"github:owner:my.repo:cache": "pullr__user__github_owner_my_repo_cache",
+		"github:owner:app/cache":     "pullr__user__github_owner_app_cache",
+	}
+	for key, expected := range tests {
+		if name := projectName("user", key); name != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, name)
+		}
+	}
+
+	long := projectName("user", "github:owner:"+strings.Repeat("a", 300))
+	other := projectName("user", "github:owner:"+strings.Repeat("a", 301))
+	if len(long) != maxProjectNameLength || long == other {
+		t.Errorf("expected unique names of %d characters, got %s and %s", maxProjectNameLength, long, other)
+	}
+}
+
+func TestCacheEnv(t *testing.T) {
+	p := &Pipeline{registry: "reg.pullr.io"}
+	job := &domain.BuildJob{ImageOwner: "owner", ImageName: "app", Cache: domain.CacheRegistry, CacheGeneration: 1}
+
+	env, cacheFrom := p.cacheEnv(job)
+	if cacheFrom != "reg.pullr.io/owner/app:buildcache-1" || *env[0].Value != cacheFrom || *env[1].Value != cacheFrom {
+		t.Errorf("expected registry cache to be pulled and pushed, got %s %v", cacheFrom, env)
+	}
+	if flags := buildFlags(job, nil, cacheFrom); flags != "--cache-from 'reg.pullr.io/owner/app:buildcache-1'" {
+		t.Errorf("unexpected build flags: %s", flags)
+	}
+
+	job.Cache, job.CacheFrom = domain.CacheInline, ""
+	if _, cacheFrom := p.cacheEnv(job); cacheFrom != "" {
+		t.Errorf("expected first inline cache build not to use a cache, got %s", cacheFrom)
+	}
+
+	job.Cache = domain.CacheLocal
+	p.cacheBucket = "cache-bucket"
+	env, cacheFrom = p.cacheEnv(job)
+	if cacheFrom != localCacheImage || *env[2].Value != localCacheFile {
+		t.Errorf("expected local cache to be loaded from the cache file, got %s %v", cacheFrom, env)
+	}
+}
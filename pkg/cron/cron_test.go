@@ -0,0 +1,71 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse_Invalid(t *testing.T) {
+	exprs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+
+	for _, expr := range exprs {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	from := time.Date(2018, time.May, 15, 10, 30, 20, 0, time.UTC) // Tuesday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2018, time.May, 15, 10, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2018, time.May, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2018, time.May, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2018, time.May, 16, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, time.May, 15, 10, 45, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2018, time.May, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 0 * * sat,sun", time.Date(2018, time.May, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2018, time.May, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 * 5", time.Date(2018, time.May, 18, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+
+		if next := s.Next(from); !next.Equal(tt.next) {
+			t.Errorf("%s: expected next to be %v, got %v", tt.expr, tt.next, next)
+		}
+	}
+}
+
+func TestSchedule_Next_Never(t *testing.T) {
+	s, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected zero time, got %v", next)
+	}
+}
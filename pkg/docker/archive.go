@@ -0,0 +1,201 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// injectedDockerfile is the name of the Dockerfiles which are outside of the
+// build context in the context archive
+const injectedDockerfile = ".pullr.Dockerfile"
+
+// contextArchive streams the build context directory as a tar archive. Files
+// matching the .dockerignore patterns are left out. If the Dockerfile is
+// outside of the context, it is added to the archive. The path of the
+// Dockerfile in the archive is reported back.
+func contextArchive(contextDir, dockerfile string) (io.ReadCloser, string, error) {
+	ignore, err := readDockerignore(contextDir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dockerfileName, err := filepath.Rel(contextDir, dockerfile)
+	inContext := err == nil && !strings.HasPrefix(dockerfileName, ".."+string(filepath.Separator)) && dockerfileName != ".."
+	if inContext {
+		dockerfileName = filepath.ToSlash(dockerfileName)
+	} else {
+		dockerfileName = injectedDockerfile
+	}
+
+	if _, err := os.Stat(contextDir); err != nil {
+		return nil, "", err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(contextDir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(contextDir, file)
+			if err != nil || rel == "." {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+
+			// Dockerfile and .dockerignore are always sent, daemon needs them
+			if rel != dockerfileName && rel != ".dockerignore" && ignore.matches(rel) {
+				if info.IsDir() && !ignore.hasExceptions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			return addToArchive(tw, file, rel, info)
+		})
+		if err == nil && !inContext {
+			var info os.FileInfo
+			info, err = os.Stat(dockerfile)
+			if err == nil {
+				err = addToArchive(tw, dockerfile, injectedDockerfile, info)
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, dockerfileName, nil
+}
+
+func addToArchive(tw *tar.Writer, file, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ignorePattern is a .dockerignore line, exceptions start with "!"
+type ignorePattern struct {
+	pattern   string
+	exception bool
+}
+
+type dockerignore []ignorePattern
+
+func readDockerignore(contextDir string) (dockerignore, error) {
+	f, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns dockerignore
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.exception = true
+			line = strings.TrimSpace(line[1:])
+		}
+		p.pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(line)), "/")
+		patterns = append(patterns, p)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// matches reports whether the file is ignored, the last matching pattern
+// decides like in docker cli
+func (d dockerignore) matches(file string) bool {
+	ignored := false
+	for _, p := range d {
+		if matchIgnorePattern(p.pattern, file) {
+			ignored = !p.exception
+		}
+	}
+
+	return ignored
+}
+
+func (d dockerignore) hasExceptions() bool {
+	for _, p := range d {
+		if p.exception {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIgnorePattern reports whether the file or any of its parent
+// directories matches the pattern. "**" matches any number of directories.
+func matchIgnorePattern(pattern, file string) bool {
+	return matchParts(strings.Split(pattern, "/"), strings.Split(file, "/"))
+}
+
+func matchParts(pattern, file []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(file); skip++ {
+			if matchParts(pattern[1:], file[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(file) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(pattern[0], file[0])
+	return err == nil && ok && matchParts(pattern[1:], file[1:])
+}
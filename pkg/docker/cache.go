@@ -0,0 +1,128 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// cacheKeyLabel is the label keeping the local cache key of the built images.
+// Purging an image's cache changes its key, so the layers built with the
+// older keys aren't reused.
+const cacheKeyLabel = "io.pullr.cache-key"
+
+// hasLocalCache reports whether the daemon has an image built with the local
+// cache key. It is false after the image's cache is purged and on the
+// daemons which haven't built the image yet, like the other hosts of a pool.
+func (d *Docker) hasLocalCache(ctx context.Context, key string) bool {
+	filters, err := json.Marshal(map[string][]string{"label": {cacheKeyLabel + "=" + key}})
+	if err != nil {
+		return false
+	}
+
+	res, err := d.do(ctx, http.MethodGet, "/images/json", url.Values{"filters": {string(filters)}}, nil, nil)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+
+	var images []struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&images); err != nil {
+		return false
+	}
+
+	return len(images) > 0
+}
+
+// pruneLocalCache removes the images built with the other cache keys of the
+// image, like the ones built before its cache is purged, so their layers
+// aren't reused. Images which couldn't be removed are reported to out.
+func (d *Docker) pruneLocalCache(ctx context.Context, out io.Writer, key string) {
+	filters, err := json.Marshal(map[string][]string{"label": {cacheKeyLabel}})
+	if err != nil {
+		return
+	}
+
+	res, err := d.do(ctx, http.MethodGet, "/images/json", url.Values{"filters": {string(filters)}}, nil, nil)
+	if err != nil {
+		fmt.Fprintf(out, "Previous local caches couldn't be listed: %v\n", err)
+		return
+	}
+	defer res.Body.Close()
+
+	var images []struct {
+		ID     string            `json:"Id"`
+		Labels map[string]string `json:"Labels"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&images); err != nil {
+		fmt.Fprintf(out, "Previous local caches couldn't be listed: %v\n", err)
+		return
+	}
+
+	// Keys of the image differ only by the cache generation at the end
+	prefix := path.Dir(key) + "/"
+	for _, img := range images {
+		imgKey := img.Labels[cacheKeyLabel]
+		if imgKey == key || !strings.HasPrefix(imgKey, prefix) || strings.Contains(imgKey[len(prefix):], "/") {
+			continue
+		}
+
+		res, err := d.do(ctx, http.MethodDelete, "/images/"+img.ID, url.Values{"force": {"1"}}, nil, nil)
+		if err != nil {
+			fmt.Fprintf(out, "Previous local cache %s couldn't be removed: %v\n", imgKey, err)
+			continue
+		}
+		res.Body.Close()
+	}
+}
+
+// pullCache pulls the cache image of a build. Builds don't fail for the
+// cache images, like the ones not pushed yet, they run without the cache.
+func (d *Docker) pullCache(ctx context.Context, out io.Writer, cache domain.BuildCache) bool {
+	registryHost := strings.SplitN(cache.Ref, "/", 2)[0]
+	auth, err := registryAuth(registryHost, cache.Username, cache.Password)
+	if err != nil {
+		fmt.Fprintf(out, "Skipping cache %s: %v\n", cache.Ref, err)
+		return false
+	}
+
+	repo, tag := splitTag(cache.Ref)
+	params := url.Values{"fromImage": {repo}, "tag": {tag}}
+	res, err := d.do(ctx, http.MethodPost, "/images/create", params, http.Header{"X-Registry-Auth": {auth}}, nil)
+	if err == nil {
+		defer res.Body.Close()
+		err = decodeStream(res.Body, ioutil.Discard, nil)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Skipping cache %s: %v\n", cache.Ref, err)
+		return false
+	}
+
+	fmt.Fprintf(out, "Using cache %s\n", cache.Ref)
+	return true
+}
+
+// pushCache pushes the built image to its registry cache image. Failing
+// cache pushes are reported to the build output, they don't fail the push.
+func (d *Docker) pushCache(ctx context.Context, out io.Writer, tag, cacheRef string, header http.Header) {
+	err := d.TagImage(ctx, tag, cacheRef)
+	if err == nil {
+		_, err = d.pushRemote(ctx, ioutil.Discard, cacheRef, header)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Cache %s couldn't be pushed: %v\n", cacheRef, err)
+		return
+	}
+
+	fmt.Fprintf(out, "Pushed cache %s\n", cacheRef)
+}
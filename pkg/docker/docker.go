@@ -2,103 +2,515 @@ package docker
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os/exec"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/mobingilabs/pullr/pkg/domain"
 )
 
+// defaultHost is the socket of the local docker daemon
+const defaultHost = "unix:///var/run/docker.sock"
+
+// Config are the options for connecting to a docker host
+type Config struct {
+	// Host is the docker daemon address, local docker daemon is used if it
+	// is empty
+	Host string
+	// CertPath is the directory of the tls certificates, tls is disabled if
+	// it is empty
+	CertPath string
+	// Hosts are the docker hosts of a host pool with their own cert paths
+	// like "tcp://10.0.0.2:2376=/certs/build1,tcp://10.0.0.3:2375", builds
+	// are scheduled to the least loaded healthy host
+	Hosts []HostConfig
+	// HealthInterval is the interval of the host pool health checks
+	HealthInterval time.Duration
+}
+
+// ConfigFromMap transforms generic configuration into docker specific
+// configuration
+func ConfigFromMap(in map[string]string) (*Config, error) {
+	config := Config{HealthInterval: time.Second * 30}
+	options := make(map[string]string, len(in))
+	for key, value := range in {
+		options[key] = value
+	}
+
+	if hosts, ok := options["hosts"]; ok {
+		delete(options, "hosts")
+		var err error
+		if config.Hosts, err = parseHosts(hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused: true,
+		Result:      &config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(options); err != nil {
+		return nil, err
+	}
+
+	if config.CertPath != "" && config.Host == "" {
+		return nil, errors.New("certpath requires host to be set")
+	}
+	if config.Host != "" && len(config.Hosts) > 0 {
+		return nil, errors.New("host and hosts can't be used together")
+	}
+	if config.HealthInterval < time.Second {
+		return nil, errors.New("healthinterval should be at least a second")
+	}
+
+	return &config, nil
+}
+
+// Capabilities are the optional build features of the docker builders
+var Capabilities = domain.BuilderCapabilities{Platforms: true, Secrets: true}
+
+// Factory creates docker image builders connected to the same docker host
 type Factory struct {
 	host     string
 	certPath string
 	tls      bool
 }
 
+// NewFactory creates a docker image builder factory, tls is enabled if the
+// certPath is given
 func NewFactory(host, certPath string) *Factory {
 	tls := certPath != ""
 	return &Factory{host, certPath, tls}
 }
 
+// Create creates a docker image builder
 func (f *Factory) Create() (domain.ImageBuilder, error) {
-	return New(f.host, f.certPath, f.tls), nil
+	return New(f.host, f.certPath, f.tls)
 }
 
-// Docker wraps docker executable to build and push images
+// Capabilities reports back the optional build features of the builders
+func (f *Factory) Capabilities() domain.BuilderCapabilities {
+	return Capabilities
+}
+
+// Docker builds and pushes images through the docker engine api
 type Docker struct {
-	env []string
+	client  *http.Client
+	baseURL string
+
+	// registryClient is the http client pushing the manifest lists of the
+	// multi platform images
+	registryClient *http.Client
+
+	mu sync.Mutex
+	// pending are the images built but not pushed yet by their primary tags
+	pending map[string]pendingPush
 }
 
-// New creates a new docker image builder with given docker host and certs path. Use empty
-// strings for both host and certPath for using the default docker configuration
-func New(host string, certPath string, tls bool) *Docker {
-	var env []string
-	if host != "" {
-		env = append(env, fmt.Sprintf("DOCKER_HOST=%s", host))
+// pendingPush is what a built image needs pushed besides its tags
+type pendingPush struct {
+	// platforms are the target platforms of a multi platform image
+	platforms []string
+	// cacheRef is the registry cache image the image is pushed to
+	cacheRef string
+}
+
+// New creates a new docker image builder with given docker host and certs
+// path. Hosts can be unix sockets like "unix:///var/run/docker.sock" or tcp
+// addresses like "tcp://10.0.0.2:2376". Use an empty host for the local
+// docker daemon. If tls is true, "ca.pem", "cert.pem" and "key.pem" files in
+// the certPath are used for connecting to the host.
+func New(host string, certPath string, tls bool) (*Docker, error) {
+	if host == "" {
+		host = defaultHost
 	}
-	if certPath != "" {
-		env = append(env, fmt.Sprintf("DOCKER_CERT_PATH=%s", certPath))
+
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("docker: host: %v", err)
 	}
-	if tls {
-		env = append(env, "DOCKER_TLS_VERIFY=1")
+
+	transport := &http.Transport{}
+	baseURL := ""
+	switch hostURL.Scheme {
+	case "unix":
+		socket := hostURL.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		baseURL = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if tls {
+			scheme = "https"
+			transport.TLSClientConfig, err = tlsConfig(certPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		baseURL = fmt.Sprintf("%s://%s", scheme, hostURL.Host)
+	default:
+		return nil, fmt.Errorf("docker: host: unsupported scheme %q", hostURL.Scheme)
 	}
 
-	return &Docker{env}
+	return &Docker{
+		client:  &http.Client{Transport: transport},
+		baseURL: baseURL,
+		pending: make(map[string]pendingPush),
+	}, nil
 }
 
+func tlsConfig(certPath string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("docker: tls: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("docker: tls: invalid ca certificate")
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("docker: tls: %v", err)
+	}
+
+	return &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Close closes the idle connections to the docker host
 func (d *Docker) Close() error {
+	if transport, ok := d.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
 	return nil
 }
 
-// TagImage tags and image
-func (d *Docker) TagImage(ctx context.Context, out io.Writer, imageTag, newTag string) error {
-	cmd := exec.CommandContext(ctx, "docker", "tag", imageTag, newTag)
-	cmd.Env = d.env
-	cmd.Stdout = out
-	cmd.Stderr = out
-	return cmd.Run()
+// apiError is the error body of the engine api responses
+type apiError struct {
+	Message string `json:"message"`
+}
+
+// do sends a request to the docker engine api. Responses with error
+// statuses are reported back as errors.
+func (d *Docker) do(ctx context.Context, method, path string, params url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	reqURL := d.baseURL + path
+	if len(params) > 0 {
+		reqURL += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	res, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		var apiErr apiError
+		data, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &requestError{res.StatusCode, apiErr.Message}
+	}
+
+	return res, nil
+}
+
+// requestError is a docker engine api error response
+type requestError struct {
+	status  int
+	message string
 }
 
-// Login, logs in to a docker registry
-func (d *Docker) Login(ctx context.Context, out io.Writer, registry, username, password string) error {
-	cmd := exec.CommandContext(ctx, "docker", "login", "-u", username, "-p", password, registry)
-	cmd.Env = d.env
-	cmd.Stdout = out
-	cmd.Stderr = out
-	return cmd.Run()
+func (e *requestError) Error() string {
+	return fmt.Sprintf("docker: %d: %s", e.status, e.message)
 }
 
-// PushImage pushes a container image to the given registry
-func (d *Docker) PushImage(ctx context.Context, out io.Writer, tag, registry, username, password string) error {
-	if err := d.Login(ctx, out, registry, username, password); err != nil {
+// Ping checks if the docker host is reachable
+func (d *Docker) Ping(ctx context.Context) error {
+	res, err := d.do(ctx, http.MethodGet, "/_ping", nil, nil, nil)
+	if err != nil {
 		return err
 	}
 
-	remoteTag := fmt.Sprintf("%s/%s", strings.TrimPrefix(registry, "https://"), tag)
-	if err := d.TagImage(ctx, out, tag, remoteTag); err != nil {
+	return res.Body.Close()
+}
+
+// TagImage tags an image with a new name
+func (d *Docker) TagImage(ctx context.Context, image, newTag string) error {
+	repo, tag := splitTag(newTag)
+	params := url.Values{"repo": {repo}, "tag": {tag}}
+	res, err := d.do(ctx, http.MethodPost, "/images/"+image+"/tag", params, nil, nil)
+	if err != nil {
 		return err
 	}
 
-	cmd := exec.CommandContext(ctx, "docker", "push", remoteTag)
-	cmd.Env = d.env
-	cmd.Stderr = out
-	cmd.Stdout = out
-	return cmd.Run()
+	return res.Body.Close()
 }
 
-// BuildImage builds a container image from a Dockerfile located at ctxPath.
-// ctxPath is also used as build context
-func (d *Docker) BuildImage(ctx context.Context, out io.Writer, ctxPath, dockerfile, tag string) (domain.BuildStatus, error) {
-	cmd := exec.Command("docker", "build", "-t", tag, "-f", dockerfile, ".")
-	cmd.Dir = ctxPath
-	cmd.Env = d.env
-	cmd.Stderr = out
-	cmd.Stdout = out
+// PushImage pushes the tags of a container image to the given registry.
+// Layers are shared between the tags so only the first push uploads them.
+// Credentials are sent in the request headers. Tags of the multi platform
+// images point to a manifest list of the platform images. Images built with
+// registry cache are pushed to their cache image too.
+func (d *Docker) PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error {
+	registryHost := domain.RegistryHost(registry)
+	auth, err := registryAuth(registryHost, username, password)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"X-Registry-Auth": {auth}}
+
+	d.mu.Lock()
+	pending := d.pending[tags[0]]
+	delete(d.pending, tags[0])
+	d.mu.Unlock()
+	if len(pending.platforms) > 0 {
+		return d.pushPlatforms(ctx, out, tags, pending.platforms, registryHost, username, password, header)
+	}
 
-	err := cmd.Run()
-	if _, ok := err.(*exec.ExitError); ok {
+	for _, tag := range tags {
+		if _, err := d.push(ctx, out, tag, registryHost, header); err != nil {
+			return err
+		}
+	}
+
+	if pending.cacheRef != "" {
+		d.pushCache(ctx, out, tags[0], pending.cacheRef, header)
+	}
+
+	return nil
+}
+
+// pushResult is the auxiliary message of the push progress stream
+type pushResult struct {
+	Tag    string
+	Digest string
+	Size   int64
+}
+
+// push tags the local image with the registry and pushes it
+func (d *Docker) push(ctx context.Context, out io.Writer, tag, registryHost string, header http.Header) (pushResult, error) {
+	remoteTag := fmt.Sprintf("%s/%s", registryHost, tag)
+	if err := d.TagImage(ctx, tag, remoteTag); err != nil {
+		return pushResult{}, err
+	}
+
+	return d.pushRemote(ctx, out, remoteTag, header)
+}
+
+// pushRemote pushes an image already tagged with its registry
+func (d *Docker) pushRemote(ctx context.Context, out io.Writer, remoteTag string, header http.Header) (pushResult, error) {
+	var result pushResult
+	repo, name := splitTag(remoteTag)
+	res, err := d.do(ctx, http.MethodPost, "/images/"+repo+"/push", url.Values{"tag": {name}}, header, nil)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+
+	if err := decodeStream(res.Body, out, &result); err != nil {
+		return result, fmt.Errorf("docker: push %s: %v", remoteTag, err)
+	}
+
+	return result, nil
+}
+
+// Prune removes the stopped containers and the dangling images left behind
+// by the builds
+func (d *Docker) Prune(ctx context.Context) error {
+	for _, path := range []string{"/containers/prune", "/images/prune"} {
+		res, err := d.do(ctx, http.MethodPost, path, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+
+	return nil
+}
+
+// registryAuth encodes the credentials for X-Registry-Auth header
+func registryAuth(serverAddress, username, password string) (string, error) {
+	data, err := json.Marshal(map[string]string{
+		"username":      username,
+		"password":      password,
+		"serveraddress": serverAddress,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// splitTag splits an image name like "registry:5000/owner/name:tag" into
+// its repository and tag, tag is "latest" if the name doesn't have one
+func splitTag(name string) (string, string) {
+	colon := strings.LastIndex(name, ":")
+	if colon < 0 || colon < strings.LastIndex(name, "/") {
+		return name, "latest"
+	}
+
+	return name[:colon], name[colon+1:]
+}
+
+// BuildImage builds a container image from the source located at ctxPath.
+// Dockerfile and build context paths in the options are relative to ctxPath.
+// Failing builds are reported with BuildFailed status and a nil error, errors
+// are reported back only if the build couldn't be run. Multi platform images
+// are built once for each platform. Local cache is kept in the daemon's
+// storage, images are labeled with the cache key and built without the cache
+// until the daemon has an image with the current key. Images of the previous
+// keys are removed then. Inline and registry caches are pulled before the
+// build. Images with secrets are built by BuildKit, secrets are exposed to
+// their secret mounts through a build session.
+func (d *Docker) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	if opts.Cache.Strategy == domain.CacheLocal && opts.Cache.Key != "" && !opts.NoCache && !d.hasLocalCache(ctx, opts.Cache.Key) {
+		fmt.Fprintf(out, "Local cache %s is not found, building without cache\n", opts.Cache.Key)
+		d.pruneLocalCache(ctx, out, opts.Cache.Key)
+		opts.NoCache = true
+	}
+	if len(opts.Platforms) > 0 {
+		if opts.Cache.Strategy != "" && opts.Cache.Strategy != domain.CacheLocal {
+			fmt.Fprintf(out, "Skipping %s cache, it is not supported for multi platform builds\n", opts.Cache.Strategy)
+		}
+		return d.buildPlatforms(ctx, out, ctxPath, opts)
+	}
+
+	var cacheFrom []string
+	if opts.Cache.Ref != "" && !opts.NoCache && d.pullCache(ctx, out, opts.Cache) {
+		cacheFrom = append(cacheFrom, opts.Cache.Ref)
+	}
+
+	status, err := d.build(ctx, out, ctxPath, opts, "", cacheFrom...)
+	if status == domain.BuildSucceed && opts.Cache.Strategy == domain.CacheRegistry && len(opts.Tags) > 0 {
+		d.mu.Lock()
+		d.pending[opts.Tags[0]] = pendingPush{cacheRef: opts.Cache.Ref}
+		d.mu.Unlock()
+	}
+
+	return status, err
+}
+
+// build builds the image for the given platform, daemon's platform is used
+// if it is empty. Layers of the cacheFrom images are reused by the build.
+func (d *Docker) build(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions, platform string, cacheFrom ...string) (domain.BuildStatus, error) {
+	contextDir := filepath.Join(ctxPath, opts.Context)
+	dockerfile := filepath.Join(ctxPath, opts.Dockerfile)
+
+	archive, dockerfileName, err := contextArchive(contextDir, dockerfile)
+	if err != nil {
+		return domain.BuildFailed, fmt.Errorf("docker: build context: %v", err)
+	}
+	defer archive.Close()
+
+	params := url.Values{
+		"dockerfile": {dockerfileName},
+		"t":          opts.Tags,
+		"rm":         {"1"},
+		"forcerm":    {"1"},
+	}
+	if opts.NoCache {
+		params.Set("nocache", "1")
+	}
+	if opts.Target != "" {
+		params.Set("target", opts.Target)
+	}
+	if platform != "" {
+		params.Set("platform", platform)
+	}
+	if len(cacheFrom) > 0 {
+		data, err := json.Marshal(cacheFrom)
+		if err != nil {
+			return domain.BuildFailed, err
+		}
+		params.Set("cachefrom", string(data))
+	}
+	if opts.Cache.Strategy == domain.CacheLocal && opts.Cache.Key != "" {
+		data, err := json.Marshal(map[string]string{cacheKeyLabel: opts.Cache.Key})
+		if err != nil {
+			return domain.BuildFailed, err
+		}
+		params.Set("labels", string(data))
+	}
+	if len(opts.BuildArgs) > 0 {
+		args := make(map[string]string, len(opts.BuildArgs))
+		for _, arg := range opts.BuildArgs {
+			args[arg.Name] = arg.Value
+		}
+		data, err := json.Marshal(args)
+		if err != nil {
+			return domain.BuildFailed, err
+		}
+		params.Set("buildargs", string(data))
+	}
+
+	if len(opts.Secrets) > 0 {
+		sess, err := d.startSession(ctx, opts.Secrets)
+		if reqErr, ok := err.(*requestError); ok && reqErr.status < 500 {
+			// Retrying wouldn't help, secrets need a daemon with BuildKit
+			fmt.Fprintf(out, "Build failed: build secrets need BuildKit: %s\n", reqErr.message)
+			return domain.BuildFailed, nil
+		} else if err != nil {
+			return domain.BuildFailed, err
+		}
+		defer sess.Close()
+
+		params.Set("version", "2")
+		params.Set("session", sess.id)
+	}
+
+	header := http.Header{"Content-Type": {"application/x-tar"}}
+	res, err := d.do(ctx, http.MethodPost, "/build", params, header, archive)
+	if reqErr, ok := err.(*requestError); ok && reqErr.status < 500 {
+		// Daemon rejected the build like for a missing Dockerfile
+		fmt.Fprintln(out, reqErr.message)
 		return domain.BuildFailed, nil
+	} else if err != nil {
+		return domain.BuildFailed, err
 	}
-	return domain.BuildFailed, err
+	defer res.Body.Close()
+
+	err = decodeStream(res.Body, out, nil)
+	if _, ok := err.(*streamError); ok {
+		fmt.Fprintf(out, "Build failed: %v\n", err)
+		return domain.BuildFailed, nil
+	} else if err != nil {
+		if ctx.Err() != nil {
+			return domain.BuildFailed, ctx.Err()
+		}
+		return domain.BuildFailed, err
+	}
+
+	return domain.BuildSucceed, nil
 }
@@ -0,0 +1,446 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/registry"
+)
+
+func newTestDocker(t *testing.T, handler http.HandlerFunc) (*Docker, func()) {
+	srv := httptest.NewServer(handler)
+	d, err := New(strings.Replace(srv.URL, "http://", "tcp://", 1), "", false)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return d, srv.Close
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"docker/Dockerfile":        "FROM scratch",
+		"app/main.go":              "package main",
+		"app/.dockerignore":        "*.log\nnode_modules\n",
+		"app/debug.log":            "ignored",
+		"app/node_modules/x/x.js":  "ignored",
+		"app/vendor/pkg/lib.go":    "package pkg",
+		"app/vendor/pkg/build.log": "not ignored, patterns are relative to the root",
+	})
+
+	var files []string
+	var query map[string][]string
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/build" {
+			http.NotFound(w, r)
+			return
+		}
+
+		query = r.URL.Query()
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, header.Name)
+		}
+
+		io.WriteString(w, `{"stream":"Step 1/2 : FROM scratch\n"}`)
+		io.WriteString(w, `{"stream":" ---> abc\nStep 2/2 : "}`)
+		io.WriteString(w, `{"stream":"COPY . .\n"}`)
+		io.WriteString(w, `{"aux":{"ID":"sha256:abc"}}`)
+		io.WriteString(w, `{"stream":"Successfully built abc\n"}`)
+	})
+	defer closeSrv()
+
+	var out bytes.Buffer
+	status, err := d.BuildImage(context.Background(), &out, dir, domain.ImageBuildOptions{
+		Dockerfile: "docker/Dockerfile",
+		Context:    "app",
+		Target:     "release",
+		BuildArgs:  []domain.BuildArg{{Name: "VERSION", Value: "1.0"}},
+		Tags:       []string{"owner/app:1.0", "owner/app:latest"},
+		NoCache:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildSucceed {
+		t.Errorf("expected succeed status, got %s", status)
+	}
+
+	expectedFiles := map[string]bool{
+		".dockerignore": true, "main.go": true, "vendor/": true, "vendor/pkg/": true,
+		"vendor/pkg/lib.go": true, "vendor/pkg/build.log": true, injectedDockerfile: true,
+	}
+	if len(files) != len(expectedFiles) {
+		t.Errorf("expected files %v, got %v", expectedFiles, files)
+	}
+	for _, file := range files {
+		if !expectedFiles[file] {
+			t.Errorf("unexpected file in context: %s", file)
+		}
+	}
+
+	if got := query["t"]; len(got) != 2 || got[0] != "owner/app:1.0" || got[1] != "owner/app:latest" {
+		t.Errorf("unexpected tags: %v", got)
+	}
+	if query["dockerfile"][0] != injectedDockerfile || query["target"][0] != "release" || query["nocache"][0] != "1" {
+		t.Errorf("unexpected build params: %v", query)
+	}
+	if query["buildargs"][0] != `{"VERSION":"1.0"}` {
+		t.Errorf("unexpected build args: %v", query["buildargs"])
+	}
+
+	expectedOut := "Step 1/2 : FROM scratch\n ---> abc\nStep 2/2 : COPY . .\nSuccessfully built abc\n"
+	if out.String() != expectedOut {
+		t.Errorf("expected output %q, got %q", expectedOut, out.String())
+	}
+}
+
+func TestBuildImageFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch\nRUN false"})
+
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, `{"stream":"Step 2/2 : RUN false\n"}`)
+		io.WriteString(w, `{"errorDetail":{"code":1,"message":"returned a non-zero code: 1"},"error":"returned a non-zero code: 1"}`)
+	})
+	defer closeSrv()
+
+	var out bytes.Buffer
+	status, err := d.BuildImage(context.Background(), &out, dir, domain.ImageBuildOptions{Dockerfile: "Dockerfile", Tags: []string{"o/a:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildFailed {
+		t.Errorf("expected failed status, got %s", status)
+	}
+	if !strings.Contains(out.String(), "step 2/2 (RUN false): returned a non-zero code: 1") {
+		t.Errorf("expected failing step in output, got %q", out.String())
+	}
+}
+
+func TestBuildImageCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch"})
+
+	done := make(chan struct{})
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, `{"stream":"Step 1/1 : FROM scratch\n"}`)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	defer closeSrv()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = d.BuildImage(ctx, ioutil.Discard, dir, domain.ImageBuildOptions{Dockerfile: "Dockerfile"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+func TestPushImage(t *testing.T) {
+	var tagged, pushed []string
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "secret") {
+			t.Error("credentials leaked into the url")
+		}
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/tag"):
+			tagged = append(tagged, r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasSuffix(r.URL.Path, "/push"):
+			data, err := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var auth map[string]string
+			if err := json.Unmarshal(data, &auth); err != nil {
+				t.Fatal(err)
+			}
+			if auth["username"] != "user" || auth["password"] != "secret" || auth["serveraddress"] != "reg.pullr.io" {
+				t.Errorf("unexpected registry auth: %v", auth)
+			}
+
+			pushed = append(pushed, strings.TrimPrefix(r.URL.Path, "/images/")+"@"+r.URL.Query().Get("tag"))
+			io.WriteString(w, `{"status":"Pushing","id":"abc","progressDetail":{"current":1}}`)
+			io.WriteString(w, `{"status":"Pushing","id":"abc","progressDetail":{"current":2}}`)
+			io.WriteString(w, `{"status":"Pushed","id":"abc"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	var out bytes.Buffer
+	err := d.PushImage(context.Background(), &out, []string{"owner/app:1.0", "owner/app:latest"}, "https://reg.pullr.io", "user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tagged) != 2 || tagged[0] != "reg.pullr.io/owner/app:1.0" || tagged[1] != "reg.pullr.io/owner/app:latest" {
+		t.Errorf("unexpected tags: %v", tagged)
+	}
+	if len(pushed) != 2 || pushed[0] != "reg.pullr.io/owner/app/push@1.0" {
+		t.Errorf("unexpected pushes: %v", pushed)
+	}
+	if strings.Count(out.String(), "abc: Pushing") != 2 {
+		t.Errorf("expected progress to be written once per push, got %q", out.String())
+	}
+}
+
+func TestBuildAndPushPlatforms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch"})
+
+	var lists []string
+	reg := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Content-Type") != registry.ManifestListType {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		var list registry.ManifestList
+		if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		var manifests []string
+		for _, m := range list.Manifests {
+			manifests = append(manifests, m.Platform.String()+"="+m.Digest)
+		}
+		lists = append(lists, strings.TrimPrefix(r.URL.Path, "/v2/")+" "+strings.Join(manifests, ","))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer reg.Close()
+	regHost := strings.TrimPrefix(reg.URL, "https://")
+
+	var built, pushed []string
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/build":
+			ioutil.ReadAll(r.Body)
+			built = append(built, r.URL.Query().Get("platform")+" "+r.URL.Query().Get("t"))
+			io.WriteString(w, `{"stream":"Successfully built abc\n"}`)
+		case strings.HasSuffix(r.URL.Path, "/tag"):
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasSuffix(r.URL.Path, "/push"):
+			tag := r.URL.Query().Get("tag")
+			pushed = append(pushed, tag)
+			fmt.Fprintf(w, `{"aux":{"Tag":%q,"Digest":"sha256:%s","Size":528}}`, tag, tag)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+	d.registryClient = reg.Client()
+
+	opts := domain.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"owner/app:1.0", "owner/app:latest"},
+		Platforms:  []string{"linux/amd64", "linux/arm/v7"},
+	}
+	var out bytes.Buffer
+	status, err := d.BuildImage(context.Background(), &out, dir, opts)
+	if err != nil || status != domain.BuildSucceed {
+		t.Fatalf("expected build to succeed, got %s: %v", status, err)
+	}
+	if fmt.Sprint(built) != "[linux/amd64 owner/app:1.0-linux-amd64 linux/arm/v7 owner/app:1.0-linux-arm-v7]" {
+		t.Errorf("expected image to be built for each platform, got %v", built)
+	}
+
+	if err := d.PushImage(context.Background(), &out, opts.Tags, "https://"+regHost, "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pushed) != "[1.0-linux-amd64 1.0-linux-arm-v7]" {
+		t.Errorf("expected platform images to be pushed, got %v", pushed)
+	}
+	expected := []string{
+		"owner/app/manifests/1.0 linux/amd64=sha256:1.0-linux-amd64,linux/arm/v7=sha256:1.0-linux-arm-v7",
+		"owner/app/manifests/latest linux/amd64=sha256:1.0-linux-amd64,linux/arm/v7=sha256:1.0-linux-arm-v7",
+	}
+	if fmt.Sprint(lists) != fmt.Sprint(expected) {
+		t.Errorf("expected manifest lists %v, got %v", expected, lists)
+	}
+	if len(d.pending) != 0 {
+		t.Errorf("expected platforms to be forgotten after the push, got %v", d.pending)
+	}
+}
+
+func TestBuildAndPushRegistryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch"})
+
+	var pulled, cacheFrom string
+	var pushed []string
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/images/create":
+			pulled = r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+			io.WriteString(w, `{"status":"Pull complete"}`)
+		case r.URL.Path == "/build":
+			ioutil.ReadAll(r.Body)
+			cacheFrom = r.URL.Query().Get("cachefrom")
+			io.WriteString(w, `{"stream":"Successfully built abc\n"}`)
+		case strings.HasSuffix(r.URL.Path, "/tag"):
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasSuffix(r.URL.Path, "/push"):
+			pushed = append(pushed, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/push")+":"+r.URL.Query().Get("tag"))
+			io.WriteString(w, `{"status":"Pushed"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	ref := "reg.pullr.io/owner/app:buildcache-2"
+	opts := domain.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"owner/app:1.0"},
+		Cache:      domain.BuildCache{Strategy: domain.CacheRegistry, Ref: ref},
+	}
+	var out bytes.Buffer
+	status, err := d.BuildImage(context.Background(), &out, dir, opts)
+	if err != nil || status != domain.BuildSucceed {
+		t.Fatalf("expected build to succeed, got %s: %v", status, err)
+	}
+	if pulled != ref || cacheFrom != `["`+ref+`"]` {
+		t.Errorf("expected build to use the cache image, pulled %q cache from %q", pulled, cacheFrom)
+	}
+
+	if err := d.PushImage(context.Background(), &out, opts.Tags, "https://reg.pullr.io", "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pushed) != "[reg.pullr.io/owner/app:1.0 "+ref+"]" {
+		t.Errorf("expected image to be pushed to the cache image, got %v", pushed)
+	}
+}
+
+func TestBuildImageLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch"})
+
+	cached := map[string]bool{}
+	var query url.Values
+	var removed []string
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/images/json":
+			var filters map[string][]string
+			json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+			if filters["label"][0] == cacheKeyLabel {
+				var images []string
+				for label := range cached {
+					key := strings.TrimPrefix(label, cacheKeyLabel+"=")
+					images = append(images, fmt.Sprintf(`{"Id":"sha256:%s","Labels":{%q:%q}}`, key, cacheKeyLabel, key))
+				}
+				io.WriteString(w, "["+strings.Join(images, ",")+"]")
+			} else if cached[filters["label"][0]] {
+				io.WriteString(w, `[{"Id":"sha256:abc"}]`)
+			} else {
+				io.WriteString(w, `[]`)
+			}
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/images/"):
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/images/sha256:"))
+			io.WriteString(w, `[]`)
+		case r.URL.Path == "/build":
+			ioutil.ReadAll(r.Body)
+			query = r.URL.Query()
+			io.WriteString(w, `{"stream":"Successfully built abc\n"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	opts := domain.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"owner/app:1.0"},
+		Cache:      domain.BuildCache{Strategy: domain.CacheLocal, Key: "owner/app/2"},
+	}
+	cached[cacheKeyLabel+"=owner/app/1"] = true
+	cached[cacheKeyLabel+"=owner/app-other/1"] = true
+
+	for _, expectNoCache := range []bool{true, false} {
+		status, err := d.BuildImage(context.Background(), ioutil.Discard, dir, opts)
+		if err != nil || status != domain.BuildSucceed {
+			t.Fatalf("expected build to succeed, got %s: %v", status, err)
+		}
+		if noCache := query.Get("nocache") == "1"; noCache != expectNoCache {
+			t.Errorf("expected nocache %v, got %v", expectNoCache, noCache)
+		}
+		if labels := query.Get("labels"); labels != `{"`+cacheKeyLabel+`":"owner/app/2"}` {
+			t.Errorf("expected image to be labeled with the cache key, got %s", labels)
+		}
+		cached[cacheKeyLabel+"=owner/app/2"] = true
+	}
+	if len(removed) != 1 || removed[0] != "owner/app/1" {
+		t.Errorf("expected only the image of the previous cache to be removed, got %v", removed)
+	}
+}
@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/registry"
+)
+
+// platformTag reports back the tag of the image built for the platform like
+// "owner/app:1.0-linux-arm64" for "owner/app:1.0" and "linux/arm64"
+func platformTag(tag, platform string) string {
+	return tag + "-" + strings.Replace(platform, "/", "-", -1)
+}
+
+// buildPlatforms builds the image once for each platform, platform images
+// are tagged with the platform tags of the primary tag. Platforms are
+// remembered until the image is pushed.
+func (d *Docker) buildPlatforms(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	if len(opts.Tags) == 0 {
+		return domain.BuildFailed, errors.New("docker: multi platform builds require a tag")
+	}
+
+	for _, platform := range opts.Platforms {
+		if _, err := registry.ParsePlatform(platform); err != nil {
+			return domain.BuildFailed, err
+		}
+
+		fmt.Fprintf(out, "Building for %s\n", platform)
+		platformOpts := opts
+		platformOpts.Tags = []string{platformTag(opts.Tags[0], platform)}
+		status, err := d.build(ctx, out, ctxPath, platformOpts, platform)
+		if err != nil || status != domain.BuildSucceed {
+			return status, err
+		}
+	}
+
+	d.mu.Lock()
+	d.pending[opts.Tags[0]] = pendingPush{platforms: opts.Platforms}
+	d.mu.Unlock()
+
+	return domain.BuildSucceed, nil
+}
+
+// pushPlatforms pushes the platform images and points all the tags to a
+// manifest list of them. Platform images are kept in the registry with their
+// platform tags, so they aren't garbage collected.
+func (d *Docker) pushPlatforms(ctx context.Context, out io.Writer, tags, platforms []string, registryHost, username, password string, header http.Header) error {
+	var manifests []registry.Descriptor
+	for _, platform := range platforms {
+		result, err := d.push(ctx, out, platformTag(tags[0], platform), registryHost, header)
+		if err != nil {
+			return err
+		}
+		if result.Digest == "" {
+			return fmt.Errorf("docker: push %s: digest is not reported", platformTag(tags[0], platform))
+		}
+
+		p, _ := registry.ParsePlatform(platform)
+		manifests = append(manifests, registry.Descriptor{
+			MediaType: registry.ManifestType,
+			Size:      result.Size,
+			Digest:    result.Digest,
+			Platform:  p,
+		})
+	}
+
+	client := registry.NewClient(d.registryClient)
+	client.Login(registryHost, username, password)
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s/%s", registryHost, tag)
+		if err := client.PutManifestList(ctx, ref, manifests); err != nil {
+			return fmt.Errorf("docker: push manifest list %s: %v", ref, err)
+		}
+		fmt.Fprintf(out, "Pushed manifest list %s for %s\n", ref, strings.Join(platforms, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// healthTimeout is the time limit of a host health check
+const healthTimeout = time.Second * 10
+
+// unhealthyAfter is the number of failing health checks after a host is
+// taken out of the scheduling
+const unhealthyAfter = 2
+
+// ErrNoHealthyHost is returned when there isn't any host to lease for a build
+var ErrNoHealthyHost = errors.New("docker: no healthy build hosts")
+
+// ErrHostNotFound is returned for the operations on unknown hosts
+var ErrHostNotFound = errors.New("docker: build host not found")
+
+// HostConfig is a docker host of a host pool
+type HostConfig struct {
+	// Host is the docker daemon address like "tcp://10.0.0.2:2376"
+	Host string
+	// CertPath is the directory of the host's tls certificates, tls is
+	// disabled if it is empty
+	CertPath string
+}
+
+// parseHosts parses the comma separated docker hosts with their optional
+// cert paths like "tcp://10.0.0.2:2376=/certs/build1,tcp://10.0.0.3:2375"
+func parseHosts(in string) ([]HostConfig, error) {
+	var hosts []HostConfig
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(in, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var host HostConfig
+		parts := strings.SplitN(item, "=", 2)
+		host.Host = parts[0]
+		if len(parts) == 2 {
+			host.CertPath = parts[1]
+		}
+
+		hostURL, err := url.Parse(host.Host)
+		if err != nil || hostURL.Scheme != "tcp" || hostURL.Host == "" {
+			return nil, fmt.Errorf("invalid host %q, hosts should be like tcp://10.0.0.2:2376", host.Host)
+		}
+		if seen[hostURL.Host] {
+			return nil, fmt.Errorf("duplicate host %q", host.Host)
+		}
+		seen[hostURL.Host] = true
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// HostStats are the metrics of a build host
+type HostStats struct {
+	Name         string    `json:"name"`
+	Host         string    `json:"host"`
+	Healthy      bool      `json:"healthy"`
+	Draining     bool      `json:"draining"`
+	ActiveBuilds int       `json:"active_builds"`
+	TotalBuilds  int       `json:"total_builds"`
+	FailedBuilds int       `json:"failed_builds"`
+	LastCheck    time.Time `json:"last_check"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// poolHost is the scheduling state of a host
+type poolHost struct {
+	docker   *Docker
+	stats    HostStats
+	failures int
+}
+
+// HostPool leases the least loaded healthy docker host to each build. Hosts
+// are health checked periodically, hosts failing the checks aren't leased
+// until they pass a check again. Draining hosts aren't leased either, the
+// builds already running on them continue.
+type HostPool struct {
+	mu    sync.Mutex
+	hosts []*poolHost
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewHostPool creates a docker host pool checking the health of the hosts
+// at every interval. Hosts are checked once before it returns.
+func NewHostPool(hosts []HostConfig, interval time.Duration) (*HostPool, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("docker: host pool requires at least one host")
+	}
+
+	p := &HostPool{done: make(chan struct{})}
+	for _, config := range hosts {
+		d, err := New(config.Host, config.CertPath, config.CertPath != "")
+		if err != nil {
+			return nil, err
+		}
+
+		// Hosts are unhealthy until their first successful check
+		hostURL, _ := url.Parse(config.Host)
+		p.hosts = append(p.hosts, &poolHost{
+			docker: d,
+			stats:  HostStats{Name: hostURL.Host, Host: config.Host},
+		})
+	}
+
+	p.check()
+	p.wg.Add(1)
+	go p.checkLoop(interval)
+
+	return p, nil
+}
+
+func (p *HostPool) checkLoop(interval time.Duration) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// check pings all the hosts concurrently and updates their health
+func (p *HostPool) check() {
+	var wg sync.WaitGroup
+	for _, host := range p.hosts {
+		wg.Add(1)
+		go func(host *poolHost) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+			err := host.docker.Ping(ctx)
+			cancel()
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			host.stats.LastCheck = time.Now()
+			if err != nil {
+				host.failures++
+				host.stats.LastError = err.Error()
+				if host.failures >= unhealthyAfter {
+					host.stats.Healthy = false
+				}
+				return
+			}
+
+			host.failures = 0
+			host.stats.LastError = ""
+			host.stats.Healthy = true
+		}(host)
+	}
+	wg.Wait()
+}
+
+// Create leases the healthy host with the least active builds
+func (p *HostPool) Create() (domain.ImageBuilder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var leased *poolHost
+	for _, host := range p.hosts {
+		if !host.stats.Healthy || host.stats.Draining {
+			continue
+		}
+		if leased == nil || host.stats.ActiveBuilds < leased.stats.ActiveBuilds {
+			leased = host
+		}
+	}
+
+	if leased == nil {
+		return nil, ErrNoHealthyHost
+	}
+
+	leased.stats.ActiveBuilds++
+	leased.stats.TotalBuilds++
+	return &leasedBuilder{Docker: leased.docker, pool: p, host: leased}, nil
+}
+
+// Capabilities reports back the optional build features of the builders
+func (p *HostPool) Capabilities() domain.BuilderCapabilities {
+	return Capabilities
+}
+
+// Stats reports back the metrics of the hosts
+func (p *HostPool) Stats() []HostStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]HostStats, len(p.hosts))
+	for i, host := range p.hosts {
+		stats[i] = host.stats
+	}
+
+	return stats
+}
+
+// Drain stops or resumes leasing the named host to new builds
+func (p *HostPool) Drain(name string, drain bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, host := range p.hosts {
+		if host.stats.Name == name {
+			host.stats.Draining = drain
+			return nil
+		}
+	}
+
+	return ErrHostNotFound
+}
+
+// Close stops the health checks and closes the connections to the hosts
+func (p *HostPool) Close() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	close(p.done)
+	p.wg.Wait()
+	for _, host := range p.hosts {
+		host.docker.Close()
+	}
+
+	return nil
+}
+
+// release ends the lease of a host
+func (p *HostPool) release(host *poolHost, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	host.stats.ActiveBuilds--
+	if failed {
+		host.stats.FailedBuilds++
+	}
+}
+
+// leasedBuilder builds on a leased host and ends the lease when it is
+// closed, connections to the host are kept for the other builds
+type leasedBuilder struct {
+	*Docker
+	pool     *HostPool
+	host     *poolHost
+	failed   bool
+	released bool
+}
+
+// BuildImage builds a container image on the leased host
+func (b *leasedBuilder) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	status, err := b.Docker.BuildImage(ctx, out, ctxPath, opts)
+	if err != nil || status != domain.BuildSucceed {
+		b.failed = true
+	}
+
+	return status, err
+}
+
+// Close ends the lease of the host
+func (b *leasedBuilder) Close() error {
+	if !b.released {
+		b.released = true
+		b.pool.release(b.host, b.failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPingServer serves the docker ping endpoint, it fails while down is set
+func newPingServer(down *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_ping" || atomic.LoadInt32(down) == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+}
+
+func hostName(srv *httptest.Server) string {
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestHostPool(t *testing.T) {
+	var up, down, flaky int32 = 0, 1, 0
+	srvs := []*httptest.Server{newPingServer(&up), newPingServer(&down), newPingServer(&flaky)}
+	var hosts []HostConfig
+	for _, srv := range srvs {
+		defer srv.Close()
+		hosts = append(hosts, HostConfig{Host: strings.Replace(srv.URL, "http://", "tcp://", 1)})
+	}
+
+	pool, err := NewHostPool(hosts, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	leased := map[string]int{}
+	first, _ := pool.Create()
+	second, _ := pool.Create()
+	third, err := pool.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*leasedBuilder{first.(*leasedBuilder), second.(*leasedBuilder), third.(*leasedBuilder)} {
+		leased[b.host.stats.Name]++
+	}
+	if leased[hostName(srvs[0])] != 2 || leased[hostName(srvs[2])] != 1 || leased[hostName(srvs[1])] != 0 {
+		t.Errorf("expected builds to be spread over the healthy hosts, got %v", leased)
+	}
+
+	// Host is taken out after failing checks in a row
+	atomic.StoreInt32(&flaky, 1)
+	pool.check()
+	if stats := pool.Stats(); !stats[2].Healthy {
+		t.Error("expected host to stay healthy after a single failing check")
+	}
+	pool.check()
+	if stats := pool.Stats(); stats[2].Healthy || stats[2].LastError == "" {
+		t.Errorf("expected host to be unhealthy, got %+v", stats[2])
+	}
+
+	first.Close()
+	first.Close()
+	if err := pool.Drain(hostName(srvs[0]), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Create(); err != ErrNoHealthyHost {
+		t.Errorf("expected no hosts to lease, got %v", err)
+	}
+
+	stats := pool.Stats()
+	if stats[0].ActiveBuilds != 1 || stats[0].TotalBuilds != 2 || !stats[0].Draining {
+		t.Errorf("unexpected host stats: %+v", stats[0])
+	}
+
+	if err := pool.Drain("unknown:1234", true); err != ErrHostNotFound {
+		t.Errorf("expected host not found error, got %v", err)
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := parseHosts("tcp://10.0.0.2:2376=/certs/build1, tcp://10.0.0.3:2375")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0].CertPath != "/certs/build1" || hosts[1].Host != "tcp://10.0.0.3:2375" || hosts[1].CertPath != "" {
+		t.Errorf("unexpected hosts: %+v", hosts)
+	}
+
+	for _, in := range []string{"10.0.0.2:2376", "unix:///var/run/docker.sock", "tcp://a:1,tcp://a:1"} {
+		if _, err := parseHosts(in); err == nil {
+			t.Errorf("expected %q to be invalid", in)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Protobuf wire types of the fields used by the buildkit messages
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+// readProto calls fn for each field of the protobuf message with its number
+// and value. Varint values are reported in num and length delimited values
+// in data, values of the fixed size fields are skipped.
+func readProto(msg []byte, fn func(field int, num uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errInvalidProto
+		}
+		msg = msg[n:]
+
+		field := int(key >> 3)
+		var num uint64
+		var data []byte
+		switch key & 7 {
+		case wireVarint:
+			num, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errInvalidProto
+			}
+			msg = msg[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errInvalidProto
+			}
+			data = msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return errInvalidProto
+			}
+			msg = msg[8:]
+			continue
+		case wireFixed32:
+			if len(msg) < 4 {
+				return errInvalidProto
+			}
+			msg = msg[4:]
+			continue
+		default:
+			return errInvalidProto
+		}
+
+		if err := fn(field, num, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendProtoBytes appends a length delimited field to the protobuf message
+func appendProtoBytes(msg []byte, field int, data []byte) []byte {
+	msg = appendUvarint(msg, uint64(field)<<3|wireBytes)
+	msg = appendUvarint(msg, uint64(len(data)))
+	return append(msg, data...)
+}
+
+// appendProtoVarint appends a varint field to the protobuf message
+func appendProtoVarint(msg []byte, field int, num uint64) []byte {
+	msg = appendUvarint(msg, uint64(field)<<3|wireVarint)
+	return appendUvarint(msg, num)
+}
+
+func appendUvarint(msg []byte, num uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], num)
+	return append(msg, buf[:n]...)
+}
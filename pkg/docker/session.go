@@ -0,0 +1,217 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// Grpc methods of the build sessions called back by the daemon
+const (
+	healthCheckMethod = "/grpc.health.v1.Health/Check"
+	getSecretMethod   = "/moby.buildkit.secrets.v1.Secrets/GetSecret"
+)
+
+// Grpc status codes reported by the build sessions
+const (
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+)
+
+// healthServing is the encoded health check response with serving status
+var healthServing = appendProtoVarint(nil, 1, 1)
+
+// session exposes the build secrets to the BuildKit builds referring to its
+// id. Daemon calls the session's grpc methods back over the hijacked
+// /session connection, so the secrets are never sent along with the build.
+type session struct {
+	id      string
+	secrets map[string]string
+	conn    io.ReadWriteCloser
+	server  *http.Server
+}
+
+// startSession opens a build session exposing the secrets, it is served
+// until it is closed. Daemons without BuildKit reject the session with a
+// request error.
+func (d *Docker) startSession(ctx context.Context, secrets []domain.BuildSecret) (*session, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(key[:])
+
+	header := http.Header{
+		"Connection":                          {"Upgrade"},
+		"Upgrade":                             {"h2c"},
+		"X-Docker-Expose-Session-Uuid":        {id},
+		"X-Docker-Expose-Session-Name":        {"pullr"},
+		"X-Docker-Expose-Session-Sharedkey":   {id},
+		"X-Docker-Expose-Session-Grpc-Method": {healthCheckMethod, getSecretMethod},
+	}
+	res, err := d.do(ctx, http.MethodPost, "/session", nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	if res.StatusCode != http.StatusSwitchingProtocols || !ok {
+		res.Body.Close()
+		return nil, &requestError{res.StatusCode, "build sessions are not supported"}
+	}
+
+	s := &session{
+		id:      id,
+		secrets: make(map[string]string, len(secrets)),
+		conn:    conn,
+	}
+	for _, secret := range secrets {
+		s.secrets[secret.Name] = secret.Value
+	}
+
+	// Daemon is the grpc client of the session, it speaks http/2 with prior
+	// knowledge over the upgraded connection
+	s.server = &http.Server{Handler: s, Protocols: new(http.Protocols)}
+	s.server.Protocols.SetUnencryptedHTTP2(true)
+	go s.server.Serve(newConnListener(sessionConn{conn}))
+
+	return s, nil
+}
+
+// Close stops serving the session
+func (s *session) Close() error {
+	s.server.Close()
+	return s.conn.Close()
+}
+
+// ServeHTTP serves the grpc methods of the session
+func (s *session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	switch r.URL.Path {
+	case healthCheckMethod:
+		writeGrpc(w, healthServing, 0, "")
+	case getSecretMethod:
+		req, err := readGrpc(r.Body)
+		if err != nil {
+			writeGrpc(w, nil, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		var id string
+		readProto(req, func(field int, _ uint64, data []byte) error {
+			if field == 1 {
+				id = string(data)
+			}
+			return nil
+		})
+
+		value, ok := s.secrets[id]
+		if !ok {
+			writeGrpc(w, nil, grpcNotFound, fmt.Sprintf("secret %s not found", id))
+			return
+		}
+		writeGrpc(w, appendProtoBytes(nil, 1, []byte(value)), 0, "")
+	default:
+		writeGrpc(w, nil, grpcUnimplemented, fmt.Sprintf("method %s is not implemented", r.URL.Path))
+	}
+}
+
+// readGrpc reads the single message of a grpc request body
+func readGrpc(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, r)
+
+	return msg, nil
+}
+
+// writeGrpc writes the grpc response message if the status is ok, status is
+// reported in the trailers
+func writeGrpc(w http.ResponseWriter, msg []byte, status int, message string) {
+	w.WriteHeader(http.StatusOK)
+	if status == 0 {
+		var buf bytes.Buffer
+		var prefix [5]byte
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+		buf.Write(prefix[:])
+		buf.Write(msg)
+		w.Write(buf.Bytes())
+	}
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	w.Header().Set("Grpc-Message", message)
+}
+
+// sessionConn is the upgraded session connection. Connection is hijacked
+// from the http client, so its deadlines can't be set.
+type sessionConn struct {
+	io.ReadWriteCloser
+}
+
+func (sessionConn) LocalAddr() net.Addr                { return sessionAddr{} }
+func (sessionConn) RemoteAddr() net.Addr               { return sessionAddr{} }
+func (sessionConn) SetDeadline(t time.Time) error      { return nil }
+func (sessionConn) SetReadDeadline(t time.Time) error  { return nil }
+func (sessionConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sessionAddr struct{}
+
+func (sessionAddr) Network() string { return "session" }
+func (sessionAddr) String() string  { return "session" }
+
+// connListener accepts the single connection it is created with
+type connListener struct {
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	conns := make(chan net.Conn, 1)
+	conns <- conn
+	return &connListener{conns: conns, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return sessionAddr{}
+}
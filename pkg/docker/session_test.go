@@ -0,0 +1,203 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// callGrpc calls the grpc method of a build session and reports back the
+// grpc status with the response message
+func callGrpc(t *testing.T, client *http.Client, method string, msg []byte) (string, []byte) {
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	req, err := http.NewRequest(http.MethodPost, "http://session"+method, bytes.NewReader(append(body, msg...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= 5 {
+		data = data[5:]
+	}
+
+	return res.Trailer.Get("Grpc-Status"), data
+}
+
+// traceMessage encodes a BuildKit trace message of the progress stream
+func traceMessage(t *testing.T, status []byte) string {
+	data, err := json.Marshal(map[string]interface{}{"id": buildkitTrace, "aux": status})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBuildImageSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM alpine\nRUN --mount=type=secret,id=KEY make"})
+
+	var mu sync.Mutex
+	sessions := make(map[string]*http.Client)
+	var secret, missing, health string
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/session":
+			methods := r.Header["X-Docker-Expose-Session-Grpc-Method"]
+			if r.Header.Get("Upgrade") != "h2c" || len(methods) != 2 {
+				t.Errorf("unexpected session request %v", r.Header)
+			}
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+
+			// Daemon calls the session's methods with http/2 over the
+			// upgraded connection
+			transport := &http.Transport{Protocols: new(http.Protocols)}
+			transport.Protocols.SetUnencryptedHTTP2(true)
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return conn, nil
+			}
+
+			mu.Lock()
+			sessions[r.Header.Get("X-Docker-Expose-Session-Uuid")] = &http.Client{Transport: transport}
+			mu.Unlock()
+		case "/build":
+			ioutil.ReadAll(r.Body)
+			if r.URL.Query().Get("version") != "2" {
+				t.Errorf("expected buildkit build, got %s", r.URL.RawQuery)
+			}
+
+			mu.Lock()
+			client := sessions[r.URL.Query().Get("session")]
+			mu.Unlock()
+			if client == nil {
+				http.Error(w, `{"message":"no active session"}`, http.StatusBadRequest)
+				return
+			}
+
+			health, _ = callGrpc(t, client, healthCheckMethod, nil)
+			missing, _ = callGrpc(t, client, getSecretMethod, appendProtoBytes(nil, 1, []byte("MISSING")))
+			status, msg := callGrpc(t, client, getSecretMethod, appendProtoBytes(nil, 1, []byte("KEY")))
+			if status == "0" {
+				readProto(msg, func(field int, _ uint64, data []byte) error {
+					secret = string(data)
+					return nil
+				})
+			}
+
+			vertex := appendProtoBytes(nil, 1, []byte("sha256:1"))
+			vertex = appendProtoBytes(vertex, 3, []byte("[2/2] RUN --mount=type=secret,id=KEY make"))
+			vertex = appendProtoBytes(vertex, 5, appendProtoVarint(nil, 1, 1))
+			log := appendProtoBytes(nil, 1, []byte("sha256:1"))
+			log = appendProtoBytes(log, 4, []byte("cc -o app main.c\nbuil"))
+			io.WriteString(w, traceMessage(t, appendProtoBytes(appendProtoBytes(nil, 1, vertex), 3, log)))
+
+			log = appendProtoBytes(nil, 1, []byte("sha256:1"))
+			log = appendProtoBytes(log, 4, []byte("t\n"))
+			io.WriteString(w, traceMessage(t, appendProtoBytes(nil, 3, log)))
+			io.WriteString(w, `{"id":"moby.image.id","aux":{"ID":"sha256:abc"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	var out bytes.Buffer
+	opts := domain.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"owner/app:1.0"},
+		Secrets:    []domain.BuildSecret{{Name: "KEY", Value: "s3cr3t"}},
+	}
+	status, err := d.BuildImage(context.Background(), &out, dir, opts)
+	if err != nil || status != domain.BuildSucceed {
+		t.Fatalf("expected build to succeed, got %s: %v", status, err)
+	}
+
+	if secret != "s3cr3t" || missing != fmt.Sprint(grpcNotFound) || health != "0" {
+		t.Errorf("unexpected session responses: secret %q, missing secret status %s, health status %s", secret, missing, health)
+	}
+
+	expected := "[2/2] RUN --mount=type=secret,id=KEY make\ncc -o app main.c\nbuilt\n"
+	if out.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+}
+
+func TestBuildImageSecretsUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch"})
+
+	d, closeSrv := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/build" {
+			t.Error("expected build not to be started")
+		}
+		http.NotFound(w, r)
+	})
+	defer closeSrv()
+
+	var out bytes.Buffer
+	opts := domain.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Secrets:    []domain.BuildSecret{{Name: "KEY", Value: "s3cr3t"}},
+	}
+	status, err := d.BuildImage(context.Background(), &out, dir, opts)
+	if err != nil || status != domain.BuildFailed {
+		t.Fatalf("expected build to fail, got %s: %v", status, err)
+	}
+	if !strings.Contains(out.String(), "Build failed: build secrets need BuildKit") {
+		t.Errorf("expected failure in output, got %q", out.String())
+	}
+}
+
+func TestTraceWriterFailure(t *testing.T) {
+	vertex := appendProtoBytes(nil, 1, []byte("sha256:1"))
+	vertex = appendProtoBytes(vertex, 3, []byte("[2/2] RUN false"))
+	vertex = appendProtoBytes(vertex, 5, nil)
+	vertex = appendProtoBytes(vertex, 7, []byte("exit code: 1"))
+	stream := traceMessage(t, appendProtoBytes(nil, 1, vertex)) +
+		`{"errorDetail":{"message":"failed to solve"},"error":"failed to solve"}`
+
+	var out bytes.Buffer
+	err := decodeStream(strings.NewReader(stream), &out, nil)
+	if err == nil || err.Error() != "step [2/2] RUN false: failed to solve" {
+		t.Errorf("expected failing step error, got %v", err)
+	}
+	if out.String() != "[2/2] RUN false\n[2/2] RUN false ERROR: exit code: 1\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
@@ -0,0 +1,244 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// message is an item of the engine api's json progress stream
+type message struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// stepLine matches the build step lines like "Step 2/5 : RUN make"
+var stepLine = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)$`)
+
+// ansiEscape matches the terminal control sequences in the build output
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// streamError is an error reported in the progress stream, like a failing
+// build step
+type streamError struct {
+	step    string
+	message string
+}
+
+func (e *streamError) Error() string {
+	if e.step == "" {
+		return e.message
+	}
+	return fmt.Sprintf("step %s: %s", e.step, e.message)
+}
+
+// buildkitTrace is the id of the auxiliary messages carrying the progress of
+// the BuildKit builds
+const buildkitTrace = "moby.buildkit.trace"
+
+// decodeStream writes the progress stream to out as plain log lines. Status
+// messages are written once per layer and status, so progress bars don't
+// flood the logs. Progress of the BuildKit builds is decoded from their trace
+// messages. The error in the stream is reported back along with the step it
+// happened in. Auxiliary messages like the pushed image digests are decoded
+// into aux if it isn't nil.
+func decodeStream(r io.Reader, out io.Writer, aux interface{}) error {
+	decoder := json.NewDecoder(r)
+	lastStatus := make(map[string]string)
+	step := ""
+	partial := ""
+	trace := newTraceWriter(out)
+	defer trace.flush()
+
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != "" || msg.ErrorDetail != nil {
+			errMsg := msg.Error
+			if errMsg == "" {
+				errMsg = msg.ErrorDetail.Message
+			}
+			if partial != "" {
+				fmt.Fprintln(out, partial)
+			}
+			if step == "" {
+				step = trace.failed
+			}
+			return &streamError{step, strings.TrimSpace(errMsg)}
+		}
+
+		if msg.ID == buildkitTrace && len(msg.Aux) > 0 {
+			var data []byte
+			if err := json.Unmarshal(msg.Aux, &data); err != nil {
+				return err
+			}
+			if err := trace.write(data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(msg.Aux) > 0 && aux != nil {
+			if err := json.Unmarshal(msg.Aux, aux); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg.Stream != "" {
+			// Stream chunks don't always end at line boundaries
+			text := partial + ansiEscape.ReplaceAllString(msg.Stream, "")
+			lines := strings.Split(text, "\n")
+			partial = lines[len(lines)-1]
+			for _, line := range lines[:len(lines)-1] {
+				line = strings.TrimRight(line, "\r")
+				if m := stepLine.FindStringSubmatch(line); m != nil {
+					step = fmt.Sprintf("%s/%s (%s)", m[1], m[2], m[3])
+				}
+				fmt.Fprintln(out, line)
+			}
+			continue
+		}
+
+		if msg.Status != "" && lastStatus[msg.ID] != msg.Status {
+			lastStatus[msg.ID] = msg.Status
+			if msg.ID != "" {
+				fmt.Fprintf(out, "%s: %s\n", msg.ID, msg.Status)
+			} else {
+				fmt.Fprintln(out, msg.Status)
+			}
+		}
+	}
+
+	if partial != "" {
+		fmt.Fprintln(out, partial)
+	}
+
+	return nil
+}
+
+// traceWriter writes the progress of the BuildKit builds as plain log lines.
+// Build steps are written once when they start, their outputs are written
+// line by line.
+type traceWriter struct {
+	out     io.Writer
+	started map[string]bool
+	partial map[string]string
+	// failed is the name of the last failing build step
+	failed string
+}
+
+func newTraceWriter(out io.Writer) *traceWriter {
+	return &traceWriter{
+		out:     out,
+		started: make(map[string]bool),
+		partial: make(map[string]string),
+	}
+}
+
+// write writes a progress update, the protobuf encoded StatusResponse of
+// the buildkit control api
+func (t *traceWriter) write(data []byte) error {
+	return readProto(data, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			return t.vertex(data)
+		case 3:
+			return t.log(data)
+		}
+		return nil
+	})
+}
+
+// vertex writes a build step when it starts, is cached or fails
+func (t *traceWriter) vertex(data []byte) error {
+	var digest, name, errMsg string
+	var cached, started bool
+	err := readProto(data, func(field int, num uint64, data []byte) error {
+		switch field {
+		case 1:
+			digest = string(data)
+		case 3:
+			name = string(data)
+		case 4:
+			cached = num != 0
+		case 5:
+			started = true
+		case 7:
+			errMsg = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if (started || cached) && !t.started[digest] {
+		t.started[digest] = true
+		if cached {
+			fmt.Fprintf(t.out, "%s CACHED\n", name)
+		} else {
+			fmt.Fprintln(t.out, name)
+		}
+	}
+	if errMsg != "" {
+		t.flushVertex(digest)
+		t.failed = name
+		fmt.Fprintf(t.out, "%s ERROR: %s\n", name, errMsg)
+	}
+
+	return nil
+}
+
+// log writes the complete lines of a build step's output
+func (t *traceWriter) log(data []byte) error {
+	var digest, msg string
+	err := readProto(data, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			digest = string(data)
+		case 4:
+			msg = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Log chunks don't always end at line boundaries
+	lines := strings.Split(t.partial[digest]+ansiEscape.ReplaceAllString(msg, ""), "\n")
+	t.partial[digest] = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		fmt.Fprintln(t.out, strings.TrimRight(line, "\r"))
+	}
+
+	return nil
+}
+
+// flush writes the incomplete last lines of the build step outputs
+func (t *traceWriter) flush() {
+	for digest := range t.partial {
+		t.flushVertex(digest)
+	}
+}
+
+func (t *traceWriter) flushVertex(digest string) {
+	if partial := t.partial[digest]; partial != "" {
+		fmt.Fprintln(t.out, partial)
+	}
+	delete(t.partial, digest)
+}
@@ -60,7 +60,7 @@ func TestAuthService_Register(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cred, err := storage.AuthStorage().Get("test")
+	cred, err := storage.AuthStorage().GetPassword("test")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,284 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const baseImageWatcherLease = "baseimage-watcher"
+
+// BaseImage is a base image used by an image's Dockerfile along with its
+// digest at the time the image is built
+type BaseImage struct {
+	Owner    string `json:"owner" bson:"owner"`
+	ImageKey string `json:"image_key" bson:"image_key"`
+	Ref      string `json:"ref" bson:"ref"`
+	Digest   string `json:"digest" bson:"digest"`
+	// TriggeredAt is the last time the image is rebuilt because of a change
+	// in this base image
+	TriggeredAt time.Time `json:"triggered_at,omitempty" bson:"triggered_at,omitempty"`
+}
+
+// BaseImageStorage stores and queries base images of the images
+type BaseImageStorage interface {
+	// List retrieves base images of the matching image
+	List(username string, imgKey string) ([]BaseImage, error)
+
+	// Put replaces base images of the matching image
+	Put(username string, imgKey string, bases []BaseImage) error
+
+	// Delete deletes base images of the matching image
+	Delete(username string, imgKey string) error
+
+	// Refs retrieves distinct base image references used by all users
+	Refs() ([]string, error)
+
+	// Dependents retrieves base image records of all users with the given
+	// reference
+	Dependents(ref string) ([]BaseImage, error)
+
+	// Update updates digest and trigger time of the matching base image record
+	Update(base BaseImage) error
+}
+
+// ImageRegistry queries docker registries
+type ImageRegistry interface {
+	// Digest reports back the current content digest of the image reference
+	Digest(ctx context.Context, ref string) (string, error)
+}
+
+// PlatformRegistry queries the platform images of multi platform images
+type PlatformRegistry interface {
+	// PlatformDigests reports back the digests of the platform images listed
+	// in the manifest list of the image reference by their platforms
+	PlatformDigests(ctx context.Context, ref string) (map[string]string, error)
+}
+
+// RecordBaseImages parses the base images of the Dockerfile and stores them
+// with their current digests for the image. Digests of the base images which
+// can not be resolved are stored empty.
+func RecordBaseImages(ctx context.Context, storage BaseImageStorage, registry ImageRegistry, username, imgKey string, dockerfile io.Reader) error {
+	refs, err := ParseBaseImages(dockerfile)
+	if err != nil {
+		return err
+	}
+
+	existing, err := storage.List(username, imgKey)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	bases := make([]BaseImage, len(refs))
+	for i, ref := range refs {
+		digest, _ := registry.Digest(ctx, ref)
+		bases[i] = BaseImage{Owner: username, ImageKey: imgKey, Ref: ref, Digest: digest}
+
+		// Keep trigger times for rate limiting the rebuilds
+		for _, old := range existing {
+			if old.Ref == ref {
+				bases[i].TriggeredAt = old.TriggeredAt
+				break
+			}
+		}
+	}
+
+	return storage.Put(username, imgKey, bases)
+}
+
+// BaseImageWatcherConfig is the configuration for base image watcher
+type BaseImageWatcherConfig struct {
+	// Interval is the duration between two registry checks
+	Interval time.Duration
+	// Cooldown is the minimum duration between two rebuilds of an image
+	// triggered by its base images. It prevents endless rebuild loops between
+	// the images using each other as their base images.
+	Cooldown time.Duration
+	// MaxRebuilds is the maximum number of images rebuilt in each check
+	MaxRebuilds int
+	// RegistryHost is the host of the registry pullr pushes the images. It
+	// is used for detecting images using themselves as base image.
+	RegistryHost string
+}
+
+// BaseImageWatcher periodically checks the registries for the new digests of
+// the base images and rebuilds the images depending on the changed ones.
+// Multiple watchers can run at the same time, only the one holding the lease
+// checks the registries.
+type BaseImageWatcher struct {
+	holder    string
+	config    BaseImageWatcherConfig
+	leases    LeaseStorage
+	bases     BaseImageStorage
+	images    ImageStorage
+	registry  ImageRegistry
+	sourcesvc *SourceService
+	buildsvc  *BuildService
+	logger    Logger
+}
+
+// NewBaseImageWatcher creates a base image watcher. holder should be unique
+// for each running watcher.
+func NewBaseImageWatcher(holder string, config BaseImageWatcherConfig, storage StorageDriver, registry ImageRegistry, sourcesvc *SourceService, buildsvc *BuildService, logger Logger) *BaseImageWatcher {
+	return &BaseImageWatcher{
+		holder:    holder,
+		config:    config,
+		leases:    storage.LeaseStorage(),
+		bases:     storage.BaseImageStorage(),
+		images:    storage.ImageStorage(),
+		registry:  registry,
+		sourcesvc: sourcesvc,
+		buildsvc:  buildsvc,
+		logger:    logger,
+	}
+}
+
+// Run checks the base images in every interval til the context is done
+func (w *BaseImageWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := w.leases.Release(baseImageWatcherLease, w.holder); err != nil {
+				w.logger.Errorf("baseimage watcher: release lease: %v", err)
+			}
+			return
+		case now := <-ticker.C:
+			if err := w.Check(ctx, now); err != nil {
+				w.logger.Errorf("baseimage watcher: %v", err)
+			}
+		}
+	}
+}
+
+// Check queries the current digests of the base images and queues rebuilds
+// for the images whose base images are changed. It does nothing if another
+// watcher holds the lease.
+func (w *BaseImageWatcher) Check(ctx context.Context, now time.Time) error {
+	ok, err := w.leases.Acquire(baseImageWatcherLease, w.holder, w.config.Interval*2)
+	if err != nil || !ok {
+		return err
+	}
+
+	refs, err := w.bases.Refs()
+	if err != nil {
+		return err
+	}
+
+	// Changed base images grouped by their dependent images
+	changed := make(map[string][]BaseImage)
+	var order []string
+	for _, ref := range refs {
+		digest, err := w.registry.Digest(ctx, ref)
+		if err != nil {
+			w.logger.Warningf("baseimage watcher: %s: %v", ref, err)
+			continue
+		}
+
+		dependents, err := w.bases.Dependents(ref)
+		if err != nil {
+			return err
+		}
+
+		for _, base := range dependents {
+			if base.Digest == digest {
+				continue
+			}
+
+			// Base image couldn't be resolved while building, it is the first
+			// time we know its digest
+			if base.Digest == "" {
+				base.Digest = digest
+				if err := w.bases.Update(base); err != nil {
+					w.logger.Errorf("baseimage watcher: update %s: %v", ref, err)
+				}
+				continue
+			}
+
+			base.Digest = digest
+			id := fmt.Sprintf("%s/%s", base.Owner, base.ImageKey)
+			if _, ok := changed[id]; !ok {
+				order = append(order, id)
+			}
+			changed[id] = append(changed[id], base)
+		}
+	}
+
+	nrebuilds := 0
+	for _, id := range order {
+		if w.config.MaxRebuilds > 0 && nrebuilds >= w.config.MaxRebuilds {
+			w.logger.Warningf("baseimage watcher: max rebuilds reached, remaining images will be rebuilt later")
+			break
+		}
+
+		bases := changed[id]
+		rebuilt, err := w.rebuild(ctx, now, bases)
+		if err != nil {
+			w.logger.Errorf("baseimage watcher: rebuild %s: %v", id, err)
+			continue
+		}
+		if !rebuilt {
+			continue
+		}
+
+		nrebuilds++
+		for _, base := range bases {
+			base.TriggeredAt = now
+			if err := w.bases.Update(base); err != nil {
+				w.logger.Errorf("baseimage watcher: update %s: %v", base.Ref, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebuild queues rebuilds of the latest successful build of each tag of the
+// image which the changed base images belong to. It reports false if the
+// image is not rebuilt because of the loop protection.
+func (w *BaseImageWatcher) rebuild(ctx context.Context, now time.Time, changed []BaseImage) (bool, error) {
+	owner, imgKey := changed[0].Owner, changed[0].ImageKey
+	img, err := w.images.Get(owner, imgKey)
+	if err == ErrNotFound {
+		return false, w.bases.Delete(owner, imgKey)
+	} else if err != nil {
+		return false, err
+	}
+
+	self := fmt.Sprintf("%s/%s/%s", w.config.RegistryHost, img.Owner, img.Name)
+	external := false
+	for _, base := range changed {
+		if base.Ref != self && !strings.HasPrefix(base.Ref, self+":") {
+			external = true
+		}
+	}
+	if !external {
+		return false, nil
+	}
+
+	bases, err := w.bases.List(owner, imgKey)
+	if err != nil {
+		return false, err
+	}
+	for _, base := range bases {
+		if now.Sub(base.TriggeredAt) < w.config.Cooldown {
+			return false, nil
+		}
+	}
+
+	token, err := w.sourcesvc.Token(owner, img.Repository.Provider)
+	if err != nil {
+		return false, err
+	}
+
+	nqueued, err := w.buildsvc.RebuildLatest(img, token)
+	if err != nil {
+		return false, err
+	}
+
+	return nqueued > 0, nil
+}
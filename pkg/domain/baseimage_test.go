@@ -0,0 +1,117 @@
+package domain_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/dummy"
+)
+
+// recordingJobQ keeps the queued build jobs
+type recordingJobQ struct {
+	jobs []BuildJob
+}
+
+func (q *recordingJobQ) Close() error {
+	return nil
+}
+
+func (q *recordingJobQ) Put(queue string, content io.Reader) error {
+	body, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	var job BuildJob
+	if err := json.Unmarshal(body, &job); err != nil {
+		return err
+	}
+	q.jobs = append(q.jobs, job)
+	return nil
+}
+
+func (q *recordingJobQ) Listen(queue string) (QueueListener, error) {
+	return nil, nil
+}
+
+// staticRegistry reports back the digests from its map
+type staticRegistry map[string]string
+
+func (r staticRegistry) Digest(ctx context.Context, ref string) (string, error) {
+	return r[ref], nil
+}
+
+func TestBaseImageWatcher(t *testing.T) {
+	storage := dummy.NewStorageDriver(nil)
+	storage.OAuthStorage().PutToken("owner", "owner", "github", "token")
+
+	images := []Image{
+		{Key: "github:owner:app", Name: "app", Owner: "owner", Repository: SourceRepository{Provider: "github", Owner: "owner", Name: "app"}},
+		{Key: "github:owner:base", Name: "base", Owner: "owner", Repository: SourceRepository{Provider: "github", Owner: "owner", Name: "base"}},
+	}
+	for _, img := range images {
+		storage.ImageStorage().Put(img)
+		storage.BuildStorage().Put(img.Owner, img.Key, BuildRecord{Status: BuildSucceed, Tag: "latest", CommitHash: "abc", StartedAt: time.Now()})
+	}
+
+	bases := storage.BaseImageStorage()
+	bases.Put("owner", "github:owner:app", []BaseImage{
+		{Owner: "owner", ImageKey: "github:owner:app", Ref: "node:8", Digest: "sha256:old"},
+		{Owner: "owner", ImageKey: "github:owner:app", Ref: "alpine:3.7"},
+	})
+	bases.Put("owner", "github:owner:base", []BaseImage{
+		{Owner: "owner", ImageKey: "github:owner:base", Ref: "reg.pullr.io/owner/base:builder", Digest: "sha256:old"},
+	})
+
+	registry := staticRegistry{
+		"node:8":                          "sha256:new",
+		"alpine:3.7":                      "sha256:alpine",
+		"reg.pullr.io/owner/base:builder": "sha256:new",
+	}
+	jobq := &recordingJobQ{}
+	buildsvc := NewBuildService(jobq, storage.BuildStorage(), storage.VersionStorage(), "builds")
+	sourcesvc := NewSourceService(storage.OAuthStorage(), nil)
+	config := BaseImageWatcherConfig{Interval: time.Minute, Cooldown: time.Hour, RegistryHost: "reg.pullr.io"}
+	watcher := NewBaseImageWatcher("test", config, storage, registry, sourcesvc, buildsvc, &TestLogger{})
+
+	now := time.Now()
+	if err := watcher.Check(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Image using itself as a base image isn't rebuilt
+	if len(jobq.jobs) != 1 || jobq.jobs[0].ImageKey != "github:owner:app" {
+		t.Fatalf("expected only the app to be rebuilt, got %+v", jobq.jobs)
+	}
+
+	appBases, _ := bases.List("owner", "github:owner:app")
+	for _, base := range appBases {
+		if base.Digest != registry[base.Ref] {
+			t.Errorf("%s: expected digest to be updated, got %s", base.Ref, base.Digest)
+		}
+		// Unresolved digests are recorded without a rebuild
+		if triggered := base.Ref == "node:8"; base.TriggeredAt.Equal(now) != triggered {
+			t.Errorf("%s: expected triggered %v, got %v", base.Ref, triggered, base.TriggeredAt)
+		}
+	}
+
+	registry["node:8"] = "sha256:newer"
+	if err := watcher.Check(context.Background(), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobq.jobs) != 1 {
+		t.Errorf("expected rebuilds to wait for the cooldown, got %d jobs", len(jobq.jobs))
+	}
+
+	if err := watcher.Check(context.Background(), now.Add(time.Hour*2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobq.jobs) != 2 {
+		t.Errorf("expected app to be rebuilt after the cooldown, got %d jobs", len(jobq.jobs))
+	}
+}
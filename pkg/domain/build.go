@@ -3,8 +3,14 @@ package domain
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/mobingilabs/pullr/pkg/semver"
 )
 
 // BuildStatus is status of a build record
@@ -29,11 +35,85 @@ type Build struct {
 
 // BuildRecord represents a build process and it is status
 type BuildRecord struct {
+	ID         string      `json:"id,omitempty" bson:"id,omitempty"`
 	StartedAt  time.Time   `json:"started_at,omitempty" bson:"started_at,omitempty"`
 	FinishedAt time.Time   `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
 	Status     BuildStatus `json:"status,omitempty" bson:"status,omitempty"`
 	Tag        string      `json:"tag" bson:"tag"`
-	Logs       string      `json:"logs,omitempty" bson:"logs,omitempty"`
+	// Tags are all the tags published by the build, including Tag
+	Tags []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	Logs string   `json:"logs,omitempty" bson:"logs,omitempty"`
+	// TriggeredBy is the user requested the build manually, it is empty
+	// for the builds triggered by webhooks
+	TriggeredBy string `json:"triggered_by,omitempty" bson:"triggered_by,omitempty"`
+	CommitRef   string `json:"ref,omitempty" bson:"ref,omitempty"`
+	CommitHash  string `json:"hash,omitempty" bson:"hash,omitempty"`
+	Dockerfile  string `json:"dockerfile,omitempty" bson:"dockerfile,omitempty"`
+	NoCache     bool   `json:"no_cache,omitempty" bson:"no_cache,omitempty"`
+	// RebuildOf is the id of the build record reproduced by this build
+	RebuildOf string `json:"rebuild_of,omitempty" bson:"rebuild_of,omitempty"`
+
+	BuildContext string     `json:"build_context,omitempty" bson:"build_context,omitempty"`
+	Target       string     `json:"target,omitempty" bson:"target,omitempty"`
+	BuildArgs    []BuildArg `json:"build_args,omitempty" bson:"build_args,omitempty"`
+	// Version is the semantic version published by the build
+	Version       string `json:"version,omitempty" bson:"version,omitempty"`
+	VersionLatest bool   `json:"version_latest,omitempty" bson:"version_latest,omitempty"`
+	// Platforms are the target platforms of multi platform builds
+	Platforms []string `json:"platforms,omitempty" bson:"platforms,omitempty"`
+	// Digests are the digests of the published platform images, they are
+	// recorded when a multi platform build succeeds
+	Digests []PlatformDigest `json:"digests,omitempty" bson:"digests,omitempty"`
+	// CacheGeneration is the cache generation of the image at the build
+	CacheGeneration int `json:"cache_generation,omitempty" bson:"cache_generation,omitempty"`
+}
+
+// PlatformDigest is the manifest digest of an image built for a platform
+type PlatformDigest struct {
+	Platform string `json:"platform" bson:"platform"`
+	Digest   string `json:"digest" bson:"digest"`
+}
+
+// NewBuildRecord creates an in progress build record for the given job
+func NewBuildRecord(job *BuildJob) BuildRecord {
+	return BuildRecord{
+		ID:          job.ID,
+		StartedAt:   time.Now(),
+		Status:      BuildInProgress,
+		Tag:         job.Tag,
+		Tags:        job.AllTags(),
+		TriggeredBy: job.TriggeredBy,
+		CommitRef:   job.CommitRef,
+		CommitHash:  job.CommitHash,
+		Dockerfile:  job.Dockerfile,
+		NoCache:     job.NoCache,
+		RebuildOf:   job.RebuildOf,
+
+		BuildContext:  job.BuildContext,
+		Target:        job.Target,
+		BuildArgs:     job.BuildArgs,
+		Version:       job.Version,
+		VersionLatest: job.VersionLatest,
+		Platforms:     job.Platforms,
+
+		CacheGeneration: job.CacheGeneration,
+	}
+}
+
+// NewFailedBuildRecord creates a failed build record for the commit which
+// couldn't be built, reason is reported as the build logs
+func NewFailedBuildRecord(commit *CommitInfo, triggeredBy string, reason error) BuildRecord {
+	now := time.Now()
+	return BuildRecord{
+		ID:          newBuildID(),
+		StartedAt:   now,
+		FinishedAt:  now,
+		Status:      BuildFailed,
+		Logs:        reason.Error(),
+		TriggeredBy: triggeredBy,
+		CommitRef:   commit.Ref,
+		CommitHash:  commit.Hash,
+	}
 }
 
 // WithStatus returns a build record with updated status
@@ -48,12 +128,63 @@ func (r BuildRecord) WithStatus(status BuildStatus) BuildRecord {
 	return r
 }
 
+// WithNewID returns a build record with a new unique id, like the record of
+// a retried build job
+func (r BuildRecord) WithNewID() BuildRecord {
+	r.ID = newBuildID()
+	return r
+}
+
+// WithTags returns a build record with given published tags
+func (r BuildRecord) WithTags(tags []string) BuildRecord {
+	r.Tags = tags
+	return r
+}
+
 // WithLogs returns a build record with given logs
 func (r BuildRecord) WithLogs(logs string) BuildRecord {
 	r.Logs = logs
 	return r
 }
 
+// WithDigests returns a build record with given platform digests
+func (r BuildRecord) WithDigests(digests []PlatformDigest) BuildRecord {
+	r.Digests = digests
+	return r
+}
+
+// JobPlatformDigests reports back the digests of the platform images
+// published by the multi platform build job in the order of its platforms.
+// They are read from the manifest list of the job's primary tag.
+func JobPlatformDigests(ctx context.Context, registry PlatformRegistry, registryURL string, job *BuildJob) ([]PlatformDigest, error) {
+	ref := fmt.Sprintf("%s/%s/%s:%s", RegistryHost(registryURL), job.ImageOwner, job.ImageName, job.AllTags()[0])
+	digests, err := registry.PlatformDigests(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]PlatformDigest, 0, len(job.Platforms))
+	for _, platform := range job.Platforms {
+		digest, ok := digests[platform]
+		if !ok {
+			// Registries may report the default variants like "linux/arm64/v8"
+			for listed, listedDigest := range digests {
+				if strings.HasPrefix(listed, platform+"/") {
+					digest, ok = listedDigest, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("build: %s doesn't list platform %s", ref, platform)
+		}
+
+		result = append(result, PlatformDigest{platform, digest})
+	}
+
+	return result, nil
+}
+
 // BuildStorage is an interface wraps database operations for build data
 type BuildStorage interface {
 	// GetAll retrieves all build records of matching image
@@ -62,14 +193,17 @@ type BuildStorage interface {
 	// GetLast retrieves last build record of matching image
 	GetLast(username string, imgKey string) (BuildRecord, error)
 
+	// Get retrieves the build record of matching image by its id
+	Get(username string, imgKey string, id string) (BuildRecord, error)
+
 	// GetLastBy retrieves last build records for matching image keys
 	GetLastBy(username string, imgKeys []string) (map[string]BuildRecord, error)
 
 	// List retrieves list of build records of matching user ordered by time
 	List(username string, opts ListOptions) ([]Build, Pagination, error)
 
-	// UpdateLast, updates the status of last build of matching image
-	UpdateLast(username string, imgKey string, update BuildRecord) error
+	// Update replaces the build record of matching image by its id
+	Update(username string, imgKey string, id string, record BuildRecord) error
 
 	// Put inserts a new build record
 	Put(username string, imgKey string, record BuildRecord) error
@@ -77,33 +211,257 @@ type BuildStorage interface {
 
 // BuildJob describes necessary information to build a docker image
 type BuildJob struct {
+	ID          string           `json:"id"`
 	ImageOwner  string           `json:"owner"`
 	ImageKey    string           `json:"key"`
 	ImageName   string           `json:"name"`
 	ImageRepo   SourceRepository `json:"repo"`
 	Dockerfile  string           `json:"dockerfile"`
 	Tag         string           `json:"tag"`
+	Tags        []string         `json:"tags"`
 	CommitRef   string           `json:"ref"`
 	CommitHash  string           `json:"hash"`
 	VcsToken    string           `json:"token"`
 	VcsUsername string           `json:"username"`
+	TriggeredBy string           `json:"triggered_by"`
+	NoCache     bool             `json:"no_cache"`
+	RebuildOf   string           `json:"rebuild_of"`
+	// BuildContext is the path of the build context relative to the
+	// repository root
+	BuildContext string     `json:"build_context,omitempty"`
+	Target       string     `json:"target,omitempty"`
+	BuildArgs    []BuildArg `json:"build_args,omitempty"`
+	// Version is the semantic version of the built git tag. When it is set
+	// the floating version tags are published along with the job's tags.
+	Version string `json:"version,omitempty"`
+	// VersionLatest makes the highest version published as latest too
+	VersionLatest bool `json:"version_latest,omitempty"`
+	// Notifications are the targets notified when the build finishes
+	Notifications []NotificationTarget `json:"notifications,omitempty"`
+	// BuilderOptions override the builder driver options for the build
+	BuilderOptions map[string]string `json:"builder_options,omitempty"`
+	// Platforms are the target platforms of multi platform builds
+	Platforms []string `json:"platforms,omitempty"`
+	// Cache is the layer cache strategy of the build
+	Cache           CacheStrategy `json:"cache,omitempty"`
+	CacheGeneration int           `json:"cache_generation,omitempty"`
+	// CacheFrom is the tag published by the image's previous build in the
+	// same cache generation, inline cache is imported from it
+	CacheFrom string `json:"cache_from,omitempty"`
+}
+
+// NewBuildJob creates a build job to build the image from given commit and
+// publish it with the tags. First tag is the primary tag of the build.
+// triggeredBy is the user requested the build, it can be empty if the build
+// is triggered automatically.
+func NewBuildJob(img Image, commit *CommitInfo, tags []string, token OAuthToken, triggeredBy string) BuildJob {
+	tag := ""
+	if len(tags) > 0 {
+		tag = tags[0]
+	}
+
+	return BuildJob{
+		ID:           newBuildID(),
+		ImageOwner:   img.Owner,
+		ImageKey:     img.Key,
+		ImageName:    img.Name,
+		ImageRepo:    img.Repository,
+		Dockerfile:   img.DockerfilePath,
+		BuildContext: img.BuildContext,
+		Target:       img.Target,
+		Tag:          tag,
+		Tags:         tags,
+		CommitRef:    commit.Ref,
+		CommitHash:   commit.Hash,
+		VcsToken:     token.Token,
+		VcsUsername:  token.Identity,
+		TriggeredBy:  triggeredBy,
+
+		Notifications:  img.Notifications,
+		BuilderOptions: img.BuilderOptions,
+		Platforms:      img.Platforms,
+
+		Cache:           img.Cache,
+		CacheGeneration: img.CacheGeneration,
+	}
+}
+
+// NewMatchedBuildJob creates a build job to build the image from given commit
+// with the tags and the build args of the image tag matching the commit
+func NewMatchedBuildJob(img Image, tag ImageTag, commit *CommitInfo, token OAuthToken, triggeredBy string) (BuildJob, error) {
+	tags, err := tag.Tags(commit)
+	if err != nil {
+		return BuildJob{}, err
+	}
+
+	args, err := tag.buildArgs(img, commit)
+	if err != nil {
+		return BuildJob{}, err
+	}
+
+	job := NewBuildJob(img, commit, tags, token, triggeredBy)
+	job.BuildArgs = args
+	if tag.Semver && commit.RefType == SourceTag {
+		if v, err := semver.Parse(commit.Ref); err == nil {
+			job.Version = v.String()
+			job.VersionLatest = tag.SemverLatest
+		}
+	}
+
+	return job, nil
+}
+
+// RebuildJob creates a build job which reproduces the given build record of
+// the image with the same commit, dockerfile and tag. If noCache is true
+// layer cache will not be used while building the image.
+func RebuildJob(img Image, record BuildRecord, token OAuthToken, triggeredBy string, noCache bool) (BuildJob, error) {
+	if record.CommitHash == "" || record.Tag == "" {
+		return BuildJob{}, ErrBuildNotReproducible
+	}
+
+	tags := record.Tags
+	if len(tags) == 0 {
+		tags = []string{record.Tag}
+	}
+
+	// Floating version tags are decided again by the pipeline, so an older
+	// version's rebuild doesn't move them back
+	if record.Version != "" {
+		floating := floatingTagCandidates(record.Version, record.VersionLatest)
+		tags = withoutTags(tags, floating)
+	}
+
+	commit := &CommitInfo{Ref: record.CommitRef, Hash: record.CommitHash}
+	job := NewBuildJob(img, commit, tags, token, triggeredBy)
+	if record.Dockerfile != "" {
+		job.Dockerfile = record.Dockerfile
+	}
+	if record.BuildContext != "" {
+		job.BuildContext = record.BuildContext
+	}
+	if record.Target != "" {
+		job.Target = record.Target
+	}
+	if len(record.Platforms) > 0 {
+		job.Platforms = record.Platforms
+	}
+	job.BuildArgs = record.BuildArgs
+	job.NoCache = noCache
+	job.RebuildOf = record.ID
+	job.Version = record.Version
+	job.VersionLatest = record.VersionLatest
+	return job, nil
+}
+
+// withoutTags reports back the tags except the excluded ones. The first tag
+// is always kept since it is the primary tag.
+func withoutTags(tags []string, excluded []string) []string {
+	result := tags[:1:1]
+	for _, tag := range tags[1:] {
+		if !hasTag(excluded, tag) {
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cacheTag is the tag of the dedicated registry cache images
+const cacheTag = "buildcache"
+
+// CacheRef reports back the image in the registry at registryHost the
+// job's layer cache is imported from. It is empty if the job doesn't import
+// a cache from the registry.
+func (j *BuildJob) CacheRef(registryHost string) string {
+	repo := fmt.Sprintf("%s/%s/%s", registryHost, j.ImageOwner, j.ImageName)
+	switch {
+	case j.Cache == CacheInline && j.CacheFrom != "":
+		return fmt.Sprintf("%s:%s", repo, j.CacheFrom)
+	case j.Cache == CacheRegistry && j.CacheGeneration == 0:
+		return fmt.Sprintf("%s:%s", repo, cacheTag)
+	case j.Cache == CacheRegistry:
+		return fmt.Sprintf("%s:%s-%d", repo, cacheTag, j.CacheGeneration)
+	}
+
+	return ""
+}
+
+// CacheKey reports back the key of the job's local layer cache like
+// "owner/app/2", it changes when the image's cache is purged
+func (j *BuildJob) CacheKey() string {
+	return fmt.Sprintf("%s/%s/%d", j.ImageOwner, j.ImageName, j.CacheGeneration)
+}
+
+// AllTags reports back all the tags the job publishes. Jobs queued before
+// multiple tags were supported only have the primary tag.
+func (j *BuildJob) AllTags() []string {
+	if len(j.Tags) == 0 {
+		return []string{j.Tag}
+	}
+
+	return j.Tags
+}
+
+func newBuildID() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+
+	return hex.EncodeToString(id)
 }
 
 // BuildService handles queueing and listening for build jobs
 type BuildService struct {
 	Storage   BuildStorage
+	versions  VersionStorage
 	jobq      JobQDriver
 	listener  QueueListener
 	queueName string
+
+	capabilities BuilderCapabilities
 }
 
 // NewBuildService creates a new build service
-func NewBuildService(jobq JobQDriver, storage BuildStorage, queueName string) *BuildService {
-	return &BuildService{storage, jobq, nil, queueName}
+func NewBuildService(jobq JobQDriver, storage BuildStorage, versions VersionStorage, queueName string) *BuildService {
+	return &BuildService{storage, versions, jobq, nil, queueName, BuilderCapabilities{}}
+}
+
+// SetCapabilities sets the optional build features of the builder driver,
+// jobs requiring the other features are rejected
+func (s *BuildService) SetCapabilities(capabilities BuilderCapabilities) {
+	s.capabilities = capabilities
+}
+
+// Capabilities reports back the optional build features of the builder
+// driver
+func (s *BuildService) Capabilities() BuilderCapabilities {
+	return s.capabilities
 }
 
-// Queue queues a new build job on the given queue
+// Queue queues a new build job on the given queue. Multi platform jobs are
+// rejected unless the builder can build them.
 func (s *BuildService) Queue(buildJob BuildJob) error {
+	if len(buildJob.Platforms) > 0 && !s.capabilities.Platforms {
+		return ErrBuildPlatformsUnsupported
+	}
+
+	if buildJob.Cache != "" {
+		if err := s.resolveCache(&buildJob); err != nil {
+			return err
+		}
+	}
+
 	body, err := json.Marshal(buildJob)
 	if err != nil {
 		return err
@@ -112,6 +470,81 @@ func (s *BuildService) Queue(buildJob BuildJob) error {
 	return s.jobq.Put(s.queueName, bytes.NewReader(body))
 }
 
+// resolveCache decides the cache of the job from the image's last
+// successful build. Inline cache is imported from the tag published by it,
+// unless the image's cache is purged since then. Registry and local caches
+// are keyed by the cache generation, so they start over after a purge.
+func (s *BuildService) resolveCache(job *BuildJob) error {
+	records, _, err := s.Storage.GetAll(job.ImageOwner, job.ImageKey, ListOptions{PerPage: 20})
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.Status != BuildSucceed {
+			continue
+		}
+
+		if job.Cache == CacheInline && record.CacheGeneration == job.CacheGeneration {
+			job.CacheFrom = record.Tag
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// RebuildLatest queues rebuilds of the latest successful build of each tag of
+// the image. It reports back the number of queued jobs.
+func (s *BuildService) RebuildLatest(img Image, token OAuthToken) (int, error) {
+	records, _, err := s.Storage.GetAll(img.Owner, img.Key, ListOptions{PerPage: 100})
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	latest := make(map[string]BuildRecord)
+	for _, record := range records {
+		if record.Status != BuildSucceed {
+			continue
+		}
+		if last, ok := latest[record.Tag]; !ok || record.StartedAt.After(last.StartedAt) {
+			latest[record.Tag] = record
+		}
+	}
+
+	nqueued := 0
+	for _, record := range latest {
+		job, err := RebuildJob(img, record, token, "", false)
+		if err == ErrBuildNotReproducible {
+			continue
+		} else if err != nil {
+			return nqueued, err
+		}
+
+		if err := s.Queue(job); err != nil {
+			return nqueued, err
+		}
+		nqueued++
+	}
+
+	return nqueued, nil
+}
+
+// RecordVersion records the semantic version published by the successful
+// build job, so the floating version tags are decided correctly for the later
+// versions
+func (s *BuildService) RecordVersion(job *BuildJob) error {
+	if job.Version == "" {
+		return nil
+	}
+
+	return s.versions.Put(job.ImageOwner, job.ImageKey, job.Version)
+}
+
 // Listen starts listening for build jobs on the given queue
 func (s *BuildService) Listen() error {
 	var err error
@@ -0,0 +1,79 @@
+package domain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRebuildJob(t *testing.T) {
+	img := Image{
+		Key:            "github:owner:app",
+		Name:           "app",
+		Owner:          "owner",
+		DockerfilePath: "Dockerfile.new",
+		Target:         "release",
+	}
+	token := OAuthToken{Identity: "owner", Token: "token"}
+
+	tests := []struct {
+		name       string
+		record     BuildRecord
+		err        error
+		tags       string
+		dockerfile string
+		target     string
+	}{
+		{
+			name:   "without commit",
+			record: BuildRecord{ID: "1", Tag: "latest"},
+			err:    ErrBuildNotReproducible,
+		},
+		{
+			name:   "without tag",
+			record: BuildRecord{ID: "1", CommitHash: "abc"},
+			err:    ErrBuildNotReproducible,
+		},
+		{
+			name:       "old record",
+			record:     BuildRecord{ID: "1", Tag: "latest", CommitHash: "abc"},
+			tags:       "[latest]",
+			dockerfile: "Dockerfile.new",
+			target:     "release",
+		},
+		{
+			name:       "recorded options",
+			record:     BuildRecord{ID: "1", Tag: "master", Tags: []string{"master", "dev"}, CommitHash: "abc", Dockerfile: "Dockerfile", Target: "build"},
+			tags:       "[master dev]",
+			dockerfile: "Dockerfile",
+			target:     "build",
+		},
+		{
+			name:       "floating version tags",
+			record:     BuildRecord{ID: "1", Tag: "1.4.2", Tags: []string{"1.4.2", "1", "1.4", "latest", "stable"}, CommitHash: "abc", Version: "1.4.2", VersionLatest: true},
+			tags:       "[1.4.2 stable]",
+			dockerfile: "Dockerfile.new",
+			target:     "release",
+		},
+	}
+
+	for _, test := range tests {
+		job, err := RebuildJob(img, test.record, token, "owner", true)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if tags := fmt.Sprint(job.AllTags()); tags != test.tags {
+			t.Errorf("%s: expected tags %s, got %s", test.name, test.tags, tags)
+		}
+		if job.Dockerfile != test.dockerfile || job.Target != test.target {
+			t.Errorf("%s: expected %s/%s, got %s/%s", test.name, test.dockerfile, test.target, job.Dockerfile, job.Target)
+		}
+		if job.RebuildOf != test.record.ID || !job.NoCache || job.CommitHash != test.record.CommitHash || job.Version != test.record.Version {
+			t.Errorf("%s: unexpected job %+v", test.name, job)
+		}
+	}
+}
@@ -28,6 +28,7 @@ type Config struct {
 	OAuth map[string]OAuthProviderConfig
 
 	Registry RegistryConfig
+	Secrets  SecretsConfig
 }
 
 // DriverConfig is a pair of driver name and options for that
@@ -55,6 +56,13 @@ type BuildSvcConfig struct {
 	MaxErr   int
 	CloneDir string
 	Timeout  time.Duration
+	// AdminAddr is the listen address of the admin endpoints like the build
+	// host metrics, admin endpoints are disabled if it is empty. Addresses
+	// without a host like ":9090" listen on localhost only.
+	AdminAddr string
+	// AdminToken is the bearer token the admin endpoints require, admin
+	// endpoints can't listen on a non loopback address without it
+	AdminToken string
 }
 
 // ApiSrvConfig contains configuration for apisrv service
@@ -77,6 +85,13 @@ type RegistryConfig struct {
 	Password string
 }
 
+// SecretsConfig contains configuration for image secrets
+type SecretsConfig struct {
+	// Key is the base64 encoded 32 bytes key used for encrypting the
+	// secrets. Image secrets are disabled if it is empty.
+	Key string
+}
+
 // ParseConfig parses given yaml/json input into Config
 func ParseConfig(reader io.Reader) (*Config, error) {
 	var conf Config
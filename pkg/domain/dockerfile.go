@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// ParseBaseImages reports back the base images referenced by the FROM
+// instructions of all the stages in a Dockerfile. References to the previous
+// stages and the scratch image are omitted. Variables in the references are
+// expanded with the default values of the ARG instructions declared before
+// the first FROM, references which can not be expanded are omitted.
+func ParseBaseImages(r io.Reader) ([]string, error) {
+	instructions, err := dockerfileInstructions(r)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make(map[string]string)
+	stages := make(map[string]bool)
+	seen := make(map[string]bool)
+	var bases []string
+	inStages := false
+
+	for _, fields := range instructions {
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if inStages || len(fields) < 2 {
+				continue
+			}
+
+			kv := strings.SplitN(fields[1], "=", 2)
+			if len(kv) == 2 {
+				args[kv[0]] = strings.Trim(kv[1], `"'`)
+			}
+
+		case "FROM":
+			inStages = true
+			var params []string
+			for _, f := range fields[1:] {
+				if !strings.HasPrefix(f, "--") {
+					params = append(params, f)
+				}
+			}
+			if len(params) == 0 {
+				continue
+			}
+
+			ref := os.Expand(params[0], func(name string) string {
+				if val, ok := args[name]; ok {
+					return val
+				}
+				return "$" + name
+			})
+
+			lower := strings.ToLower(ref)
+			if ref != "" && !strings.Contains(ref, "$") && lower != "scratch" && !stages[lower] && !seen[ref] {
+				seen[ref] = true
+				bases = append(bases, ref)
+			}
+
+			// Stage name only applies to the later stages, "FROM node AS
+			// node" is based on the node image
+			if len(params) >= 3 && strings.EqualFold(params[1], "AS") {
+				stages[strings.ToLower(params[2])] = true
+			}
+		}
+	}
+
+	return bases, nil
+}
+
+// dockerfileInstructions splits a Dockerfile into instructions by joining
+// continuation lines and removing comments.
+func dockerfileInstructions(r io.Reader) ([][]string, error) {
+	var instructions [][]string
+	var current strings.Builder
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasSuffix(line, `\`) {
+			current.WriteString(strings.TrimSuffix(line, `\`))
+			current.WriteString(" ")
+			continue
+		}
+
+		current.WriteString(line)
+		if fields := strings.Fields(current.String()); len(fields) > 0 {
+			instructions = append(instructions, fields)
+		}
+		current.Reset()
+	}
+
+	if fields := strings.Fields(current.String()); len(fields) > 0 {
+		instructions = append(instructions, fields)
+	}
+
+	return instructions, scanner.Err()
+}
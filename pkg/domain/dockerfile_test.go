@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseBaseImages(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		expected   []string
+	}{
+		{"FROM node:8\nRUN npm install", []string{"node:8"}},
+		{"from golang:1.10 as build\nFROM alpine:3.7\nCOPY --from=build /app /app", []string{"golang:1.10", "alpine:3.7"}},
+		{"FROM golang AS build\nFROM build\nFROM scratch", []string{"golang"}},
+		{"FROM node AS node\nFROM node\nRUN node app.js", []string{"node"}},
+		{"ARG VERSION=3.7\nFROM alpine:${VERSION}\nARG TAG=ignored\nFROM debian:$TAG", []string{"alpine:3.7"}},
+		{"FROM --platform=$BUILDPLATFORM golang:1.10 \\\n  AS build\nFROM golang:1.10", []string{"golang:1.10"}},
+		{"# FROM commented:1\nFROM reg.pullr.io/owner/base:1", []string{"reg.pullr.io/owner/base:1"}},
+	}
+
+	for _, test := range tests {
+		bases, err := ParseBaseImages(strings.NewReader(test.dockerfile))
+		if err != nil {
+			t.Errorf("%q: %v", test.dockerfile, err)
+			continue
+		}
+		if fmt.Sprint(bases) != fmt.Sprint(test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.dockerfile, test.expected, bases)
+		}
+	}
+}
@@ -38,6 +38,12 @@ var (
 	ErrStorageDriver = &Error{ErrKindUnexpected, "storage driver failed", ""}
 	// ErrImageExists is image conflict error
 	ErrImageExists = &Error{ErrKindConflict, "image exists", ""}
+	// ErrImageBadTagTemplate is tag name template rendering error
+	ErrImageBadTagTemplate = &Error{ErrKindBadRequest, "image: tag name template failed", ""}
+	// ErrImageKeyChanged is image update error changing the image's
+	// repository or name, versions, build records and downstreams of the
+	// image are kept under its key
+	ErrImageKeyChanged = &Error{ErrKindBadRequest, "image: repository and name can not be changed", ""}
 )
 
 // DefaultAuthService errors
@@ -66,9 +72,29 @@ var (
 	ErrSourceUnsupportedProvider = &Error{ErrKindUnsupported, "unsupported source client", ""}
 	ErrSourceBadPayload          = &Error{ErrKindBadRequest, "bad webhook payload", ""}
 	ErrSourceIrrelevantEvent     = &Error{ErrKindIrrelevant, "irrelevant webhook event", ""}
+	ErrSourceChangesUnknown      = &Error{ErrKindUnsupported, "changed files are unknown", ""}
+)
+
+// SecretService errors
+var (
+	ErrSecretsDisabled = &Error{ErrKindUnsupported, "secrets: not configured", ""}
+	ErrSecretBadKey    = &Error{ErrKindUnexpected, "secrets: encryption key should be 32 bytes encoded with base64", ""}
+	ErrSecretBadName   = &Error{ErrKindBadRequest, "secrets: name should be a valid variable name", ""}
+	ErrSecretEmpty     = &Error{ErrKindBadRequest, "secrets: value is required", ""}
+	ErrSecretCorrupted = &Error{ErrKindUnexpected, "secrets: can not decrypt the secret", ""}
 )
 
 // BuildService errors
 var (
-	ErrBuildBadJob = &Error{ErrKindBadRequest, "bad job", ""}
+	ErrBuildBadJob          = &Error{ErrKindBadRequest, "bad job", ""}
+	ErrBuildBadRef          = &Error{ErrKindBadRequest, "build: one of branch, tag or commit is required", ""}
+	ErrBuildNoMatchingTag   = &Error{ErrKindBadRequest, "build: no matching image tag for the ref", ""}
+	ErrBuildNotReproducible = &Error{ErrKindBadRequest, "build: record doesn't have enough information to rebuild", ""}
+
+	// ErrBuildPlatformsUnsupported is returned for the multi platform jobs
+	// when the builder driver can't build them
+	ErrBuildPlatformsUnsupported = &Error{ErrKindUnsupported, "build: builder doesn't support multi platform images", ""}
+	// ErrBuildSecretsUnsupported is returned for the image secrets when the
+	// builder driver can't expose them to the builds
+	ErrBuildSecretsUnsupported = &Error{ErrKindUnsupported, "build: builder doesn't support build secrets", ""}
 )
@@ -0,0 +1,162 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImageUpstream is a dependency of an image to a tag of another image. When
+// the upstream image tag is built successfully, dependent image is rebuilt.
+type ImageUpstream struct {
+	Key string `json:"key" bson:"key"`
+	Tag string `json:"tag" bson:"tag"`
+}
+
+// DependencyGraph is the graph of upstream relations between a user's images
+type DependencyGraph struct {
+	images map[string]Image
+}
+
+// DependencyEdge is a relation between an upstream and a downstream image
+type DependencyEdge struct {
+	Upstream   string `json:"upstream"`
+	Tag        string `json:"tag"`
+	Downstream string `json:"downstream"`
+}
+
+// NewDependencyGraph creates a dependency graph from the images
+func NewDependencyGraph(images []Image) DependencyGraph {
+	g := DependencyGraph{make(map[string]Image, len(images))}
+	for _, img := range images {
+		g.images[img.Key] = img
+	}
+
+	return g
+}
+
+// With reports back a copy of the graph with the given image added or
+// replaced
+func (g DependencyGraph) With(img Image) DependencyGraph {
+	images := make(map[string]Image, len(g.images)+1)
+	for key, other := range g.images {
+		images[key] = other
+	}
+	images[img.Key] = img
+
+	return DependencyGraph{images}
+}
+
+// Has reports whether the image is in the graph
+func (g DependencyGraph) Has(key string) bool {
+	_, ok := g.images[key]
+	return ok
+}
+
+// Edges reports back all the relations in the graph
+func (g DependencyGraph) Edges() []DependencyEdge {
+	edges := []DependencyEdge{}
+	for _, img := range g.images {
+		for _, up := range img.Upstreams {
+			edges = append(edges, DependencyEdge{up.Key, up.Tag, img.Key})
+		}
+	}
+
+	return edges
+}
+
+// Downstreams reports back the images depending on the given tag of the image
+func (g DependencyGraph) Downstreams(key string, tag string) []Image {
+	var downstreams []Image
+	for _, img := range g.images {
+		for _, up := range img.Upstreams {
+			if up.Key == key && up.Tag == tag {
+				downstreams = append(downstreams, img)
+				break
+			}
+		}
+	}
+
+	return downstreams
+}
+
+// Cycle reports back a dependency cycle reachable from the image as list of
+// image keys. It reports nil if there is no cycle.
+func (g DependencyGraph) Cycle(key string) []string {
+	return g.cycle(key, nil, make(map[string]bool))
+}
+
+func (g DependencyGraph) cycle(key string, path []string, done map[string]bool) []string {
+	for i, visited := range path {
+		if visited == key {
+			return append(path[i:], key)
+		}
+	}
+	if done[key] {
+		return nil
+	}
+
+	path = append(path, key)
+	for _, up := range g.images[key].Upstreams {
+		if cycle := g.cycle(up.Key, path, done); cycle != nil {
+			return cycle
+		}
+	}
+
+	done[key] = true
+	return nil
+}
+
+// DownstreamTrigger rebuilds the images depending on the successfully built
+// image tags
+type DownstreamTrigger struct {
+	images   ImageStorage
+	sources  *SourceService
+	buildsvc *BuildService
+}
+
+// NewDownstreamTrigger creates a downstream trigger
+func NewDownstreamTrigger(images ImageStorage, sources *SourceService, buildsvc *BuildService) *DownstreamTrigger {
+	return &DownstreamTrigger{images, sources, buildsvc}
+}
+
+// Trigger queues rebuilds of the latest builds of the images depending on
+// the image tags built by the given job. An image failing to queue doesn't
+// prevent the others, errors of all the failing images are reported back.
+func (t *DownstreamTrigger) Trigger(job *BuildJob) error {
+	images, err := t.images.All(job.ImageOwner)
+	if err != nil {
+		return err
+	}
+
+	graph := NewDependencyGraph(images)
+	triggered := make(map[string]bool)
+	var errs []string
+	for _, tag := range job.AllTags() {
+		for _, img := range graph.Downstreams(job.ImageKey, tag) {
+			if triggered[img.Key] {
+				continue
+			}
+			triggered[img.Key] = true
+
+			if err := t.trigger(img); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", img.Key, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("downstreams: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (t *DownstreamTrigger) trigger(img Image) error {
+	token, err := t.sources.Token(img.Owner, img.Repository.Provider)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.buildsvc.RebuildLatest(img, token)
+	return err
+}
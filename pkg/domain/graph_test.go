@@ -0,0 +1,91 @@
+package domain_test
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/mobingilabs/pullr/pkg/domain"
+	"github.com/mobingilabs/pullr/pkg/dummy"
+	"github.com/mobingilabs/pullr/pkg/gova"
+)
+
+func testImage(name string, upstreams ...ImageUpstream) Image {
+	img := Image{
+		Name:           name,
+		Owner:          "owner",
+		Repository:     SourceRepository{Provider: "github", Owner: "owner", Name: name},
+		DockerfilePath: "Dockerfile",
+		Tags:           []ImageTag{{RefType: SourceBranch, RefTest: "master", Name: "latest"}},
+		Upstreams:      upstreams,
+	}
+	img.Key = ImageKey(img)
+	return img
+}
+
+func TestImageValidUpstreams(t *testing.T) {
+	base := testImage("base")
+	app := testImage("app", ImageUpstream{"github:owner:base", "latest"})
+	graph := NewDependencyGraph([]Image{base, app})
+
+	tests := []struct {
+		name  string
+		img   Image
+		field string
+	}{
+		{"valid upstream", testImage("web", ImageUpstream{"github:owner:app", "latest"}), ""},
+		{"missing upstream", testImage("web", ImageUpstream{"github:owner:missing", "latest"}), "upstreams[0].key"},
+		{"self dependency", testImage("web", ImageUpstream{"github:owner:web", "latest"}), "upstreams[0].key"},
+		{"cycle", testImage("base", ImageUpstream{"github:owner:app", "latest"}), "upstreams"},
+		{"duplicate", testImage("web", ImageUpstream{"github:owner:base", "1"}, ImageUpstream{"github:owner:base", "1"}), "upstreams[1]"},
+	}
+
+	for _, test := range tests {
+		valid, err := test.img.Valid(graph)
+		if test.field == "" {
+			if !valid {
+				t.Errorf("%s: expected image to be valid, got %v", test.name, err)
+			}
+			continue
+		}
+
+		found := false
+		for _, verr := range err.(gova.ValidationErrors) {
+			if verr.Field == test.field {
+				found = true
+			}
+		}
+		if valid || !found {
+			t.Errorf("%s: expected %s to be invalid, got %v", test.name, test.field, err)
+		}
+	}
+}
+
+func TestDownstreamTriggerContinues(t *testing.T) {
+	storage := dummy.NewStorageDriver(nil)
+	storage.OAuthStorage().PutToken("owner", "owner", "github", "token")
+
+	// web's repository provider has no token, it fails to trigger
+	web := testImage("web", ImageUpstream{"github:owner:base", "latest"})
+	web.Repository.Provider = "gitlab"
+	images := []Image{
+		testImage("base"),
+		testImage("app", ImageUpstream{"github:owner:base", "latest"}),
+		web,
+	}
+	for _, img := range images {
+		storage.ImageStorage().Put(img)
+		storage.BuildStorage().Put(img.Owner, img.Key, BuildRecord{Status: BuildSucceed, Tag: "latest", CommitHash: "abc"})
+	}
+
+	jobq := &recordingJobQ{}
+	buildsvc := NewBuildService(jobq, storage.BuildStorage(), storage.VersionStorage(), "builds")
+	trigger := NewDownstreamTrigger(storage.ImageStorage(), NewSourceService(storage.OAuthStorage(), nil), buildsvc)
+
+	err := trigger.Trigger(&BuildJob{ImageOwner: "owner", ImageKey: "github:owner:base", Tag: "latest"})
+	if err == nil || !strings.Contains(err.Error(), web.Key) {
+		t.Errorf("expected web's error to be reported, got %v", err)
+	}
+	if len(jobq.jobs) != 1 || jobq.jobs[0].ImageKey != "github:owner:app" {
+		t.Errorf("expected app to be rebuilt, got %+v", jobq.jobs)
+	}
+}
@@ -2,9 +2,13 @@ package domain
 
 import (
 	"fmt"
+	"path"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mobingilabs/pullr/pkg/cron"
 	"github.com/mobingilabs/pullr/pkg/gova"
 )
 
@@ -16,54 +20,162 @@ type Image struct {
 	Owner          string           `json:"owner" bson:"owner,omitempty"`
 	Repository     SourceRepository `json:"repository" bson:"repository,omitempty"`
 	DockerfilePath string           `json:"dockerfile_path" bson:"dockerfile_path,omitempty"`
-	Tags           []ImageTag       `json:"tags" bson:"tags,omitempty"`
-	CreatedAt      time.Time        `json:"created_at" bson:"created_at,omitempty"`
-	UpdatedAt      time.Time        `json:"updated_at" bson:"updated_at,omitempty"`
+	// BuildContext is the path of the build context relative to the
+	// repository root, repository root is used if it is empty
+	BuildContext string `json:"build_context,omitempty" bson:"build_context,omitempty"`
+	// Target is the build stage to build in multi-stage Dockerfiles
+	Target string `json:"target,omitempty" bson:"target,omitempty"`
+	// BuildArgs are the build time variables passed to all the builds of the
+	// image, values can be tag templates
+	BuildArgs []BuildArg `json:"build_args,omitempty" bson:"build_args,omitempty"`
+	// IncludePaths are the path globs relative to the repository root. If
+	// they are set, only the pushes changing a matching file trigger builds.
+	IncludePaths []string `json:"include_paths,omitempty" bson:"include_paths,omitempty"`
+	// ExcludePaths are the path globs of the files which never trigger
+	// builds when they are changed
+	ExcludePaths []string `json:"exclude_paths,omitempty" bson:"exclude_paths,omitempty"`
+	// Notifications are the targets notified when the image's builds finish
+	Notifications []NotificationTarget `json:"notifications,omitempty" bson:"notifications,omitempty"`
+	// BuilderOptions override the builder driver options for the image's
+	// builds like "computetype" of the codebuild builder, options unknown to
+	// the driver are ignored
+	BuilderOptions map[string]string `json:"builder_options,omitempty" bson:"builder_options,omitempty"`
+	// Platforms are the target platforms like "linux/arm64" of multi
+	// platform images, images are built for the builder's platform if it is
+	// empty
+	Platforms []string        `json:"platforms,omitempty" bson:"platforms,omitempty"`
+	Tags      []ImageTag      `json:"tags" bson:"tags,omitempty"`
+	Upstreams []ImageUpstream `json:"upstreams" bson:"upstreams,omitempty"`
+	CreatedAt time.Time       `json:"created_at" bson:"created_at,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at" bson:"updated_at,omitempty"`
+
+	// Cache is the layer cache strategy of the image's builds, builds start
+	// from a clean builder if it is empty
+	Cache CacheStrategy `json:"cache,omitempty" bson:"cache,omitempty"`
+	// CacheGeneration changes when the image's cache is purged, caches of
+	// the previous generations aren't used by the builds
+	CacheGeneration int `json:"cache_generation,omitempty" bson:"cache_generation,omitempty"`
 }
 
-// Valid validates the image data
-func (i Image) Valid() (bool, error) {
+// Valid validates the image data. Upstreams of the image should be in the
+// graph of the owner's images and shouldn't introduce a dependency cycle.
+func (i Image) Valid(graph DependencyGraph) (bool, error) {
 	validator := &gova.Validator{}
 	validator.NotEmptyString("name", i.Name)
+	if i.Name != "" {
+		// Name is a part of the image key used in the urls, it can't be a
+		// docker repository path like "app/cache"
+		validator.DockerRepository("name", i.Name)
+		validator.Assert("name", validImageName.MatchString(i.Name), "should only contain lowercase letters, digits and _- characters")
+	}
 	validator.NotEmptyString("owner", i.Owner)
 	validator.NotEmptyString("repository.provider", i.Repository.Provider)
 	validator.NotEmptyString("repository.owner", i.Repository.Owner)
 	validator.NotEmptyString("repository.name", i.Repository.Name)
 	validator.NotEmptyString("dockerfile_path", i.DockerfilePath)
+	if i.DockerfilePath != "" {
+		validator.RelativePath("dockerfile_path", i.DockerfilePath)
+		validator.MaxLength("dockerfile_path", i.DockerfilePath, maxPathLength)
+		validator.Assert("dockerfile_path", validPath.MatchString(i.DockerfilePath), "should only contain letters, digits and _.-/ characters")
+	}
 	validator.NotEmpty("tags", len(i.Tags))
 
+	if i.BuildContext != "" {
+		validator.RelativePath("build_context", i.BuildContext)
+		validator.MaxLength("build_context", i.BuildContext, maxPathLength)
+	}
+	if i.Target != "" {
+		validator.Assert("target", validStageName.MatchString(i.Target), "should be a valid build stage name")
+	}
+	validateBuildArgs(validator, ImageTag{}, i.BuildArgs)
+	validatePathGlobs(validator, "include_paths", i.IncludePaths)
+	validatePathGlobs(validator, "exclude_paths", i.ExcludePaths)
+	validateNotifications(validator, i.Notifications)
+	validateBuilderOptions(validator, i.BuilderOptions)
+	validatePlatforms(validator, i.Platforms)
+	if i.Cache != "" {
+		validator.ShouldBeOneOf("cache", string(i.Cache), string(CacheInline), string(CacheRegistry), string(CacheLocal))
+	}
+
 	if len(i.Tags) > 0 {
 		for index, tag := range i.Tags {
 			_, errs := tag.Valid()
 			validator.ExtendElt("tags", index, errs)
 		}
+		validateTagRules(validator, i.Tags)
+	}
+
+	seen := make(map[ImageUpstream]bool, len(i.Upstreams))
+	for index, up := range i.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", index)
+		validator.NotEmptyString(field+".key", up.Key)
+		validator.NotEmptyString(field+".tag", up.Tag)
+		validator.Assert(field+".key", up.Key == "" || up.Key != i.Key, "image can not depend on itself")
+		validator.Assert(field+".key", up.Key == "" || up.Key == i.Key || graph.Has(up.Key), "upstream image doesn't exist")
+		validator.Assert(field, !seen[up], "duplicate upstream")
+		seen[up] = true
+	}
+	if len(i.Upstreams) > 0 {
+		if cycle := graph.With(i).Cycle(i.Key); cycle != nil {
+			validator.Assert("upstreams", false, fmt.Sprintf("dependency cycle: %s", strings.Join(cycle, " -> ")))
+		}
 	}
 
 	return validator.Valid(), validator.Errors()
 }
 
-// MatchingTag reports back the matching build tag for given commit info
-func (i Image) MatchingTag(commit *CommitInfo) (ImageTag, bool) {
-	for _, tag := range i.Tags {
-		if commit.RefType != tag.RefType {
-			continue
-		}
+// validBuilderOption matches the builder option names
+var validBuilderOption = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
 
-		if commit.RefType == SourceBranch {
-			if commit.Ref == tag.RefTest {
-				return tag, true
-			}
+// maxBuilderOptions is the maximum number of builder options of an image
+const maxBuilderOptions = 16
 
-			continue
-		}
+func validateBuilderOptions(validator *gova.Validator, options map[string]string) {
+	validator.Assert("builder_options", len(options) <= maxBuilderOptions, fmt.Sprintf("should have at most %d options", maxBuilderOptions))
+	for name, value := range options {
+		field := fmt.Sprintf("builder_options.%s", name)
+		validator.Assert(field, validBuilderOption.MatchString(name), "should be a lowercase alphanumeric name")
+		validator.MaxLength(field, value, 255)
+	}
+}
 
-		test := tag.RefTest
-		if test[0] == '/' && test[len(test)-1] == '/' {
-			test = test[1 : len(test)-1]
-		}
+// CacheStrategy is where the layer cache of an image's builds is kept
+type CacheStrategy string
+
+// Layer cache strategies
+const (
+	// CacheInline imports the cache from the image published by the previous
+	// build, cache metadata is kept in the pushed images
+	CacheInline CacheStrategy = "inline"
+	// CacheRegistry imports and exports the cache from a dedicated
+	// "buildcache" tag of the image
+	CacheRegistry CacheStrategy = "registry"
+	// CacheLocal keeps the cache with the builder, like in the docker
+	// daemon's storage, a buildkit cache directory or a codebuild s3 cache
+	CacheLocal CacheStrategy = "local"
+)
 
-		match, err := regexp.MatchString(test, commit.Ref)
-		if match && err == nil {
+// validPlatform matches the platforms like "linux/amd64" or "linux/arm/v7"
+var validPlatform = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// maxPlatforms is the maximum number of target platforms of an image
+const maxPlatforms = 8
+
+func validatePlatforms(validator *gova.Validator, platforms []string) {
+	validator.Assert("platforms", len(platforms) <= maxPlatforms, fmt.Sprintf("should have at most %d platforms", maxPlatforms))
+	seen := make(map[string]bool, len(platforms))
+	for index, platform := range platforms {
+		field := fmt.Sprintf("platforms[%d]", index)
+		validator.Assert(field, validPlatform.MatchString(platform), "should be a platform like linux/amd64")
+		validator.Assert(field, !seen[platform], "duplicate platform")
+		seen[platform] = true
+	}
+}
+
+// MatchingTag reports back the matching build tag for given commit info
+func (i Image) MatchingTag(commit *CommitInfo) (ImageTag, bool) {
+	for _, tag := range i.Tags {
+		if _, ok := tag.match(commit); ok {
 			return tag, true
 		}
 	}
@@ -76,6 +188,22 @@ type ImageTag struct {
 	RefType SourceRefType `json:"ref_type" bson:"ref_type,omitempty"`
 	RefTest string        `json:"ref_test" bson:"ref_test,omitempty"`
 	Name    string        `json:"name" bson:"name,omitempty"`
+	// Aliases are the additional tag names published along with Name. They
+	// can be templates like Name.
+	Aliases []string `json:"aliases,omitempty" bson:"aliases,omitempty"`
+	// Semver enables publishing the floating major and minor version tags
+	// like "1" and "1.4" for the git tags which are semantic versions. Only
+	// git tag matchers can enable it.
+	Semver bool `json:"semver,omitempty" bson:"semver,omitempty"`
+	// SemverLatest enables moving "latest" tag to the highest semantic
+	// version along with the floating version tags
+	SemverLatest bool `json:"semver_latest,omitempty" bson:"semver_latest,omitempty"`
+	// BuildArgs are the build time variables for the builds of this tag, they
+	// override the image's build args with the same name
+	BuildArgs []BuildArg `json:"build_args,omitempty" bson:"build_args,omitempty"`
+	// Schedule is a cron expression for rebuilding the branch periodically,
+	// only branch tags can be scheduled
+	Schedule string `json:"schedule,omitempty" bson:"schedule,omitempty"`
 }
 
 // Valid validates the image tag data
@@ -83,25 +211,284 @@ func (it ImageTag) Valid() (bool, gova.ValidationErrors) {
 	validator := &gova.Validator{}
 	validator.ShouldBeOneOf("ref_type", string(it.RefType), string(SourceTag), string(SourceBranch))
 	validator.NotEmptyString("ref_test", it.RefTest)
+	validator.MaxLength("ref_test", it.RefTest, maxRefTestLength)
 
 	if it.RefType == SourceBranch {
 		validator.NotEmptyString("name", it.Name)
+		if isBranchGlob(it.RefTest) {
+			_, err := path.Match(it.RefTest, "")
+			validator.Assert("ref_test", err == nil, "should be a valid glob pattern")
+		}
+	}
+
+	if it.Name != "" && !isTagTemplate(it.Name) {
+		validator.DockerTag("name", it.Name)
+	}
+
+	if it.RefType == SourceTag && it.RefTest != "" {
+		validator.Regexp("ref_test", it.refTestExpr())
+	}
+
+	if isTagTemplate(it.Name) {
+		validator.Assert("name", it.validTemplate(it.Name), "should be a valid tag template")
+	}
+
+	for index, alias := range it.Aliases {
+		field := fmt.Sprintf("aliases[%d]", index)
+		validator.NotEmptyString(field, alias)
+		if isTagTemplate(alias) {
+			validator.Assert(field, it.validTemplate(alias), "should be a valid tag template")
+		} else if alias != "" {
+			validator.DockerTag(field, alias)
+		}
+	}
+
+	if it.Semver {
+		validator.Assert("semver", it.RefType == SourceTag, "only git tags can publish semantic versions")
+	}
+	validator.Assert("semver_latest", !it.SemverLatest || it.Semver, "requires semver to be enabled")
+
+	validateBuildArgs(validator, it, it.BuildArgs)
+
+	if it.Schedule != "" {
+		validator.Assert("schedule", it.RefType == SourceBranch, "only branch tags can be scheduled")
+		validator.Assert("schedule", !isBranchGlob(it.RefTest), "branch patterns can not be scheduled")
+		_, err := cron.Parse(it.Schedule)
+		validator.Assert("schedule", err == nil, "should be a valid cron expression")
 	}
 
 	return validator.Valid(), validator.Errors()
 }
 
-// Tag reports back container tag name
-func (it ImageTag) Tag(commit *CommitInfo) string {
+// Tag reports back container tag name. Names containing template actions
+// are rendered with the commit info and the capture groups of the ref test,
+// see TagContext. Tag names derived from the refs are sanitised to be valid
+// docker tags.
+func (it ImageTag) Tag(commit *CommitInfo) (string, error) {
+	if it.Name == "" {
+		return SanitizeTagName(commit.Ref), nil
+	}
+
+	return it.render(it.Name, commit)
+}
+
+// Tags reports back all the container tag names, the first one is the tag
+// reported by Tag and the rest are the rendered aliases without duplicates.
+func (it ImageTag) Tags(commit *CommitInfo) ([]string, error) {
+	tag, err := it.Tag(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{tag}
+	seen := map[string]bool{tag: true}
+	for _, alias := range it.Aliases {
+		name, err := it.render(alias, commit)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			tags = append(tags, name)
+		}
+	}
+
+	return tags, nil
+}
+
+func (it ImageTag) render(name string, commit *CommitInfo) (string, error) {
+	if !isTagTemplate(name) {
+		return name, nil
+	}
+
+	groups, _ := it.match(commit)
+	rendered, err := renderTagTemplate(name, newTagContext(commit, groups))
+	if err != nil || rendered == "" {
+		return "", ErrImageBadTagTemplate
+	}
+
+	return SanitizeTagName(rendered), nil
+}
+
+// match reports whether the commit matches the tag along with the capture
+// groups of the ref test
+func (it ImageTag) match(commit *CommitInfo) ([]string, bool) {
+	if commit.RefType != it.RefType {
+		return nil, false
+	}
+
 	if it.RefType == SourceBranch {
-		return it.Name
+		if commit.Ref == it.RefTest {
+			return []string{commit.Ref}, true
+		}
+
+		if isBranchGlob(it.RefTest) {
+			if ok, _ := path.Match(it.RefTest, commit.Ref); ok {
+				return []string{commit.Ref}, true
+			}
+		}
+
+		return nil, false
 	}
 
-	if it.Name == "" {
-		return commit.Ref
+	re, err := it.refRegexp()
+	if err != nil {
+		return nil, false
+	}
+
+	groups := re.FindStringSubmatch(commit.Ref)
+	return groups, groups != nil
+}
+
+// isBranchGlob reports whether the branch ref test is a glob pattern like
+// "release/*"
+func isBranchGlob(test string) bool {
+	return strings.ContainsAny(test, "*?[")
+}
+
+// refRegexps caches the compiled ref tests, so webhooks don't compile them
+// again for every image
+var refRegexps sync.Map
+
+// refRegexp compiles the ref test of git tag matchers
+func (it ImageTag) refRegexp() (*regexp.Regexp, error) {
+	expr := it.refTestExpr()
+	if re, ok := refRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	refRegexps.Store(expr, re)
+	return re, nil
+}
+
+// refTestExpr reports back the regular expression of the ref test. Ref
+// tests can be wrapped in slashes like `/^v\d+$/`.
+func (it ImageTag) refTestExpr() string {
+	test := it.RefTest
+	if len(test) > 1 && test[0] == '/' && test[len(test)-1] == '/' {
+		test = test[1 : len(test)-1]
 	}
 
-	return it.Name
+	return test
+}
+
+// validateTagRules reports the tag rules which can never match because an
+// earlier rule has the same ref test or an earlier branch pattern matches
+// the branch first
+func validateTagRules(validator *gova.Validator, tags []ImageTag) {
+	for index, tag := range tags {
+		field := fmt.Sprintf("tags[%d].ref_test", index)
+		for prev, other := range tags[:index] {
+			if other.RefType != tag.RefType || other.RefTest == "" {
+				continue
+			}
+
+			if other.RefTest == tag.RefTest {
+				validator.Assert(field, false, fmt.Sprintf("duplicates tags[%d]", prev))
+				break
+			}
+
+			if tag.RefType == SourceBranch && !isBranchGlob(tag.RefTest) && isBranchGlob(other.RefTest) {
+				if ok, _ := path.Match(other.RefTest, tag.RefTest); ok {
+					validator.Assert(field, false, fmt.Sprintf("never matches, tags[%d] matches the branch first", prev))
+					break
+				}
+			}
+		}
+	}
+}
+
+// validTemplate reports whether the given tag name template renders without
+// errors for the commits matching the tag
+func (it ImageTag) validTemplate(name string) bool {
+	ngroups := 1
+	if it.RefType == SourceTag {
+		re, err := it.refRegexp()
+		if err != nil {
+			return false
+		}
+		ngroups += re.NumSubexp()
+	}
+
+	sample := &CommitInfo{
+		Ref:       it.RefTest,
+		RefType:   it.RefType,
+		Hash:      "0000000000000000000000000000000000000000",
+		CreatedAt: time.Now(),
+	}
+	_, err := renderTagTemplate(name, newTagContext(sample, make([]string, ngroups)))
+	return err == nil
+}
+
+// BuildArg is a build time variable passed to docker build
+type BuildArg struct {
+	Name  string `json:"name" bson:"name"`
+	Value string `json:"value" bson:"value"`
+}
+
+const (
+	// maxPathLength is the maximum length of the paths in the repository
+	maxPathLength = 1024
+	// maxRefTestLength is the maximum length of the tag ref tests
+	maxRefTestLength = 255
+)
+
+var (
+	validImageName    = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	validStageName    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	validBuildArgName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// validPath matches the paths passed to the build scripts as they are
+	validPath = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+)
+
+// buildArgs reports back the build args of the builds of this tag for the
+// commit. Tag's build args override the image's and the templates in the
+// values are rendered like the tag names.
+func (it ImageTag) buildArgs(img Image, commit *CommitInfo) ([]BuildArg, error) {
+	var args []BuildArg
+	index := make(map[string]int)
+	for _, arg := range append(append([]BuildArg{}, img.BuildArgs...), it.BuildArgs...) {
+		value := arg.Value
+		if isTagTemplate(value) {
+			groups, _ := it.match(commit)
+			rendered, err := renderTagTemplate(value, newTagContext(commit, groups))
+			if err != nil {
+				return nil, ErrImageBadTagTemplate
+			}
+			value = rendered
+		}
+
+		if i, ok := index[arg.Name]; ok {
+			args[i].Value = value
+			continue
+		}
+
+		index[arg.Name] = len(args)
+		args = append(args, BuildArg{arg.Name, value})
+	}
+
+	return args, nil
+}
+
+// validateBuildArgs validates build args whose values are rendered for the
+// commits matching the given tag
+func validateBuildArgs(validator *gova.Validator, tag ImageTag, args []BuildArg) {
+	seen := make(map[string]bool, len(args))
+	for index, arg := range args {
+		field := fmt.Sprintf("build_args[%d]", index)
+		validator.Assert(field+".name", validBuildArgName.MatchString(arg.Name), "should be a valid variable name")
+		validator.Assert(field+".name", !seen[arg.Name], "duplicate build arg")
+		if isTagTemplate(arg.Value) {
+			validator.Assert(field+".value", tag.validTemplate(arg.Value), "should be a valid template")
+		}
+		seen[arg.Name] = true
+	}
 }
 
 // ImageStorage stores and queries image data
@@ -115,6 +502,12 @@ type ImageStorage interface {
 	// List retrieves a matching list of images
 	List(username string, options ListOptions) ([]Image, Pagination, error)
 
+	// All retrieves all the images belonging to user
+	All(username string) ([]Image, error)
+
+	// FindByRepository retrieves the images of user built from the repository
+	FindByRepository(username string, repo SourceRepository) ([]Image, error)
+
 	// Put inserts a new image record
 	Put(image Image) error
 
@@ -125,11 +518,20 @@ type ImageStorage interface {
 	Delete(username string, key string) error
 }
 
-// ImageKey generates a unique image key from the repository
-func ImageKey(repo SourceRepository) string {
+// ImageKey generates a unique image key from the image's repository and name.
+// Images named after their repositories have "provider:owner:repository"
+// keys, other images of the same repository are distinguished by their names
+// like "provider:owner:repository:name".
+func ImageKey(img Image) string {
+	repo := img.Repository
 	if repo.Name == "" || repo.Provider == "" || repo.Owner == "" {
 		return ""
 	}
 
-	return fmt.Sprintf("%s:%s:%s", repo.Provider, repo.Owner, repo.Name)
+	key := fmt.Sprintf("%s:%s:%s", repo.Provider, repo.Owner, repo.Name)
+	if img.Name != "" && img.Name != repo.Name {
+		key = fmt.Sprintf("%s:%s", key, img.Name)
+	}
+
+	return key
 }
@@ -15,3 +15,52 @@ func TestImageKey(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestImageValidName(t *testing.T) {
+	tests := map[string]bool{
+		"app":       true,
+		"app-cache": true,
+		"app_2":     true,
+		"app/cache": false,
+		"app.web":   false,
+		"App":       false,
+		"-app":      false,
+	}
+
+	for name, expected := range tests {
+		img := Image{
+			Name:           name,
+			Owner:          "owner",
+			Repository:     SourceRepository{Provider: "github", Owner: "owner", Name: "app"},
+			DockerfilePath: "Dockerfile",
+			Tags:           []ImageTag{{RefType: SourceBranch, RefTest: "master", Name: "latest"}},
+		}
+		if valid, _ := img.Valid(NewDependencyGraph(nil)); valid != expected {
+			t.Errorf("%q: expected valid %v, got %v", name, expected, valid)
+		}
+	}
+}
+
+func TestImageValidDockerfilePath(t *testing.T) {
+	tests := map[string]bool{
+		"Dockerfile":            true,
+		"docker/app.Dockerfile": true,
+		"../Dockerfile":         false,
+		"Dockerfile; rm -rf /":  false,
+		"$(id)":                 false,
+		"docker file":           false,
+	}
+
+	for path, expected := range tests {
+		img := Image{
+			Name:           "app",
+			Owner:          "owner",
+			Repository:     SourceRepository{Provider: "github", Owner: "owner", Name: "app"},
+			DockerfilePath: path,
+			Tags:           []ImageTag{{RefType: SourceBranch, RefTest: "master", Name: "latest"}},
+		}
+		if valid, _ := img.Valid(NewDependencyGraph(nil)); valid != expected {
+			t.Errorf("%q: expected valid %v, got %v", path, expected, valid)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// LeaseStorage grants time limited exclusive leases. Leases are used for
+// making sure only one replica of a service runs a periodic task at a time.
+type LeaseStorage interface {
+	// Acquire acquires the named lease for the holder or renews it if the
+	// holder already owns it. It reports false if the lease is owned by
+	// another holder and not expired yet.
+	Acquire(name string, holder string, ttl time.Duration) (bool, error)
+
+	// Release releases the named lease if it is owned by the holder
+	Release(name string, holder string) error
+}
@@ -0,0 +1,132 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/gova"
+)
+
+// NotificationTarget is an http endpoint the results of an image's builds
+// are posted to
+type NotificationTarget struct {
+	URL string `json:"url" bson:"url" yaml:"url"`
+	// Restricted targets come from the repository configs rather than the
+	// image owner. They should be https urls of public hosts, connections
+	// to loopback and private addresses are refused.
+	Restricted bool `json:"restricted,omitempty" bson:"restricted,omitempty" yaml:"-"`
+}
+
+// restrictedClient posts the notifications of the restricted targets
+var restrictedClient = &http.Client{
+	Timeout: time.Minute,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, Control: publicAddrOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// BuildNotification is the json body posted to the notification targets
+type BuildNotification struct {
+	ImageKey   string      `json:"image_key"`
+	ImageName  string      `json:"image_name"`
+	BuildID    string      `json:"build_id"`
+	Status     BuildStatus `json:"status"`
+	Tags       []string    `json:"tags"`
+	CommitRef  string      `json:"ref"`
+	CommitHash string      `json:"hash"`
+	FinishedAt time.Time   `json:"finished_at"`
+}
+
+// NotifyBuild posts the result of the build to the job's notification
+// targets. All the targets are tried even if some of them fail, the first
+// error is reported back.
+func NotifyBuild(ctx context.Context, job *BuildJob, record BuildRecord) error {
+	body, err := json.Marshal(BuildNotification{
+		ImageKey:   job.ImageKey,
+		ImageName:  job.ImageName,
+		BuildID:    record.ID,
+		Status:     record.Status,
+		Tags:       record.Tags,
+		CommitRef:  record.CommitRef,
+		CommitHash: record.CommitHash,
+		FinishedAt: record.FinishedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	var notifyErr error
+	for _, target := range job.Notifications {
+		client := http.DefaultClient
+		if target.Restricted {
+			client = restrictedClient
+		}
+		if err := postNotification(ctx, client, target.URL, body); err != nil && notifyErr == nil {
+			notifyErr = err
+		}
+	}
+
+	return notifyErr
+}
+
+func postNotification(ctx context.Context, client *http.Client, targetURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("notify %s: unexpected status %d", targetURL, res.StatusCode)
+	}
+
+	return nil
+}
+
+// publicAddrOnly refuses dialing the addresses which aren't public, it is
+// checked after the host names are resolved
+func publicAddrOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("notify: %s is not a public address", host)
+	}
+
+	return nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+func validateNotifications(validator *gova.Validator, targets []NotificationTarget) {
+	for index, target := range targets {
+		field := fmt.Sprintf("notifications[%d].url", index)
+		u, err := url.Parse(target.URL)
+		valid := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		validator.Assert(field, valid, "should be an http or https url")
+		if valid && target.Restricted {
+			ip := net.ParseIP(u.Hostname())
+			public := u.Hostname() != "localhost" && (ip == nil || isPublicIP(ip))
+			validator.Assert(field, u.Scheme == "https" && public, "should be an https url of a public host")
+		}
+	}
+}
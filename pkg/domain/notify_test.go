@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mobingilabs/pullr/pkg/gova"
+)
+
+func TestValidateNotifications(t *testing.T) {
+	tests := []struct {
+		target NotificationTarget
+		valid  bool
+	}{
+		{NotificationTarget{URL: "http://hooks.example.com/build"}, true},
+		{NotificationTarget{URL: "http://10.0.0.2/build"}, true},
+		{NotificationTarget{URL: "ftp://hooks.example.com"}, false},
+		{NotificationTarget{URL: "https://hooks.example.com/build", Restricted: true}, true},
+		{NotificationTarget{URL: "http://hooks.example.com/build", Restricted: true}, false},
+		{NotificationTarget{URL: "https://localhost/build", Restricted: true}, false},
+		{NotificationTarget{URL: "https://127.0.0.1:8080/build", Restricted: true}, false},
+		{NotificationTarget{URL: "https://10.0.0.2/build", Restricted: true}, false},
+		{NotificationTarget{URL: "https://169.254.169.254/latest", Restricted: true}, false},
+		{NotificationTarget{URL: "https://[::1]/build", Restricted: true}, false},
+	}
+
+	for _, test := range tests {
+		validator := &gova.Validator{}
+		validateNotifications(validator, []NotificationTarget{test.target})
+		if validator.Valid() != test.valid {
+			t.Errorf("%+v: expected valid %v, got %v", test.target, test.valid, validator.Errors())
+		}
+	}
+}
+
+func TestNotifyBuildRestricted(t *testing.T) {
+	posted := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted++
+	}))
+	defer srv.Close()
+
+	job := &BuildJob{ImageKey: "github:owner:app", Notifications: []NotificationTarget{{URL: srv.URL}}}
+	if err := NotifyBuild(context.Background(), job, BuildRecord{Status: BuildSucceed}); err != nil || posted != 1 {
+		t.Fatalf("expected owner's target to be notified, got %d posts: %v", posted, err)
+	}
+
+	job.Notifications[0].Restricted = true
+	if err := NotifyBuild(context.Background(), job, BuildRecord{Status: BuildSucceed}); err == nil || posted != 1 {
+		t.Errorf("expected loopback target from the repository config to be refused, got %d posts: %v", posted, err)
+	}
+}
+
+func TestRepoConfigRestrictions(t *testing.T) {
+	if _, err := ParseRepoConfig([]byte("tags:\n  - {ref_type: branch, ref_test: master, name: latest, schedule: '@daily'}\n")); err == nil {
+		t.Error("expected schedule to be rejected in repository config")
+	}
+
+	conf, err := ParseRepoConfig([]byte("notifications:\n  - url: https://hooks.example.com/build\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := conf.Apply(Image{Notifications: []NotificationTarget{{URL: "http://10.0.0.2/build"}}})
+	if len(img.Notifications) != 1 || !img.Notifications[0].Restricted {
+		t.Errorf("expected repository config targets to be restricted, got %+v", img.Notifications)
+	}
+}
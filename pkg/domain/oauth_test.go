@@ -29,6 +29,10 @@ func (p *testOAuthProvider) FinishLogin(secret string, req *http.Request) (strin
 	return "testtoken", nil
 }
 
+func (p *testOAuthProvider) Identity(token string) (string, error) {
+	return "testuser", nil
+}
+
 func (t *testOAuthProvider) GetSecret(req *http.Request) string {
 	if t.WrongSecret {
 		return "somewrongsecret"
@@ -47,17 +51,17 @@ func TestOAuthService(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	token, err := oauthsvc.FinishLogin("test", "test", nil)
+	token, redir, err := oauthsvc.FinishLogin("test", "test", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	if token.Token != "testtoken" {
-		t.Errorf("expected token: testtoken, got: %s", token)
+		t.Errorf("expected token: testtoken, got: %s", token.Token)
 	}
 
-	if !strings.HasPrefix(token.Redirect, "redir") {
-		t.Errorf("expected redirect url to start with: redir, but redirec url is: %s", token.Redirect)
+	if !strings.HasPrefix(redir, "redir") {
+		t.Errorf("expected redirect url to start with: redir, but redirec url is: %s", redir)
 	}
 }
 
@@ -71,7 +75,7 @@ func TestOAuthService_BadRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = oauthsvc.FinishLogin("test", "test", nil)
+	_, _, err = oauthsvc.FinishLogin("test", "test", nil)
 	if err != ErrNotFound {
 		t.Error("mismatching secrets should result not found error")
 	}
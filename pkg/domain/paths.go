@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mobingilabs/pullr/pkg/gova"
+)
+
+// WatchesPaths reports whether the image builds only for the pushes changing
+// its include or exclude paths
+func (i Image) WatchesPaths() bool {
+	return len(i.IncludePaths) > 0 || len(i.ExcludePaths) > 0
+}
+
+// PathsChanged reports whether any of the changed files is relevant to the
+// image. A file is relevant if it matches one of the include paths, or there
+// are no include paths, and it doesn't match any of the exclude paths.
+func (i Image) PathsChanged(files []string) bool {
+	for _, file := range files {
+		if len(i.IncludePaths) > 0 && !matchAnyPath(i.IncludePaths, file) {
+			continue
+		}
+		if matchAnyPath(i.ExcludePaths, file) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func matchAnyPath(globs []string, file string) bool {
+	for _, glob := range globs {
+		if matchPathGlob(glob, file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPathGlob reports whether the file or any of its parent directories
+// matches the glob. Glob segments are matched with path.Match and "**"
+// segments match zero or more directories, so "services/api" and
+// "services/*/**/*.go" both match "services/api/cmd/main.go".
+func matchPathGlob(glob, file string) bool {
+	globParts := strings.Split(path.Clean(glob), "/")
+	fileParts := strings.Split(path.Clean(file), "/")
+	return matchPathParts(globParts, fileParts)
+}
+
+func matchPathParts(glob, file []string) bool {
+	if len(glob) == 0 {
+		// Glob matched a parent directory of the file
+		return true
+	}
+
+	if glob[0] == "**" {
+		for skip := 0; skip <= len(file); skip++ {
+			if matchPathParts(glob[1:], file[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(file) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(glob[0], file[0])
+	return err == nil && ok && matchPathParts(glob[1:], file[1:])
+}
+
+// isValidPathGlob reports whether the glob is well formed and relative to the
+// repository root
+func isValidPathGlob(glob string) bool {
+	if !gova.IsRelativePath(glob) {
+		return false
+	}
+
+	for _, part := range strings.Split(path.Clean(glob), "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validatePathGlobs(validator *gova.Validator, field string, globs []string) {
+	for index, glob := range globs {
+		validator.Assert(fmt.Sprintf("%s[%d]", field, index), isValidPathGlob(glob), "should be a valid path glob inside the repository")
+	}
+}
@@ -0,0 +1,73 @@
+package domain
+
+import "testing"
+
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		glob     string
+		file     string
+		expected bool
+	}{
+		{"services/api", "services/api/cmd/main.go", true},
+		{"services/api", "services/apiv2/main.go", false},
+		{"services/*/**/*.go", "services/api/cmd/main.go", true},
+		{"services/*/**/*.go", "services/api/main.go", true},
+		{"services/*/**/*.go", "services/api/README.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/intro.md", true},
+		{"docs/", "docs/intro.md", true},
+		{"./docs", "docs/intro.md", true},
+		{"*.go", "cmd/main.go", false},
+		{"cmd/main.go/extra", "cmd/main.go", false},
+	}
+
+	for _, test := range tests {
+		if got := matchPathGlob(test.glob, test.file); got != test.expected {
+			t.Errorf("matchPathGlob(%q, %q): expected %v, got %v", test.glob, test.file, test.expected, got)
+		}
+	}
+}
+
+func TestImagePathsChanged(t *testing.T) {
+	tests := []struct {
+		include  []string
+		exclude  []string
+		files    []string
+		expected bool
+	}{
+		{nil, nil, []string{"main.go"}, true},
+		{nil, nil, nil, false},
+		{[]string{"api"}, nil, []string{"web/index.html"}, false},
+		{[]string{"api"}, nil, []string{"web/index.html", "api/main.go"}, true},
+		{nil, []string{"**/*.md"}, []string{"README.md", "docs/intro.md"}, false},
+		{nil, []string{"**/*.md"}, []string{"README.md", "main.go"}, true},
+		{[]string{"api"}, []string{"api/docs"}, []string{"api/docs/intro.md"}, false},
+		{[]string{"api"}, []string{"api/docs"}, []string{"api/docs/intro.md", "api/main.go"}, true},
+	}
+
+	for _, test := range tests {
+		img := Image{IncludePaths: test.include, ExcludePaths: test.exclude}
+		if got := img.PathsChanged(test.files); got != test.expected {
+			t.Errorf("include %v exclude %v files %v: expected %v, got %v", test.include, test.exclude, test.files, test.expected, got)
+		}
+	}
+}
+
+func TestIsValidPathGlob(t *testing.T) {
+	tests := map[string]bool{
+		"services/api":       true,
+		"services/*/**/*.go": true,
+		"docs/[a-z]*.md":     true,
+		"":                   false,
+		"/etc":               false,
+		"..":                 false,
+		"../other":           false,
+		"docs/[a-z.md":       false,
+	}
+
+	for glob, expected := range tests {
+		if got := isValidPathGlob(glob); got != expected {
+			t.Errorf("isValidPathGlob(%q): expected %v, got %v", glob, expected, got)
+		}
+	}
+}
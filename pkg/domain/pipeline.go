@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -18,11 +19,18 @@ type PipelineConfig struct {
 	RegistryPassword string
 }
 
+// RegistryHost strips the scheme and the trailing slash of the registry url,
+// like "https://registry.example.com/" to "registry.example.com"
+func RegistryHost(registryURL string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://")
+	return strings.TrimSuffix(host, "/")
+}
+
 // RepositoryCloner clones source code
 type RepositoryCloner interface {
-	// CloneRepository clones the given source repository into target directory and reports
-	// back the path for cloned repository.
-	CloneRepository(ctx context.Context, out io.Writer, target string, repo SourceRepository, username, token string) error
+	// CloneRepository clones the given source repository into target directory and
+	// checks out the given commit. If commit is empty default branch is used.
+	CloneRepository(ctx context.Context, out io.Writer, target string, repo SourceRepository, commit, username, token string) error
 }
 
 // ImageBuilderFactory creates ImageBuilders. Each running pipeline gets its own image
@@ -32,20 +40,109 @@ type ImageBuilderFactory interface {
 	Create() (ImageBuilder, error)
 }
 
+// ImageBuildOptions describes how an image should be built
+type ImageBuildOptions struct {
+	// Dockerfile is path of the Dockerfile relative to the source root
+	Dockerfile string
+	// Context is path of the build context relative to the source root, it
+	// is the source root if empty
+	Context string
+	// Target is the build stage to build, last stage is built if empty
+	Target string
+	// BuildArgs are the build time variables
+	BuildArgs []BuildArg
+	// Secrets are exposed to the build as secret mounts, they are not kept
+	// in the image layers
+	Secrets []BuildSecret
+	// Tags are the names of the image to be built, image is built once and
+	// tagged with all of them
+	Tags []string
+	// NoCache disables using layer cache while building the image
+	NoCache bool
+	// Platforms are the target platforms of a multi platform image, the
+	// tags point to a manifest list of the platform images once they are
+	// pushed. Image is built for the builder's platform if it is empty.
+	Platforms []string
+	// Cache is the layer cache of the build
+	Cache BuildCache
+}
+
+// BuildCache describes where the layer cache of a build is kept
+type BuildCache struct {
+	Strategy CacheStrategy
+	// Ref is the registry image the cache is imported from, the previous
+	// image for inline cache or the dedicated cache image for registry
+	// cache. Registry cache is exported to it too.
+	Ref string
+	// Key identifies the image's local cache, it changes when the cache is
+	// purged
+	Key string
+	// Username and Password are the credentials of the registry the cache
+	// is imported from
+	Username string
+	Password string
+}
+
 // ImageBuilder builds container images. When it is closed, it cleans up the
 // resources created during building an image.
 type ImageBuilder interface {
 	io.Closer
-	// BuildImage builds a container image from a Dockerfile located at ctxPath.
-	// ctxPath is also used as build context
-	BuildImage(ctx context.Context, out io.Writer, ctxPath, dockerfile, tag string) (BuildStatus, error)
+	// BuildImage builds a container image from the source located at
+	// ctxPath. Dockerfile and build context paths in the options are relative
+	// to ctxPath.
+	BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts ImageBuildOptions) (BuildStatus, error)
+
+	// PushImage pushes the tags of a container image to the given registry
+	PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error
+}
+
+// BuilderCapabilities are the optional build features of a builder
+type BuilderCapabilities struct {
+	// Platforms is set if multi platform images can be built
+	Platforms bool
+	// Secrets is set if build secrets can be exposed to the builds
+	Secrets bool
+}
+
+// CapableBuilder is implemented by the image builder factories and the
+// pipelines supporting optional build features, the others support none
+type CapableBuilder interface {
+	Capabilities() BuilderCapabilities
+}
+
+// CapabilitiesOf reports back the optional build features of an image
+// builder factory or a pipeline
+func CapabilitiesOf(builder interface{}) BuilderCapabilities {
+	if capable, ok := builder.(CapableBuilder); ok {
+		return capable.Capabilities()
+	}
 
-	// PushImage pushes a container image to the given registry
-	PushImage(ctx context.Context, out io.Writer, tag, registry, username, password string) error
+	return BuilderCapabilities{}
 }
 
+// BuildResourceCleaner removes the resources builders keep for an image
+// between its builds, like the codebuild projects
+type BuildResourceCleaner interface {
+	CleanImage(ctx context.Context, owner, imageKey string) error
+}
+
+// BuildSecretCleaner removes the copies of a build secret builders keep for
+// an image, like the codebuild parameters
+type BuildSecretCleaner interface {
+	CleanSecret(ctx context.Context, owner, imageKey, name string) error
+}
+
+// BuildCachePurger removes the layer caches builders keep for an image, like
+// the codebuild project caches
+type BuildCachePurger interface {
+	PurgeCache(ctx context.Context, owner, imageKey string) error
+}
+
+// Pipeline builds and publishes the images described by the build jobs
 type Pipeline interface {
-	Run(ctx context.Context, logOut io.Writer, job *BuildJob) error
+	// Run builds and pushes the image of the job and reports back the status
+	// of the build. Build logs are written to logOut.
+	Run(ctx context.Context, logOut io.Writer, job *BuildJob) (BuildStatus, error)
 }
 
 // HostedPipeline is the image build pipeline
@@ -55,16 +152,78 @@ type HostedPipeline struct {
 	cloners        map[string]RepositoryCloner
 	builderFactory ImageBuilderFactory
 	randSource     rand.Source
+
+	// Optional base image tracking
+	baseImages BaseImageStorage
+	registry   ImageRegistry
+
+	// Optional build secrets
+	secrets *SecretService
+
+	// Optional floating version tags
+	versions VersionStorage
 }
 
 // NewPipeline creates a build pipeline for given job
 func NewPipeline(config PipelineConfig, logger Logger, cloners map[string]RepositoryCloner, builderFactory ImageBuilderFactory) *HostedPipeline {
 	randSource := rand.NewSource(time.Now().UnixNano())
-	return &HostedPipeline{config, logger, cloners, builderFactory, randSource}
+	return &HostedPipeline{config: config, logger: logger, cloners: cloners, builderFactory: builderFactory, randSource: randSource}
+}
+
+// TrackBaseImages makes the pipeline record base images of the built images
+// along with their current digests
+func (p *HostedPipeline) TrackBaseImages(storage BaseImageStorage, registry ImageRegistry) {
+	p.baseImages = storage
+	p.registry = registry
+}
+
+// UseSecrets makes the pipeline expose the image secrets to the builds
+func (p *HostedPipeline) UseSecrets(secrets *SecretService) {
+	p.secrets = secrets
+}
+
+// UseVersions makes the pipeline publish the floating version tags of the
+// semantic version builds against the versions recorded in the storage
+func (p *HostedPipeline) UseVersions(versions VersionStorage) {
+	p.versions = versions
+}
+
+// Capabilities reports back the optional build features of the image
+// builders
+func (p *HostedPipeline) Capabilities() BuilderCapabilities {
+	return CapabilitiesOf(p.builderFactory)
+}
+
+// Close releases the resources kept by the image builder factory like the
+// warm build machines
+func (p *HostedPipeline) Close() error {
+	if closer, ok := p.builderFactory.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
 }
 
 // Run, runs the build pipeline against the given job
 func (p *HostedPipeline) Run(ctx context.Context, out io.Writer, job *BuildJob) (status BuildStatus, err error) {
+	var secrets []BuildSecret
+	if p.secrets != nil {
+		secrets, err = p.secrets.BuildSecrets(job.ImageOwner, job.ImageKey)
+		if err != nil {
+			return BuildFailed, fmt.Errorf("pipeline: secrets: %v", err)
+		}
+
+		redactor := NewRedactingWriter(out, SecretValues(secrets))
+		defer redactor.Flush()
+		out = redactor
+	}
+	if len(secrets) > 0 && !p.Capabilities().Secrets {
+		// Retrying wouldn't help, secrets should be removed or the builder
+		// changed
+		fmt.Fprintf(out, "Build failed: %v\n", ErrBuildSecretsUnsupported)
+		return BuildFailed, nil
+	}
+
 	cloner, ok := p.cloners[job.ImageRepo.Provider]
 	if !ok {
 		return BuildFailed, ErrSourceUnsupportedProvider
@@ -74,23 +233,54 @@ func (p *HostedPipeline) Run(ctx context.Context, out io.Writer, job *BuildJob)
 	dir := filepath.Join(p.config.CloneDir, dirname)
 	defer os.RemoveAll(dir)
 
-	err = cloner.CloneRepository(ctx, out, dir, job.ImageRepo, job.VcsUsername, job.VcsToken)
+	err = cloner.CloneRepository(ctx, out, dir, job.ImageRepo, job.CommitHash, job.VcsUsername, job.VcsToken)
 	if err != nil {
 		return BuildFailed, fmt.Errorf("pipeline: clone: %v", err)
 	}
 
+	if p.baseImages != nil {
+		if err := p.recordBaseImages(ctx, dir, job); err != nil {
+			p.logger.Errorf("pipeline: record base images: %v", err)
+		}
+	}
+
 	builder, err := p.builderFactory.Create()
 	if err != nil {
 		return BuildFailed, err
 	}
 	defer builder.Close()
-	tag := fmt.Sprintf("%s/%s:%s", job.ImageOwner, job.ImageName, job.Tag)
-	status, err = builder.BuildImage(ctx, out, dir, job.Dockerfile, tag)
+
+	// Some builders push while building, so the floating tags are decided
+	// right before the build
+	if p.versions != nil {
+		if err := AddFloatingTags(p.versions, job); err != nil {
+			return BuildFailed, fmt.Errorf("pipeline: versions: %v", err)
+		}
+	}
+
+	var tags []string
+	for _, tag := range job.AllTags() {
+		tags = append(tags, fmt.Sprintf("%s/%s:%s", job.ImageOwner, job.ImageName, tag))
+	}
+	status, err = builder.BuildImage(ctx, out, dir, ImageBuildOptions{
+		Dockerfile: job.Dockerfile,
+		Context:    job.BuildContext,
+		Target:     job.Target,
+		BuildArgs:  job.BuildArgs,
+		Secrets:    secrets,
+		Tags:       tags,
+		NoCache:    job.NoCache,
+		Platforms:  job.Platforms,
+		Cache:      p.buildCache(job),
+	})
 	if err != nil {
 		return BuildFailed, fmt.Errorf("pipeline: build: %v", err)
 	}
+	if status != BuildSucceed {
+		return status, nil
+	}
 
-	err = builder.PushImage(ctx, out, tag, p.config.RegistryURL, p.config.RegistryUser, p.config.RegistryPassword)
+	err = builder.PushImage(ctx, out, tags, p.config.RegistryURL, p.config.RegistryUser, p.config.RegistryPassword)
 	if err != nil {
 		return BuildFailed, fmt.Errorf("pipeline: push: %v", err)
 	}
@@ -100,3 +290,28 @@ func (p *HostedPipeline) Run(ctx context.Context, out io.Writer, job *BuildJob)
 
 	return status, nil
 }
+
+// buildCache reports back the layer cache of the job's build
+func (p *HostedPipeline) buildCache(job *BuildJob) BuildCache {
+	if job.Cache == "" {
+		return BuildCache{}
+	}
+
+	return BuildCache{
+		Strategy: job.Cache,
+		Ref:      job.CacheRef(RegistryHost(p.config.RegistryURL)),
+		Key:      job.CacheKey(),
+		Username: p.config.RegistryUser,
+		Password: p.config.RegistryPassword,
+	}
+}
+
+func (p *HostedPipeline) recordBaseImages(ctx context.Context, dir string, job *BuildJob) error {
+	dockerfile, err := os.Open(filepath.Join(dir, job.Dockerfile))
+	if err != nil {
+		return err
+	}
+	defer dockerfile.Close()
+
+	return RecordBaseImages(ctx, p.baseImages, p.registry, job.ImageOwner, job.ImageKey, dockerfile)
+}
@@ -0,0 +1,179 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type fakeCloner struct{}
+
+func (fakeCloner) CloneRepository(ctx context.Context, out io.Writer, target string, repo SourceRepository, commit, username, token string) error {
+	return os.MkdirAll(target, 0755)
+}
+
+// fakeBuilder reports back the given build status and records the pushes
+type fakeBuilder struct {
+	status BuildStatus
+	pushed []string
+}
+
+func (b *fakeBuilder) Create() (ImageBuilder, error) {
+	return b, nil
+}
+
+func (b *fakeBuilder) Close() error {
+	return nil
+}
+
+func (b *fakeBuilder) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts ImageBuildOptions) (BuildStatus, error) {
+	return b.status, nil
+}
+
+func (b *fakeBuilder) PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error {
+	b.pushed = append(b.pushed, tags...)
+	return nil
+}
+
+func TestHostedPipelineRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	job := &BuildJob{
+		ImageOwner: "owner",
+		ImageName:  "app",
+		ImageRepo:  SourceRepository{Provider: "github", Owner: "owner", Name: "app"},
+		Tag:        "1.0",
+		Dockerfile: "Dockerfile",
+	}
+
+	for _, status := range []BuildStatus{BuildSucceed, BuildFailed, BuildTimeout} {
+		builder := &fakeBuilder{status: status}
+		cloners := map[string]RepositoryCloner{"github": fakeCloner{}}
+		p := NewPipeline(PipelineConfig{CloneDir: dir}, &TestLogger{}, cloners, builder)
+
+		got, err := p.Run(context.Background(), ioutil.Discard, job)
+		if err != nil {
+			t.Fatalf("%s: %v", status, err)
+		}
+		if got != status {
+			t.Errorf("expected %s status, got %s", status, got)
+		}
+
+		expectPush := status == BuildSucceed
+		if pushed := len(builder.pushed) > 0; pushed != expectPush {
+			t.Errorf("%s: expected push %v, pushed %v", status, expectPush, builder.pushed)
+		}
+	}
+}
+
+type platformBuilder struct {
+	fakeBuilder
+}
+
+func (b *platformBuilder) Capabilities() BuilderCapabilities {
+	return BuilderCapabilities{Platforms: true}
+}
+
+func TestCapabilitiesOf(t *testing.T) {
+	p := NewPipeline(PipelineConfig{}, &TestLogger{}, nil, &fakeBuilder{})
+	if CapabilitiesOf(p).Platforms {
+		t.Error("expected builders without capabilities not to support platforms")
+	}
+
+	p = NewPipeline(PipelineConfig{}, &TestLogger{}, nil, &platformBuilder{})
+	if !CapabilitiesOf(p).Platforms {
+		t.Error("expected pipeline to report the capabilities of its builders")
+	}
+
+	s := NewBuildService(nil, nil, nil, "builds")
+	if err := s.Queue(BuildJob{Platforms: []string{"linux/arm64"}}); err != ErrBuildPlatformsUnsupported {
+		t.Errorf("expected multi platform job to be rejected, got %v", err)
+	}
+}
+
+func TestHostedPipelineRunSecretsUnsupported(t *testing.T) {
+	secrets, err := NewSecretService(&memSecretStorage{}, testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Set("owner", "github:owner:app", "TOKEN", "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+
+	builder := &fakeBuilder{status: BuildSucceed}
+	p := NewPipeline(PipelineConfig{}, &TestLogger{}, nil, builder)
+	p.UseSecrets(secrets)
+
+	var out bytes.Buffer
+	status, err := p.Run(context.Background(), &out, &BuildJob{ImageOwner: "owner", ImageKey: "github:owner:app"})
+	if err != nil || status != BuildFailed {
+		t.Fatalf("expected build to fail without an error, got %s: %v", status, err)
+	}
+	if !strings.Contains(out.String(), ErrBuildSecretsUnsupported.Error()) {
+		t.Errorf("expected unsupported secrets in the output, got %q", out.String())
+	}
+}
+
+// memVersionStorage keeps the published versions of a single image
+type memVersionStorage []string
+
+func (s *memVersionStorage) List(username string, imgKey string) ([]string, error) {
+	return *s, nil
+}
+
+func (s *memVersionStorage) Put(username string, imgKey string, version string) error {
+	*s = append(*s, version)
+	return nil
+}
+
+func (s *memVersionStorage) Delete(username string, imgKey string) error {
+	*s = nil
+	return nil
+}
+
+func TestHostedPipelineFloatingTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullr-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versions := &memVersionStorage{"1.3.0"}
+	job := BuildJob{
+		ImageOwner:    "owner",
+		ImageName:     "app",
+		ImageRepo:     SourceRepository{Provider: "github", Owner: "owner", Name: "app"},
+		Tag:           "1.4.2",
+		Version:       "1.4.2",
+		VersionLatest: true,
+	}
+
+	// Version published while the job was waiting in the queue
+	versions.Put("owner", "", "1.5.0")
+
+	builder := &fakeBuilder{status: BuildSucceed}
+	cloners := map[string]RepositoryCloner{"github": fakeCloner{}}
+	p := NewPipeline(PipelineConfig{CloneDir: dir}, &TestLogger{}, cloners, builder)
+	p.UseVersions(versions)
+
+	if _, err := p.Run(context.Background(), ioutil.Discard, &job); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[owner/app:1.4.2 owner/app:1.4]"
+	if pushed := fmt.Sprint(builder.pushed); pushed != expected {
+		t.Errorf("expected %s to be pushed, got %s", expected, pushed)
+	}
+	if tags := fmt.Sprint(job.AllTags()); tags != "[1.4.2 1.4]" {
+		t.Errorf("expected job to have the floating tags, got %s", tags)
+	}
+}
@@ -0,0 +1,91 @@
+package domain
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+const redactedText = "*****"
+
+// RedactingWriter masks the secret values in the written data. Data is
+// written line by line, so secrets split between multiple writes are masked
+// too. Flush should be called to write the last incomplete line.
+type RedactingWriter struct {
+	w       io.Writer
+	secrets [][]byte
+	buf     []byte
+}
+
+// NewRedactingWriter creates a writer which writes to w with the given
+// secret values masked. Each line of the multi line secrets like the PEM
+// keys is masked on its own, since the data is masked line by line.
+func NewRedactingWriter(w io.Writer, secrets []string) *RedactingWriter {
+	r := &RedactingWriter{w: w}
+	for _, secret := range secrets {
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				r.secrets = append(r.secrets, []byte(line))
+			}
+		}
+	}
+
+	// Longer secrets are masked first, so secrets containing the others
+	// aren't left partially visible
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+
+	return r
+}
+
+// Write writes the complete lines in p with secrets masked and buffers the
+// rest
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	if len(r.secrets) == 0 {
+		return r.w.Write(p)
+	}
+
+	r.buf = append(r.buf, p...)
+	end := bytes.LastIndexByte(r.buf, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	if _, err := r.w.Write(r.redact(r.buf[:end+1])); err != nil {
+		return 0, err
+	}
+
+	r.buf = append(r.buf[:0], r.buf[end+1:]...)
+	return len(p), nil
+}
+
+// Flush writes the buffered incomplete line
+func (r *RedactingWriter) Flush() error {
+	if len(r.buf) == 0 {
+		return nil
+	}
+
+	_, err := r.w.Write(r.redact(r.buf))
+	r.buf = r.buf[:0]
+	return err
+}
+
+func (r *RedactingWriter) redact(p []byte) []byte {
+	for _, secret := range r.secrets {
+		p = bytes.Replace(p, secret, []byte(redactedText), -1)
+	}
+
+	return p
+}
+
+// SecretValues reports back the values of the build secrets
+func SecretValues(secrets []BuildSecret) []string {
+	values := make([]string, len(secrets))
+	for i, secret := range secrets {
+		values[i] = secret.Value
+	}
+
+	return values
+}
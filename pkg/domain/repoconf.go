@@ -0,0 +1,149 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RepoConfigPath is the path of the build configuration file in the
+// repositories
+const RepoConfigPath = ".pullr.yml"
+
+// RepoConfig is the build configuration versioned in the repository. Top
+// level settings apply to all the images of the repository and the settings
+// under images apply to the image with the same name, like:
+//
+//	dockerfile_path: Dockerfile
+//	include_paths: [libs]
+//	images:
+//	  api:
+//	    dockerfile_path: services/api/Dockerfile
+//	    include_paths: [services/api]
+//	    tags:
+//	      - {ref_type: branch, ref_test: master, name: latest}
+type RepoConfig struct {
+	RepoImageConfig `yaml:",inline"`
+	Images          map[string]RepoImageConfig `yaml:"images"`
+}
+
+// RepoImageConfig is the image settings of a repository config. Only the
+// settings which are set override the stored image.
+type RepoImageConfig struct {
+	DockerfilePath string               `yaml:"dockerfile_path"`
+	BuildContext   string               `yaml:"build_context"`
+	Target         string               `yaml:"target"`
+	BuildArgs      map[string]string    `yaml:"build_args"`
+	IncludePaths   []string             `yaml:"include_paths"`
+	ExcludePaths   []string             `yaml:"exclude_paths"`
+	Tags           []RepoTagConfig      `yaml:"tags"`
+	Notifications  []NotificationTarget `yaml:"notifications"`
+}
+
+// RepoTagConfig is an image tag defined in a repository config. Schedules
+// can't be set from the repository, they are registered when the image is
+// saved.
+type RepoTagConfig struct {
+	RefType      SourceRefType     `yaml:"ref_type"`
+	RefTest      string            `yaml:"ref_test"`
+	Name         string            `yaml:"name"`
+	Aliases      []string          `yaml:"aliases"`
+	Semver       bool              `yaml:"semver"`
+	SemverLatest bool              `yaml:"semver_latest"`
+	BuildArgs    map[string]string `yaml:"build_args"`
+}
+
+// ParseRepoConfig parses a repository config. Unknown settings are reported
+// as errors, so typos don't silently change the builds.
+func ParseRepoConfig(data []byte) (RepoConfig, error) {
+	var conf RepoConfig
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return RepoConfig{}, fmt.Errorf("%s: %v", RepoConfigPath, err)
+	}
+
+	return conf, nil
+}
+
+// Apply reports back the image with the repository config applied. Build
+// args are merged by their names, other settings replace the image's
+// settings.
+func (c RepoConfig) Apply(img Image) Image {
+	img = c.RepoImageConfig.apply(img)
+	if conf, ok := c.Images[img.Name]; ok {
+		img = conf.apply(img)
+	}
+
+	return img
+}
+
+func (c RepoImageConfig) apply(img Image) Image {
+	if c.DockerfilePath != "" {
+		img.DockerfilePath = c.DockerfilePath
+	}
+	if c.BuildContext != "" {
+		img.BuildContext = c.BuildContext
+	}
+	if c.Target != "" {
+		img.Target = c.Target
+	}
+	if len(c.BuildArgs) > 0 {
+		img.BuildArgs = mergeBuildArgs(img.BuildArgs, c.BuildArgs)
+	}
+	if c.IncludePaths != nil {
+		img.IncludePaths = c.IncludePaths
+	}
+	if c.ExcludePaths != nil {
+		img.ExcludePaths = c.ExcludePaths
+	}
+	if c.Notifications != nil {
+		img.Notifications = make([]NotificationTarget, len(c.Notifications))
+		for i, target := range c.Notifications {
+			target.Restricted = true
+			img.Notifications[i] = target
+		}
+	}
+	if c.Tags != nil {
+		img.Tags = make([]ImageTag, len(c.Tags))
+		for i, tag := range c.Tags {
+			img.Tags[i] = ImageTag{
+				RefType:      tag.RefType,
+				RefTest:      tag.RefTest,
+				Name:         tag.Name,
+				Aliases:      tag.Aliases,
+				Semver:       tag.Semver,
+				SemverLatest: tag.SemverLatest,
+				BuildArgs:    mergeBuildArgs(nil, tag.BuildArgs),
+			}
+		}
+	}
+
+	return img
+}
+
+// mergeBuildArgs overrides the build args with the values from the map,
+// the new build args are appended sorted by their names
+func mergeBuildArgs(args []BuildArg, values map[string]string) []BuildArg {
+	merged := make([]BuildArg, 0, len(args)+len(values))
+	seen := make(map[string]bool, len(args))
+	for _, arg := range args {
+		if value, ok := values[arg.Name]; ok {
+			arg.Value = value
+		}
+		seen[arg.Name] = true
+		merged = append(merged, arg)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		merged = append(merged, BuildArg{name, values[name]})
+	}
+
+	return merged
+}
@@ -0,0 +1,213 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/cron"
+)
+
+const schedulerLease = "scheduler"
+
+// Schedule is a periodic build of an image's branch tag
+type Schedule struct {
+	Owner    string    `json:"owner" bson:"owner"`
+	ImageKey string    `json:"image_key" bson:"image_key"`
+	Branch   string    `json:"branch" bson:"branch"`
+	Cron     string    `json:"cron" bson:"cron"`
+	NextRun  time.Time `json:"next_run" bson:"next_run"`
+	LastRun  time.Time `json:"last_run,omitempty" bson:"last_run,omitempty"`
+}
+
+// ScheduleStorage stores and queries scheduled builds
+type ScheduleStorage interface {
+	// List retrieves schedules of the matching image
+	List(username string, imgKey string) ([]Schedule, error)
+
+	// Put replaces schedules of the matching image with the given schedules
+	Put(username string, imgKey string, schedules []Schedule) error
+
+	// Delete deletes schedules of the matching image
+	Delete(username string, imgKey string) error
+
+	// Due retrieves schedules of all users whose next run time is not after
+	// the given time
+	Due(now time.Time) ([]Schedule, error)
+
+	// Update updates the run times of the matching schedule
+	Update(schedule Schedule) error
+}
+
+// Scheduler queues build jobs for the scheduled image tags. Multiple
+// schedulers can run at the same time, they use a storage backed lease to
+// make sure only one of them queues the jobs.
+type Scheduler struct {
+	holder    string
+	interval  time.Duration
+	leases    LeaseStorage
+	schedules ScheduleStorage
+	images    ImageStorage
+	sourcesvc *SourceService
+	buildsvc  *BuildService
+	logger    Logger
+}
+
+// NewScheduler creates a scheduler which checks for due schedules in every
+// interval. holder should be unique for each running scheduler.
+func NewScheduler(holder string, interval time.Duration, storage StorageDriver, sourcesvc *SourceService, buildsvc *BuildService, logger Logger) *Scheduler {
+	return &Scheduler{
+		holder:    holder,
+		interval:  interval,
+		leases:    storage.LeaseStorage(),
+		schedules: storage.ScheduleStorage(),
+		images:    storage.ImageStorage(),
+		sourcesvc: sourcesvc,
+		buildsvc:  buildsvc,
+		logger:    logger,
+	}
+}
+
+// Run runs the due schedules in every interval til the context is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.leases.Release(schedulerLease, s.holder); err != nil {
+				s.logger.Errorf("scheduler: release lease: %v", err)
+			}
+			return
+		case now := <-ticker.C:
+			if err := s.RunDue(ctx, now); err != nil {
+				s.logger.Errorf("scheduler: %v", err)
+			}
+		}
+	}
+}
+
+// RunDue queues build jobs for the schedules due at the given time. It does
+// nothing if another scheduler holds the lease.
+func (s *Scheduler) RunDue(ctx context.Context, now time.Time) error {
+	ok, err := s.leases.Acquire(schedulerLease, s.holder, s.interval*2)
+	if err != nil || !ok {
+		return err
+	}
+
+	due, err := s.schedules.Due(now)
+	if err != nil {
+		return err
+	}
+
+	for _, sched := range due {
+		if sched.NextRun.IsZero() {
+			continue
+		}
+
+		// Next run time is persisted before queueing the job, so a failing
+		// queue doesn't cause firing the schedule over and over again
+		sched.LastRun = now
+		sched.NextRun = nextRun(sched.Cron, now)
+		if err := s.schedules.Update(sched); err != nil {
+			s.logger.Errorf("scheduler: update %s:%s: %v", sched.Owner, sched.ImageKey, err)
+			continue
+		}
+
+		if err := s.queue(ctx, sched); err != nil {
+			s.logger.Errorf("scheduler: queue %s:%s: %v", sched.Owner, sched.ImageKey, err)
+		}
+	}
+
+	return nil
+}
+
+// Sync updates the stored schedules of the image with the image's tags.
+// Run times of the unchanged schedules are kept as it is.
+func (s *Scheduler) Sync(img Image) error {
+	existing, err := s.schedules.List(img.Owner, img.Key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	now := time.Now()
+	schedules := make([]Schedule, 0, len(img.Tags))
+	for _, tag := range img.Tags {
+		if tag.Schedule == "" || tag.RefType != SourceBranch {
+			continue
+		}
+
+		sched := Schedule{
+			Owner:    img.Owner,
+			ImageKey: img.Key,
+			Branch:   tag.RefTest,
+			Cron:     tag.Schedule,
+			NextRun:  nextRun(tag.Schedule, now),
+		}
+		for _, old := range existing {
+			if old.Branch == sched.Branch && old.Cron == sched.Cron {
+				sched.NextRun = old.NextRun
+				sched.LastRun = old.LastRun
+				break
+			}
+		}
+
+		schedules = append(schedules, sched)
+	}
+
+	return s.schedules.Put(img.Owner, img.Key, schedules)
+}
+
+// Remove removes the schedules of the image
+func (s *Scheduler) Remove(username string, imgKey string) error {
+	return s.schedules.Delete(username, imgKey)
+}
+
+func (s *Scheduler) queue(ctx context.Context, sched Schedule) error {
+	img, err := s.images.Get(sched.Owner, sched.ImageKey)
+	if err != nil {
+		return err
+	}
+
+	var tag ImageTag
+	found := false
+	for _, t := range img.Tags {
+		if t.RefType == SourceBranch && t.RefTest == sched.Branch && t.Schedule == sched.Cron {
+			tag, found = t, true
+			break
+		}
+	}
+
+	// Image is updated after the schedule is fetched
+	if !found {
+		return nil
+	}
+
+	commit, err := s.sourcesvc.ResolveRef(ctx, sched.Owner, img.Repository, SourceBranch, sched.Branch)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.sourcesvc.Token(sched.Owner, img.Repository.Provider)
+	if err != nil {
+		return err
+	}
+
+	job, err := NewMatchedBuildJob(img, tag, commit, token, "")
+	if err != nil {
+		return err
+	}
+
+	return s.buildsvc.Queue(job)
+}
+
+// nextRun reports the next activation time of the cron expression after the
+// given time. It reports zero time for invalid expressions.
+func nextRun(expr string, after time.Time) time.Time {
+	sched, err := cron.Parse(expr)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return sched.Next(after)
+}
@@ -0,0 +1,29 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRun(t *testing.T) {
+	after := time.Date(2018, time.May, 15, 10, 30, 20, 0, time.UTC) // Tuesday
+
+	tests := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"*/15 * * * *", time.Date(2018, time.May, 15, 10, 45, 0, 0, time.UTC)},
+		{"@daily", time.Date(2018, time.May, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 4 * * mon", time.Date(2018, time.May, 21, 4, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+		{"", time.Time{}},
+		{"every day", time.Time{}},
+		{"61 * * * *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		if next := nextRun(test.expr, after); !next.Equal(test.expected) {
+			t.Errorf("%q: expected next run %v, got %v", test.expr, test.expected, next)
+		}
+	}
+}
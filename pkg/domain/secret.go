@@ -0,0 +1,153 @@
+package domain
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"time"
+)
+
+var validSecretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ImageSecret is a secret exposed to the builds of an image. Value is
+// encrypted and it is never reported back by the api.
+type ImageSecret struct {
+	Owner     string    `json:"-" bson:"owner"`
+	ImageKey  string    `json:"image_key" bson:"image_key"`
+	Name      string    `json:"name" bson:"name"`
+	Value     []byte    `json:"-" bson:"value"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// BuildSecret is a decrypted image secret passed to the image builders
+type BuildSecret struct {
+	Name  string
+	Value string
+}
+
+// SecretStorage stores and queries encrypted image secrets
+type SecretStorage interface {
+	// List retrieves the secrets of the matching image
+	List(username string, imgKey string) ([]ImageSecret, error)
+
+	// Put inserts or replaces the secret with the same name
+	Put(secret ImageSecret) error
+
+	// Delete deletes the matching secret of the image
+	Delete(username string, imgKey string, name string) error
+
+	// DeleteAll deletes all the secrets of the matching image
+	DeleteAll(username string, imgKey string) error
+}
+
+// SecretService encrypts and decrypts the image secrets with AES-GCM
+type SecretService struct {
+	storage SecretStorage
+	aead    cipher.AEAD
+}
+
+// NewSecretService creates a secret service with a base64 encoded 32 bytes
+// encryption key
+func NewSecretService(storage SecretStorage, key string) (*SecretService, error) {
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(rawKey) != 32 {
+		return nil, ErrSecretBadKey
+	}
+
+	block, err := aes.NewCipher(rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretService{storage, aead}, nil
+}
+
+// Set encrypts and stores the secret of the image
+func (s *SecretService) Set(username, imgKey, name, value string) error {
+	if !validSecretName.MatchString(name) {
+		return ErrSecretBadName
+	}
+	if value == "" {
+		return ErrSecretEmpty
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// Secret's identity is authenticated along with its value, so an
+	// encrypted value can't be moved to another secret
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), secretAD(username, imgKey, name))
+	return s.storage.Put(ImageSecret{
+		Owner:     username,
+		ImageKey:  imgKey,
+		Name:      name,
+		Value:     sealed,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// List reports back the secrets of the image without their values
+func (s *SecretService) List(username, imgKey string) ([]ImageSecret, error) {
+	secrets, err := s.storage.List(username, imgKey)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	list := make([]ImageSecret, len(secrets))
+	for i, secret := range secrets {
+		secret.Value = nil
+		list[i] = secret
+	}
+
+	return list, nil
+}
+
+// Delete deletes the secret of the image
+func (s *SecretService) Delete(username, imgKey, name string) error {
+	return s.storage.Delete(username, imgKey, name)
+}
+
+// DeleteAll deletes all the secrets of the image
+func (s *SecretService) DeleteAll(username, imgKey string) error {
+	return s.storage.DeleteAll(username, imgKey)
+}
+
+// BuildSecrets reports back the decrypted secrets of the image
+func (s *SecretService) BuildSecrets(username, imgKey string) ([]BuildSecret, error) {
+	secrets, err := s.storage.List(username, imgKey)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	buildSecrets := make([]BuildSecret, len(secrets))
+	for i, secret := range secrets {
+		nonceSize := s.aead.NonceSize()
+		if len(secret.Value) < nonceSize {
+			return nil, ErrSecretCorrupted
+		}
+
+		nonce, sealed := secret.Value[:nonceSize], secret.Value[nonceSize:]
+		value, err := s.aead.Open(nil, nonce, sealed, secretAD(username, imgKey, secret.Name))
+		if err != nil {
+			return nil, ErrSecretCorrupted
+		}
+
+		buildSecrets[i] = BuildSecret{secret.Name, string(value)}
+	}
+
+	return buildSecrets, nil
+}
+
+func secretAD(username, imgKey, name string) []byte {
+	return []byte(username + "\x00" + imgKey + "\x00" + name)
+}
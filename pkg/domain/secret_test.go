@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testSecretKey is a base64 encoded 32 bytes encryption key
+const testSecretKey = "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="
+
+// memSecretStorage keeps the secrets in memory
+type memSecretStorage struct {
+	secrets []ImageSecret
+}
+
+func (s *memSecretStorage) List(username string, imgKey string) ([]ImageSecret, error) {
+	var list []ImageSecret
+	for _, secret := range s.secrets {
+		if secret.Owner == username && secret.ImageKey == imgKey {
+			list = append(list, secret)
+		}
+	}
+	return list, nil
+}
+
+func (s *memSecretStorage) Put(secret ImageSecret) error {
+	s.Delete(secret.Owner, secret.ImageKey, secret.Name)
+	s.secrets = append(s.secrets, secret)
+	return nil
+}
+
+func (s *memSecretStorage) Delete(username string, imgKey string, name string) error {
+	for i, secret := range s.secrets {
+		if secret.Owner == username && secret.ImageKey == imgKey && secret.Name == name {
+			s.secrets = append(s.secrets[:i], s.secrets[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memSecretStorage) DeleteAll(username string, imgKey string) error {
+	s.secrets = nil
+	return nil
+}
+
+func TestSecretService(t *testing.T) {
+	storage := &memSecretStorage{}
+	secrets, err := NewSecretService(storage, testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSecretService(storage, "c2hvcnQ="); err != ErrSecretBadKey {
+		t.Errorf("expected short key to be rejected, got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"NPM_TOKEN", "s3cr3t", nil},
+		{"SSH_KEY", "-----BEGIN KEY-----\nabc\n-----END KEY-----", nil},
+		{"1TOKEN", "value", ErrSecretBadName},
+		{"TOKEN-2", "value", ErrSecretBadName},
+		{"EMPTY", "", ErrSecretEmpty},
+	}
+	for _, test := range tests {
+		if err := secrets.Set("owner", "github:owner:app", test.name, test.value); err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	for _, secret := range storage.secrets {
+		if bytes.Contains(secret.Value, []byte("s3cr3t")) {
+			t.Errorf("%s: secret is stored in plain text", secret.Name)
+		}
+	}
+
+	buildSecrets, err := secrets.BuildSecrets("owner", "github:owner:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buildSecrets) != 2 || buildSecrets[0].Value != "s3cr3t" || buildSecrets[1].Value != tests[1].value {
+		t.Errorf("expected secrets to be decrypted, got %+v", buildSecrets)
+	}
+
+	list, _ := secrets.List("owner", "github:owner:app")
+	for _, secret := range list {
+		if secret.Value != nil {
+			t.Errorf("%s: secret value is listed", secret.Name)
+		}
+	}
+
+	// Encrypted values are bound to their secret's identity
+	storage.secrets[0].Name = "MOVED"
+	if _, err := secrets.BuildSecrets("owner", "github:owner:app"); err != ErrSecretCorrupted {
+		t.Errorf("expected moved secret to be rejected, got %v", err)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	tests := []struct {
+		writes   []string
+		expected string
+	}{
+		{[]string{"token is s3cr3t\n"}, "token is *****\n"},
+		{[]string{"token is s3", "cr3t\nnext line"}, "token is *****\nnext line"},
+		{[]string{"p4ss and s3cr3t\n", "s3cr3t"}, "***** and *****\n*****"},
+		{[]string{"nothing to hide\n"}, "nothing to hide\n"},
+		{[]string{"-----BEGIN KEY-----\nMIIEpA", "IBAAKCAQ\n-----END KEY-----\n"}, "*****\n*****\n*****\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		w := NewRedactingWriter(&out, []string{"s3cr3t", "p4ss", "", "-----BEGIN KEY-----\r\nMIIEpAIBAAKCAQ\n-----END KEY-----\n"})
+		for _, p := range test.writes {
+			if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+				t.Fatalf("write %q: %d, %v", p, n, err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.String() != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.writes, test.expected, out.String())
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -16,6 +17,20 @@ const (
 	SourceTag    SourceRefType = "tag"
 )
 
+// ParseGitRef parses a fully qualified git ref like "refs/heads/feature/login"
+// or "refs/tags/v1.0.0" into its type and name. It reports false for the refs
+// which are neither branches nor tags.
+func ParseGitRef(ref string) (SourceRefType, string, bool) {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/") && len(ref) > len("refs/heads/"):
+		return SourceBranch, strings.TrimPrefix(ref, "refs/heads/"), true
+	case strings.HasPrefix(ref, "refs/tags/") && len(ref) > len("refs/tags/"):
+		return SourceTag, strings.TrimPrefix(ref, "refs/tags/"), true
+	}
+
+	return "", "", false
+}
+
 // SourceClient wraps source control provider client operations
 type SourceClient interface {
 	// ParseWebhookPayload extracts CommitInfo from source provider's webhook request
@@ -34,6 +49,19 @@ type SourceClient interface {
 	// To get repositories owned by the user pass authenticated source provider
 	// user name as the organisation.
 	Repositories(ctx context.Context, identity string, organisation string, token string) ([]SourceRepository, error)
+
+	// ResolveRef reports back the commit info of the given branch, tag or
+	// commit hash. refType should be empty when ref is a commit hash.
+	ResolveRef(ctx context.Context, token string, repo SourceRepository, refType SourceRefType, ref string) (*CommitInfo, error)
+
+	// CompareFiles reports back the paths of the files changed between the
+	// base and head commits. ErrSourceChangesUnknown is returned if the
+	// provider can't report all of them.
+	CompareFiles(ctx context.Context, token string, repo SourceRepository, base string, head string) ([]string, error)
+
+	// FileContent reports back the content of the file at the given path in
+	// the given commit. ErrNotFound is returned if the file doesn't exist.
+	FileContent(ctx context.Context, token string, repo SourceRepository, ref string, path string) ([]byte, error)
 }
 
 // CommitInfo has information about a commit
@@ -50,6 +78,15 @@ type CommitInfo struct {
 	CreatedAt time.Time
 	// SourceRepository is the source code repository
 	Repository SourceRepository
+	// Before is the commit hash the ref pointed to before the push, it is
+	// empty for new refs and the commits which are not pushed
+	Before string
+	// ChangedFiles are the paths of the files added, modified or removed by
+	// the push
+	ChangedFiles []string
+	// ChangesTruncated is true if the push payload didn't list all the
+	// changed files
+	ChangesTruncated bool
 }
 
 // SourceRepository has the information for source code repository.
@@ -150,3 +187,74 @@ func (s *SourceService) Repositories(ctx context.Context, provider, username, or
 
 	return c.Repositories(ctx, token.Identity, organisation, token.Token)
 }
+
+// ResolveRef finds the commit pointed by the given branch, tag or commit hash
+// in the repository. refType should be empty when ref is a commit hash.
+func (s *SourceService) ResolveRef(ctx context.Context, username string, repo SourceRepository, refType SourceRefType, ref string) (*CommitInfo, error) {
+	c, ok := s.clients[repo.Provider]
+	if !ok {
+		return nil, ErrSourceUnsupportedProvider
+	}
+
+	token, err := s.Token(username, repo.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ResolveRef(ctx, token.Token, repo, refType, ref)
+}
+
+// ChangedFiles reports back the paths of the files changed by the pushed
+// commit. Provider's compare api is used if the push payload was truncated.
+// ErrSourceChangesUnknown is returned if the changes can't be determined.
+func (s *SourceService) ChangedFiles(ctx context.Context, username string, commit *CommitInfo) ([]string, error) {
+	if !commit.ChangesTruncated {
+		return commit.ChangedFiles, nil
+	}
+	if commit.Before == "" {
+		return nil, ErrSourceChangesUnknown
+	}
+
+	c, ok := s.clients[commit.Repository.Provider]
+	if !ok {
+		return nil, ErrSourceUnsupportedProvider
+	}
+
+	token, err := s.Token(username, commit.Repository.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.CompareFiles(ctx, token.Token, commit.Repository, commit.Before, commit.Hash)
+}
+
+// FileContent reports back the content of the file at the path in the given
+// commit of the repository. ErrNotFound is returned if the file doesn't exist.
+func (s *SourceService) FileContent(ctx context.Context, username string, repo SourceRepository, ref string, path string) ([]byte, error) {
+	c, ok := s.clients[repo.Provider]
+	if !ok {
+		return nil, ErrSourceUnsupportedProvider
+	}
+
+	token, err := s.Token(username, repo.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.FileContent(ctx, token.Token, repo, ref, path)
+}
+
+// Token reports back the user's oauth token for the given source provider
+func (s *SourceService) Token(username, provider string) (OAuthToken, error) {
+	tokens, err := s.storage.GetTokens(username)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	token, ok := tokens[provider]
+	if !ok {
+		return OAuthToken{}, ErrAuthUnauthorized
+	}
+
+	return token, nil
+}
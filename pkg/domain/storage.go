@@ -24,6 +24,11 @@ type StorageDriver interface {
 	UserStorage() UserStorage
 	ImageStorage() ImageStorage
 	BuildStorage() BuildStorage
+	ScheduleStorage() ScheduleStorage
+	LeaseStorage() LeaseStorage
+	BaseImageStorage() BaseImageStorage
+	VersionStorage() VersionStorage
+	SecretStorage() SecretStorage
 }
 
 // ListDir defines ordering/sorting direction
@@ -0,0 +1,149 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/gova"
+)
+
+// TagContext is the data tag name templates are rendered with. A tag name
+// like `{{.Branch | slug}}-{{.ShortSHA}}` or `v{{index .Groups 1}}` is
+// rendered against the commit which triggered the build.
+type TagContext struct {
+	// Ref is the branch or the git tag name
+	Ref string
+	// Branch is the branch name, empty for git tags
+	Branch string
+	// GitTag is the git tag name, empty for branches
+	GitTag string
+	// SHA is the full commit hash
+	SHA string
+	// ShortSHA is the first 7 characters of the commit hash
+	ShortSHA string
+	// Groups are the capture groups of the ref test regexp, the first item is
+	// the whole match
+	Groups []string
+
+	time time.Time
+}
+
+// Date formats the commit time with the given go time layout
+func (c TagContext) Date(layout string) string {
+	return c.time.UTC().Format(layout)
+}
+
+var tagFuncs = template.FuncMap{
+	"slug":  slug,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trunc": func(n int, s string) string {
+		if len(s) > n {
+			return s[:n]
+		}
+		return s
+	},
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+}
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// slug converts s to a string safe to use in docker tags
+func slug(s string) string {
+	s = slugInvalidChars.ReplaceAllString(strings.ToLower(s), "-")
+	return strings.Trim(s, "-.")
+}
+
+// maxTagLength is the maximum length of a docker tag
+const maxTagLength = 128
+
+var (
+	tagInvalidChars    = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	tagInvalidLeadings = regexp.MustCompile(`^[.-]+`)
+)
+
+// IsValidTagName reports whether name is a valid docker tag
+func IsValidTagName(name string) bool {
+	return gova.IsDockerTag(name)
+}
+
+// SanitizeTagName converts name to a valid docker tag. Invalid characters are
+// replaced with "-" and leading periods and dashes are removed. Names longer
+// than 128 characters are truncated and suffixed with a short hash of the
+// whole name, so different long names don't end up with the same tag. Valid
+// names are reported back as they are.
+func SanitizeTagName(name string) string {
+	if IsValidTagName(name) {
+		return name
+	}
+
+	tag := tagInvalidChars.ReplaceAllString(name, "-")
+	tag = tagInvalidLeadings.ReplaceAllString(tag, "")
+	if tag == "" {
+		tag = "_"
+	}
+
+	if len(tag) > maxTagLength {
+		sum := sha1.Sum([]byte(name))
+		suffix := hex.EncodeToString(sum[:])[:8]
+		tag = tag[:maxTagLength-len(suffix)-1] + "-" + suffix
+	}
+
+	return tag
+}
+
+// isTagTemplate reports whether the tag name needs to be rendered
+func isTagTemplate(name string) bool {
+	return strings.Contains(name, "{{")
+}
+
+func parseTagTemplate(name string) (*template.Template, error) {
+	return template.New("tag").Funcs(tagFuncs).Option("missingkey=error").Parse(name)
+}
+
+func newTagContext(commit *CommitInfo, groups []string) TagContext {
+	ctx := TagContext{
+		Ref:    commit.Ref,
+		SHA:    commit.Hash,
+		Groups: groups,
+		time:   commit.CreatedAt,
+	}
+
+	if commit.RefType == SourceBranch {
+		ctx.Branch = commit.Ref
+	} else {
+		ctx.GitTag = commit.Ref
+	}
+
+	ctx.ShortSHA = commit.Hash
+	if len(ctx.ShortSHA) > 7 {
+		ctx.ShortSHA = ctx.ShortSHA[:7]
+	}
+
+	if ctx.time.IsZero() {
+		ctx.time = time.Now()
+	}
+
+	return ctx
+}
+
+func renderTagTemplate(name string, ctx TagContext) (string, error) {
+	tmpl, err := parseTagTemplate(name)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, ctx); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageTagTemplates(t *testing.T) {
+	branch := &CommitInfo{Ref: "feature/Login", RefType: SourceBranch, Hash: "0123456789abcdef", CreatedAt: time.Date(2018, 5, 1, 10, 0, 0, 0, time.UTC)}
+	release := &CommitInfo{Ref: "release-1.4.2", RefType: SourceTag, Hash: "0123456789abcdef"}
+
+	tests := []struct {
+		tag      ImageTag
+		commit   *CommitInfo
+		expected string
+		err      error
+	}{
+		{ImageTag{RefType: SourceBranch, RefTest: "feature/*", Name: "dev"}, branch, "[dev]", nil},
+		{ImageTag{RefType: SourceBranch, RefTest: "feature/*"}, branch, "[feature-Login]", nil},
+		{ImageTag{RefType: SourceBranch, RefTest: "feature/*", Name: "{{.Branch | slug}}-{{.ShortSHA}}"}, branch, "[feature-login-0123456]", nil},
+		{ImageTag{RefType: SourceBranch, RefTest: "feature/*", Name: `{{.Date "20060102"}}`, Aliases: []string{"latest", "{{.SHA | trunc 4}}", "latest"}}, branch, "[20180501 latest 0123]", nil},
+		{ImageTag{RefType: SourceTag, RefTest: `/^release-(\d+)\.(\d+)\.\d+$/`, Name: "v{{index .Groups 1}}.{{index .Groups 2}}", Aliases: []string{"{{.GitTag}}"}}, release, "[v1.4 release-1.4.2]", nil},
+		{ImageTag{RefType: SourceTag, RefTest: `/^release-(\d+)/`, Name: "{{index .Groups 5}}"}, release, "", ErrImageBadTagTemplate},
+		{ImageTag{RefType: SourceTag, RefTest: `/^release-/`, Name: "{{.Missing}}"}, release, "", ErrImageBadTagTemplate},
+		{ImageTag{RefType: SourceBranch, RefTest: "feature/*", Name: "{{.GitTag}}"}, branch, "", ErrImageBadTagTemplate},
+	}
+
+	for _, test := range tests {
+		tags, err := test.tag.Tags(test.commit)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.tag.Name, test.err, err)
+			continue
+		}
+		if err == nil && fmt.Sprint(tags) != test.expected {
+			t.Errorf("%s: expected %s, got %v", test.tag.Name, test.expected, tags)
+		}
+	}
+}
+
+func TestSanitizeTagName(t *testing.T) {
+	tests := map[string]string{
+		"1.4.2":           "1.4.2",
+		"feature/login":   "feature-login",
+		"-.hotfix":        "hotfix",
+		"release/v1 beta": "release-v1-beta",
+		"///":             "_",
+	}
+
+	for name, expected := range tests {
+		tag := SanitizeTagName(name)
+		if tag != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, tag)
+		}
+		if !IsValidTagName(tag) {
+			t.Errorf("%q: %q is not a valid tag", name, tag)
+		}
+	}
+
+	long := strings.Repeat("feature/x", 20)
+	tag := SanitizeTagName(long)
+	if len(tag) != maxTagLength || !IsValidTagName(tag) || tag == SanitizeTagName(long+"y") {
+		t.Errorf("expected long name to be truncated with a hash suffix, got %s", tag)
+	}
+}
+
+func TestParseGitRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		refType SourceRefType
+		name    string
+		ok      bool
+	}{
+		{"refs/heads/master", SourceBranch, "master", true},
+		{"refs/heads/feature/auth/login", SourceBranch, "feature/auth/login", true},
+		{"refs/tags/v1.0.0", SourceTag, "v1.0.0", true},
+		{"refs/tags/", "", "", false},
+		{"refs/pull/1/head", "", "", false},
+		{"master", "", "", false},
+	}
+
+	for _, test := range tests {
+		refType, name, ok := ParseGitRef(test.ref)
+		if refType != test.refType || name != test.name || ok != test.ok {
+			t.Errorf("%s: expected %s %q %v, got %s %q %v", test.ref, test.refType, test.name, test.ok, refType, name, ok)
+		}
+	}
+}
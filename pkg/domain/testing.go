@@ -13,3 +13,9 @@ func (*TestLogger) Error(args ...interface{}) {
 
 func (*TestLogger) Errorf(format string, args ...interface{}) {
 }
+
+func (*TestLogger) Warning(args ...interface{}) {
+}
+
+func (*TestLogger) Warningf(format string, args ...interface{}) {
+}
@@ -0,0 +1,101 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/semver"
+)
+
+// PublishedVersion is a semantic version of an image published by a
+// successful build
+type PublishedVersion struct {
+	Owner       string    `json:"owner" bson:"owner"`
+	ImageKey    string    `json:"image_key" bson:"image_key"`
+	Version     string    `json:"version" bson:"version"`
+	PublishedAt time.Time `json:"published_at" bson:"published_at"`
+}
+
+// VersionStorage stores the semantic versions published for the images
+type VersionStorage interface {
+	// List retrieves the published versions of the matching image
+	List(username string, imgKey string) ([]string, error)
+
+	// Put records a published version of the matching image
+	Put(username string, imgKey string, version string) error
+
+	// Delete deletes all the published versions of the matching image
+	Delete(username string, imgKey string) error
+}
+
+// FloatingTags reports back the floating tags like "1" and "1.4" which
+// should be moved to the given version. A floating tag is moved only if the
+// version is the highest published version in its line. Pre-release
+// versions never move the floating tags. If latest is true, "latest" tag is
+// moved when the version is the highest of all.
+func FloatingTags(version string, published []string, latest bool) []string {
+	v, err := semver.Parse(version)
+	if err != nil || v.IsPreRelease() {
+		return nil
+	}
+
+	moveMajor, moveMinor, moveLatest := true, true, latest
+	for _, p := range published {
+		other, err := semver.Parse(p)
+		if err != nil || other.IsPreRelease() || other.Compare(v) <= 0 {
+			continue
+		}
+
+		moveLatest = false
+		if other.Major == v.Major {
+			moveMajor = false
+			if other.Minor == v.Minor {
+				moveMinor = false
+			}
+		}
+	}
+
+	var tags []string
+	if moveMajor {
+		tags = append(tags, fmt.Sprintf("%d", v.Major))
+	}
+	if moveMinor {
+		tags = append(tags, fmt.Sprintf("%d.%d", v.Major, v.Minor))
+	}
+	if moveLatest {
+		tags = append(tags, "latest")
+	}
+
+	return tags
+}
+
+// AddFloatingTags adds the floating version tags of the job's semantic
+// version to the job's tags. Tags are decided against the versions published
+// at the time of the call, so pipelines call it right before building and
+// pushing the image instead of while queueing the job.
+func AddFloatingTags(versions VersionStorage, job *BuildJob) error {
+	if job.Version == "" {
+		return nil
+	}
+
+	published, err := versions.List(job.ImageOwner, job.ImageKey)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	tags := job.AllTags()
+	for _, tag := range FloatingTags(job.Version, published, job.VersionLatest) {
+		if !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	job.Tags = tags
+
+	return nil
+}
+
+// floatingTagCandidates reports back all the floating tags the version can
+// move regardless of the published versions
+func floatingTagCandidates(version string, latest bool) []string {
+	return FloatingTags(version, nil, latest)
+}
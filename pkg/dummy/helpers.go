@@ -13,6 +13,7 @@ func sortUsers(users map[string]domain.User) []domain.User {
 		index := sort.Search(len(sorted), func(i int) bool {
 			return strings.Compare(sorted[i].Username, name) > 0
 		})
+		sorted = append(sorted, domain.User{})
 		copy(sorted[index+1:], sorted[index:])
 		sorted[index] = usr
 	}
@@ -27,12 +28,9 @@ func sortImages(images map[string]domain.Image) []domain.Image {
 			return strings.Compare(sorted[i].Name, name) >= 0
 		})
 
-		if index < len(sorted) {
-			copy(sorted[index+1:], sorted[index:])
-			sorted[index] = img
-		} else {
-			sorted = append(sorted, img)
-		}
+		sorted = append(sorted, domain.Image{})
+		copy(sorted[index+1:], sorted[index:])
+		sorted[index] = img
 	}
 
 	return sorted
@@ -45,12 +43,9 @@ func sortBuilds(records []domain.BuildRecord) []domain.BuildRecord {
 			return sorted[i].StartedAt.After(record.StartedAt)
 		})
 
-		if index < len(sorted) {
-			copy(sorted[index+1:], sorted[index:])
-			sorted[index] = record
-		} else {
-			sorted = append(sorted, record)
-		}
+		sorted = append(sorted, domain.BuildRecord{})
+		copy(sorted[index+1:], sorted[index:])
+		sorted[index] = record
 	}
 
 	return sorted
@@ -63,12 +58,9 @@ func sortImageBuilds(images map[string]domain.Build) []domain.Build {
 			return sorted[i].LastRecord.After(imgBuild.LastRecord)
 		})
 
-		if index < len(sorted) {
-			copy(sorted[index+1:], sorted[index:])
-			sorted[index] = imgBuild
-		} else {
-			sorted = append(sorted, imgBuild)
-		}
+		sorted = append(sorted, domain.Build{})
+		copy(sorted[index+1:], sorted[index:])
+		sorted[index] = imgBuild
 	}
 
 	return sorted
@@ -6,6 +6,11 @@ import (
 	"github.com/mobingilabs/pullr/pkg/domain"
 )
 
+type lease struct {
+	holder    string
+	expiresAt time.Time
+}
+
 type credential struct {
 	username string
 	password string
@@ -28,6 +33,12 @@ type storage struct {
 	images map[tUsername]map[tId]domain.Image
 	builds map[tUsername]map[tImageId]domain.Build
 
+	schedules map[tUsername]map[tImageId][]domain.Schedule
+	leases    map[string]lease
+	bases     map[tUsername]map[tImageId][]domain.BaseImage
+	versions  map[tUsername]map[tImageId][]string
+	secrets   map[tUsername]map[tImageId][]domain.ImageSecret
+
 	authtokens      map[tId]string
 	authcredentials map[tUsername]credential
 	oauthsecrets    map[string]oauthsecret
@@ -39,6 +50,11 @@ func NewStorageDriver(opts map[string]interface{}) domain.StorageDriver {
 		users:           make(map[string]domain.User),
 		images:          make(map[string]map[string]domain.Image),
 		builds:          make(map[string]map[string]domain.Build),
+		schedules:       make(map[string]map[string][]domain.Schedule),
+		leases:          make(map[string]lease),
+		bases:           make(map[string]map[string][]domain.BaseImage),
+		versions:        make(map[string]map[string][]string),
+		secrets:         make(map[string]map[string][]domain.ImageSecret),
 		authtokens:      make(map[string]string),
 		authcredentials: make(map[string]credential),
 		oauthsecrets:    make(map[string]oauthsecret),
@@ -76,6 +92,31 @@ func (s *storage) BuildStorage() domain.BuildStorage {
 	return &buildStorage{s}
 }
 
+// ScheduleStorage creates a ScheduleStorage instance
+func (s *storage) ScheduleStorage() domain.ScheduleStorage {
+	return &scheduleStorage{s}
+}
+
+// LeaseStorage creates a LeaseStorage instance
+func (s *storage) LeaseStorage() domain.LeaseStorage {
+	return &leaseStorage{s}
+}
+
+// BaseImageStorage creates a BaseImageStorage instance
+func (s *storage) BaseImageStorage() domain.BaseImageStorage {
+	return &baseImageStorage{s}
+}
+
+// VersionStorage creates a VersionStorage instance
+func (s *storage) VersionStorage() domain.VersionStorage {
+	return &versionStorage{s}
+}
+
+// SecretStorage creates a SecretStorage instance
+func (s *storage) SecretStorage() domain.SecretStorage {
+	return &secretStorage{s}
+}
+
 // AuthStorage ================================================================
 type authStorage struct {
 	d *storage
@@ -283,6 +324,21 @@ func (s *imageStorage) List(username string, opts domain.ListOptions) ([]domain.
 	return sortedImages[skip:limit], pagination, nil
 }
 
+func (s *imageStorage) All(username string) ([]domain.Image, error) {
+	return sortImages(s.d.images[username]), nil
+}
+
+func (s *imageStorage) FindByRepository(username string, repo domain.SourceRepository) ([]domain.Image, error) {
+	var images []domain.Image
+	for _, img := range sortImages(s.d.images[username]) {
+		if img.Repository.Provider == repo.Provider && img.Repository.Owner == repo.Owner && img.Repository.Name == repo.Name {
+			images = append(images, img)
+		}
+	}
+
+	return images, nil
+}
+
 func (s *imageStorage) Put(image domain.Image) error {
 	usrImages, ok := s.d.images[image.Owner]
 	if !ok {
@@ -290,7 +346,7 @@ func (s *imageStorage) Put(image domain.Image) error {
 		usrImages = s.d.images[image.Owner]
 	}
 
-	usrImages[domain.ImageKey(image.Repository)] = image
+	usrImages[image.Key] = image
 	return nil
 }
 
@@ -358,6 +414,21 @@ func (s *buildStorage) GetLast(username string, imgKey string) (domain.BuildReco
 	return imgBuild.Records[0], nil
 }
 
+func (s *buildStorage) Get(username string, imgKey string, id string) (domain.BuildRecord, error) {
+	imgBuild, ok := s.d.builds[username][imgKey]
+	if !ok {
+		return domain.BuildRecord{}, domain.ErrNotFound
+	}
+
+	for _, record := range imgBuild.Records {
+		if record.ID == id {
+			return record, nil
+		}
+	}
+
+	return domain.BuildRecord{}, domain.ErrNotFound
+}
+
 func (s *buildStorage) GetLastBy(username string, imgKeys []string) (map[string]domain.BuildRecord, error) {
 	builds := make(map[string]domain.BuildRecord, len(imgKeys))
 	for _, imgKey := range imgKeys {
@@ -385,17 +456,20 @@ func (s *buildStorage) List(username string, opts domain.ListOptions) ([]domain.
 	return sortedBuilds[skip:limit], pagination, nil
 }
 
-func (s *buildStorage) UpdateLast(username string, imgKey string, update domain.BuildRecord) error {
+func (s *buildStorage) Update(username string, imgKey string, id string, record domain.BuildRecord) error {
 	build, ok := s.d.builds[username][imgKey]
-	if !ok || len(build.Records) == 0 {
+	if !ok {
 		return domain.ErrNotFound
 	}
 
-	build.Records[0].Status = update.Status
-	build.Records[0].Logs = update.Logs
-	build.Records[0].FinishedAt = update.FinishedAt
-	s.d.builds[username][imgKey] = build
-	return nil
+	for i := range build.Records {
+		if build.Records[i].ID == id {
+			build.Records[i] = record
+			return nil
+		}
+	}
+
+	return domain.ErrNotFound
 }
 
 func (s *buildStorage) Put(username string, imgKey string, record domain.BuildRecord) error {
@@ -418,3 +492,231 @@ func (s *buildStorage) Put(username string, imgKey string, record domain.BuildRe
 	usrImgs[imgKey] = build
 	return nil
 }
+
+// ScheduleStorage ================================================================
+
+type scheduleStorage struct {
+	d *storage
+}
+
+func (s *scheduleStorage) List(username string, imgKey string) ([]domain.Schedule, error) {
+	return s.d.schedules[username][imgKey], nil
+}
+
+func (s *scheduleStorage) Put(username string, imgKey string, schedules []domain.Schedule) error {
+	usrSchedules, ok := s.d.schedules[username]
+	if !ok {
+		s.d.schedules[username] = make(map[string][]domain.Schedule)
+		usrSchedules = s.d.schedules[username]
+	}
+
+	usrSchedules[imgKey] = schedules
+	return nil
+}
+
+func (s *scheduleStorage) Delete(username string, imgKey string) error {
+	delete(s.d.schedules[username], imgKey)
+	return nil
+}
+
+func (s *scheduleStorage) Due(now time.Time) ([]domain.Schedule, error) {
+	var due []domain.Schedule
+	for _, usrSchedules := range s.d.schedules {
+		for _, schedules := range usrSchedules {
+			for _, sched := range schedules {
+				if !sched.NextRun.After(now) {
+					due = append(due, sched)
+				}
+			}
+		}
+	}
+
+	return due, nil
+}
+
+func (s *scheduleStorage) Update(schedule domain.Schedule) error {
+	schedules := s.d.schedules[schedule.Owner][schedule.ImageKey]
+	for i := range schedules {
+		if schedules[i].Branch == schedule.Branch {
+			schedules[i].NextRun = schedule.NextRun
+			schedules[i].LastRun = schedule.LastRun
+			return nil
+		}
+	}
+
+	return domain.ErrNotFound
+}
+
+// LeaseStorage ================================================================
+
+type leaseStorage struct {
+	d *storage
+}
+
+func (s *leaseStorage) Acquire(name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	l, ok := s.d.leases[name]
+	if ok && l.holder != holder && l.expiresAt.After(now) {
+		return false, nil
+	}
+
+	s.d.leases[name] = lease{holder, now.Add(ttl)}
+	return true, nil
+}
+
+func (s *leaseStorage) Release(name string, holder string) error {
+	if l, ok := s.d.leases[name]; ok && l.holder == holder {
+		delete(s.d.leases, name)
+	}
+
+	return nil
+}
+
+// BaseImageStorage ================================================================
+
+type baseImageStorage struct {
+	d *storage
+}
+
+func (s *baseImageStorage) List(username string, imgKey string) ([]domain.BaseImage, error) {
+	return s.d.bases[username][imgKey], nil
+}
+
+func (s *baseImageStorage) Put(username string, imgKey string, bases []domain.BaseImage) error {
+	usrBases, ok := s.d.bases[username]
+	if !ok {
+		s.d.bases[username] = make(map[string][]domain.BaseImage)
+		usrBases = s.d.bases[username]
+	}
+
+	usrBases[imgKey] = bases
+	return nil
+}
+
+func (s *baseImageStorage) Delete(username string, imgKey string) error {
+	delete(s.d.bases[username], imgKey)
+	return nil
+}
+
+func (s *baseImageStorage) Refs() ([]string, error) {
+	seen := make(map[string]bool)
+	var refs []string
+	for _, usrBases := range s.d.bases {
+		for _, bases := range usrBases {
+			for _, base := range bases {
+				if !seen[base.Ref] {
+					seen[base.Ref] = true
+					refs = append(refs, base.Ref)
+				}
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+func (s *baseImageStorage) Dependents(ref string) ([]domain.BaseImage, error) {
+	var dependents []domain.BaseImage
+	for _, usrBases := range s.d.bases {
+		for _, bases := range usrBases {
+			for _, base := range bases {
+				if base.Ref == ref {
+					dependents = append(dependents, base)
+				}
+			}
+		}
+	}
+
+	return dependents, nil
+}
+
+func (s *baseImageStorage) Update(base domain.BaseImage) error {
+	bases := s.d.bases[base.Owner][base.ImageKey]
+	for i := range bases {
+		if bases[i].Ref == base.Ref {
+			bases[i].Digest = base.Digest
+			bases[i].TriggeredAt = base.TriggeredAt
+			return nil
+		}
+	}
+
+	return domain.ErrNotFound
+}
+
+// VersionStorage ================================================================
+
+type versionStorage struct {
+	d *storage
+}
+
+func (s *versionStorage) List(username string, imgKey string) ([]string, error) {
+	return s.d.versions[username][imgKey], nil
+}
+
+func (s *versionStorage) Put(username string, imgKey string, version string) error {
+	usrVersions, ok := s.d.versions[username]
+	if !ok {
+		s.d.versions[username] = make(map[string][]string)
+		usrVersions = s.d.versions[username]
+	}
+
+	for _, v := range usrVersions[imgKey] {
+		if v == version {
+			return nil
+		}
+	}
+
+	usrVersions[imgKey] = append(usrVersions[imgKey], version)
+	return nil
+}
+
+func (s *versionStorage) Delete(username string, imgKey string) error {
+	delete(s.d.versions[username], imgKey)
+	return nil
+}
+
+// SecretStorage ================================================================
+
+type secretStorage struct {
+	d *storage
+}
+
+func (s *secretStorage) List(username string, imgKey string) ([]domain.ImageSecret, error) {
+	return s.d.secrets[username][imgKey], nil
+}
+
+func (s *secretStorage) Put(secret domain.ImageSecret) error {
+	usrSecrets, ok := s.d.secrets[secret.Owner]
+	if !ok {
+		s.d.secrets[secret.Owner] = make(map[string][]domain.ImageSecret)
+		usrSecrets = s.d.secrets[secret.Owner]
+	}
+
+	secrets := usrSecrets[secret.ImageKey]
+	for i := range secrets {
+		if secrets[i].Name == secret.Name {
+			secrets[i] = secret
+			return nil
+		}
+	}
+
+	usrSecrets[secret.ImageKey] = append(secrets, secret)
+	return nil
+}
+
+func (s *secretStorage) Delete(username string, imgKey string, name string) error {
+	secrets := s.d.secrets[username][imgKey]
+	for i := range secrets {
+		if secrets[i].Name == name {
+			s.d.secrets[username][imgKey] = append(secrets[:i], secrets[i+1:]...)
+			return nil
+		}
+	}
+
+	return domain.ErrNotFound
+}
+
+func (s *secretStorage) DeleteAll(username string, imgKey string) error {
+	delete(s.d.secrets[username], imgKey)
+	return nil
+}
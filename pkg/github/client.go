@@ -3,6 +3,7 @@ package github
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/mobingilabs/pullr/pkg/domain"
 )
@@ -58,8 +60,18 @@ func (c *Client) doRequest(ctx context.Context, apiReq apiRequest) (int, []byte,
 	return res.StatusCode, body, nil
 }
 
-// RegisterWebhook registers pullr to source provider's webhooks
+// RegisterWebhook registers pullr to source provider's webhooks. Nothing is
+// registered if the repository already has a webhook with the same url, so
+// the images of a repository share a single webhook.
 func (c *Client) RegisterWebhook(ctx context.Context, token string, webhookURL string, repo domain.SourceRepository) error {
+	exists, err := c.hasWebhook(ctx, token, webhookURL, repo)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
 	type registerConfig struct {
 		Url         string `json:"url"`
 		ContentType string `json:"content_type"`
@@ -77,7 +89,7 @@ func (c *Client) RegisterWebhook(ctx context.Context, token string, webhookURL s
 		},
 	}
 	var bodyJson bytes.Buffer
-	err := json.NewEncoder(&bodyJson).Encode(body)
+	err = json.NewEncoder(&bodyJson).Encode(body)
 	if err != nil {
 		return err
 	}
@@ -99,6 +111,40 @@ func (c *Client) RegisterWebhook(ctx context.Context, token string, webhookURL s
 	return nil
 }
 
+// hasWebhook reports whether the repository has a webhook with the given url
+func (c *Client) hasWebhook(ctx context.Context, token string, webhookURL string, repo domain.SourceRepository) (bool, error) {
+	type hook struct {
+		Config struct {
+			Url string `json:"url"`
+		} `json:"config"`
+	}
+
+	req := apiRequest{
+		accessToken: token,
+		path:        fmt.Sprintf("/repos/%s/%s/hooks", repo.Owner, repo.Name),
+	}
+	code, resBody, err := c.doRequest(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	if code != http.StatusOK {
+		return false, errors.New(string(resBody))
+	}
+
+	var hooks []hook
+	if err := json.Unmarshal(resBody, &hooks); err != nil {
+		return false, err
+	}
+
+	for _, h := range hooks {
+		if h.Config.Url == webhookURL {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // ParseWebhookPayload parses github's webhook request and extracts commit info out of it
 func (*Client) ParseWebhookPayload(req *http.Request) (*domain.CommitInfo, error) {
 	if !strings.HasPrefix(req.Header.Get("User-Agent"), "GitHub-Hookshot") {
@@ -131,21 +177,20 @@ func (*Client) ParseWebhookPayload(req *http.Request) (*domain.CommitInfo, error
 		return nil, err
 	}
 
-	// Parse push type
-	refParts := strings.Split(*pushEvent.Ref, "/")
-	if len(refParts) != 3 {
-		return nil, domain.ErrSourceBadPayload
-	}
-
-	var refType domain.SourceRefType
-	if refParts[1] == "tags" {
-		refType = domain.SourceTag
-	} else {
-		refType = domain.SourceBranch
+	refType, refName, ok := domain.ParseGitRef(*pushEvent.Ref)
+	if !ok {
+		return nil, domain.ErrSourceIrrelevantEvent
 	}
 
-	refName := refParts[len(refParts)-1]
 	commit := pushEvent.HeadCommit
+	changedFiles, truncated := pushEvent.ChangedFiles()
+
+	// Payloads without before, like for the new branches, leave the changed
+	// files unknown if the commit list is truncated
+	before := ""
+	if pushEvent.Before != nil && *pushEvent.Before != zeroHash {
+		before = *pushEvent.Before
+	}
 
 	commitInfo := &domain.CommitInfo{
 		Author:    *commit.Author.Name,
@@ -158,6 +203,9 @@ func (*Client) ParseWebhookPayload(req *http.Request) (*domain.CommitInfo, error
 			Name:     *pushEvent.Repository.Name,
 			Owner:    *pushEvent.Repository.Owner.Login,
 		},
+		Before:           before,
+		ChangedFiles:     changedFiles,
+		ChangesTruncated: truncated,
 	}
 
 	return commitInfo, nil
@@ -249,6 +297,145 @@ func (c *Client) Repositories(ctx context.Context, identity string, organisation
 	return repos, nil
 }
 
+// ResolveRef reports back the commit info of a branch, tag or commit hash
+func (c *Client) ResolveRef(ctx context.Context, token string, repo domain.SourceRepository, refType domain.SourceRefType, ref string) (*domain.CommitInfo, error) {
+	req := apiRequest{
+		path:        fmt.Sprintf("/repos/%s/%s/commits/%s", repo.Owner, repo.Name, escapeRef(ref)),
+		accessToken: token,
+	}
+
+	code, body, err := c.doRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNotFound || code == http.StatusUnprocessableEntity {
+		return nil, domain.ErrNotFound
+	}
+	if code != http.StatusOK {
+		return nil, errors.New(string(body))
+	}
+
+	var commit struct {
+		SHA    string `json:"sha"`
+		Commit struct {
+			Author struct {
+				Name string    `json:"name"`
+				Date time.Time `json:"date"`
+			} `json:"author"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(body, &commit); err != nil {
+		return nil, err
+	}
+
+	return &domain.CommitInfo{
+		Author:     commit.Commit.Author.Name,
+		CreatedAt:  commit.Commit.Author.Date,
+		Ref:        ref,
+		RefType:    refType,
+		Hash:       commit.SHA,
+		Repository: repo,
+	}, nil
+}
+
+// compareFileLimit is the maximum number of files listed by the compare api
+const compareFileLimit = 300
+
+// CompareFiles reports back the paths of the files changed between base and
+// head commits. Both the new and the previous paths of renamed files are
+// reported.
+func (c *Client) CompareFiles(ctx context.Context, token string, repo domain.SourceRepository, base string, head string) ([]string, error) {
+	req := apiRequest{
+		path:        fmt.Sprintf("/repos/%s/%s/compare/%s...%s", repo.Owner, repo.Name, url.PathEscape(base), url.PathEscape(head)),
+		accessToken: token,
+	}
+
+	code, body, err := c.doRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNotFound {
+		// Base commit is gone after a force push
+		return nil, domain.ErrSourceChangesUnknown
+	}
+	if code != http.StatusOK {
+		return nil, errors.New(string(body))
+	}
+
+	var comparison struct {
+		Files []struct {
+			Filename         string `json:"filename"`
+			PreviousFilename string `json:"previous_filename"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(body, &comparison); err != nil {
+		return nil, err
+	}
+	if len(comparison.Files) >= compareFileLimit {
+		return nil, domain.ErrSourceChangesUnknown
+	}
+
+	var files []string
+	for _, file := range comparison.Files {
+		files = append(files, file.Filename)
+		if file.PreviousFilename != "" {
+			files = append(files, file.PreviousFilename)
+		}
+	}
+
+	return files, nil
+}
+
+// FileContent reports back the content of the file at the path in the given
+// ref
+func (c *Client) FileContent(ctx context.Context, token string, repo domain.SourceRepository, ref string, filePath string) ([]byte, error) {
+	req := apiRequest{
+		path:        fmt.Sprintf("/repos/%s/%s/contents/%s", repo.Owner, repo.Name, escapeRef(strings.TrimPrefix(filePath, "/"))),
+		params:      url.Values{"ref": {ref}},
+		accessToken: token,
+	}
+
+	code, body, err := c.doRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNotFound {
+		return nil, domain.ErrNotFound
+	}
+	if code != http.StatusOK {
+		return nil, errors.New(string(body))
+	}
+
+	var file struct {
+		Type     string `json:"type"`
+		Encoding string `json:"encoding"`
+		Content  string `json:"content"`
+	}
+	if err := json.Unmarshal(body, &file); err != nil {
+		// Directories are reported as json arrays
+		return nil, domain.ErrNotFound
+	}
+	if file.Type != "file" {
+		return nil, domain.ErrNotFound
+	}
+	if file.Encoding != "base64" {
+		return nil, fmt.Errorf("github: unsupported content encoding %q", file.Encoding)
+	}
+
+	return base64.StdEncoding.DecodeString(strings.Replace(file.Content, "\n", "", -1))
+}
+
+// escapeRef escapes the ref for using it in url paths. Slashes in
+// hierarchical branch names like "feature/login" are kept.
+func escapeRef(ref string) string {
+	parts := strings.Split(ref, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+
+	return strings.Join(parts, "/")
+}
+
 func (c *Client) identity(ctx context.Context, token string) (string, error) {
 	req := apiRequest{
 		path:        "/user",
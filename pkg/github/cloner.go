@@ -12,10 +12,23 @@ import (
 // Cloner, clones github repositories
 type Cloner struct{}
 
-// CloneRepository clones a github repository to given target path
-func (c *Cloner) CloneRepository(ctx context.Context, out io.Writer, target string, repo domain.SourceRepository, username, token string) error {
+// CloneRepository clones a github repository to given target path and checks
+// out the given commit
+func (c *Cloner) CloneRepository(ctx context.Context, out io.Writer, target string, repo domain.SourceRepository, commit, username, token string) error {
 	cloneUrl := fmt.Sprintf("https://%s:%s@github.com/%s/%s", username, token, repo.Owner, repo.Name)
-	cmd := exec.Command("git", "clone", cloneUrl, target)
+	cmd := exec.CommandContext(ctx, "git", "clone", cloneUrl, target)
+	cmd.Stderr = out
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	if commit == "" {
+		return nil
+	}
+
+	cmd = exec.CommandContext(ctx, "git", "checkout", "--quiet", commit)
+	cmd.Dir = target
 	cmd.Stderr = out
 	cmd.Stdout = out
 	return cmd.Run()
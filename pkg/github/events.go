@@ -24,6 +24,12 @@ type PushEvent struct {
 		Timestamp *time.Time `json:"timestamp,omitempty"`
 	} `json:"head_commit,omitempty"`
 
+	Commits []struct {
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
+	} `json:"commits"`
+
 	Repository *struct {
 		Name  *string `json:"name"`
 		Owner *struct {
@@ -32,12 +38,42 @@ type PushEvent struct {
 	} `json:"repository,omitempty"`
 }
 
+// pushEventCommitLimit is the maximum number of commits listed in push event
+// payloads
+const pushEventCommitLimit = 2048
+
+// zeroHash is the commit hash GitHub reports for the refs which didn't exist
+// before the push
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// ChangedFiles reports back the paths of the files changed by the listed
+// commits. Changes are truncated if the payload doesn't list all the commits
+// like when a branch is created or the commit limit is reached.
+func (p *PushEvent) ChangedFiles() (files []string, truncated bool) {
+	if len(p.Commits) == 0 || len(p.Commits) >= pushEventCommitLimit {
+		return nil, true
+	}
+
+	seen := make(map[string]bool)
+	for _, commit := range p.Commits {
+		for _, list := range [][]string{commit.Added, commit.Removed, commit.Modified} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+
+	return files, false
+}
+
 // Validate validates the push event
 func (p *PushEvent) Validate() (bool, error) {
 	val := &gova.Validator{}
 	val.NotNil("ref", p.Ref)
-	val.NotNil("before", p.Before)
-	val.NotNil("before", p.After)
+	val.NotNil("after", p.After)
 	val.NotNil("head_commit", p.HeadCommit)
 	if p.HeadCommit != nil {
 		val.NotNil("head_commit.author", p.HeadCommit.Author)
@@ -0,0 +1,58 @@
+package gova
+
+import "regexp"
+
+// Docker reference grammar, see
+// https://github.com/docker/distribution/blob/master/reference/reference.go
+const (
+	dockerAlphaNumeric  = `[a-z0-9]+`
+	dockerSeparator     = `(?:[._]|__|[-]*)`
+	dockerComponent     = dockerAlphaNumeric + `(?:` + dockerSeparator + dockerAlphaNumeric + `)*`
+	dockerRepository    = dockerComponent + `(?:/` + dockerComponent + `)*`
+	dockerDomainPart    = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	dockerDomain        = dockerDomainPart + `(?:\.` + dockerDomainPart + `)*(?::[0-9]+)?`
+	dockerTag           = `[\w][\w.-]{0,127}`
+	dockerDigest        = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	dockerReference     = `(?:` + dockerDomain + `/)?` + dockerRepository + `(?::` + dockerTag + `)?(?:@` + dockerDigest + `)?`
+	dockerMaxNameLength = 255
+)
+
+var (
+	dockerRepositoryRegexp = regexp.MustCompile(`^` + dockerRepository + `$`)
+	dockerTagRegexp        = regexp.MustCompile(`^` + dockerTag + `$`)
+	dockerReferenceRegexp  = regexp.MustCompile(`^` + dockerReference + `$`)
+)
+
+// IsDockerRepository reports whether the value is a valid docker repository
+// name without the registry domain, like "library/ubuntu"
+func IsDockerRepository(value string) bool {
+	return len(value) <= dockerMaxNameLength && dockerRepositoryRegexp.MatchString(value)
+}
+
+// IsDockerTag reports whether the value is a valid docker tag
+func IsDockerTag(value string) bool {
+	return dockerTagRegexp.MatchString(value)
+}
+
+// IsDockerReference reports whether the value is a valid docker image
+// reference, like "quay.io/org/image:tag" or "ubuntu@sha256:..."
+func IsDockerReference(value string) bool {
+	return dockerReferenceRegexp.MatchString(value)
+}
+
+// DockerRepository checks if the given string is a valid docker repository
+// name
+func (v *Validator) DockerRepository(field string, value string) {
+	v.Assert(field, IsDockerRepository(value), "should be a valid docker repository name")
+}
+
+// DockerTag checks if the given string is a valid docker tag
+func (v *Validator) DockerTag(field string, value string) {
+	v.Assert(field, IsDockerTag(value), "should be a valid docker tag")
+}
+
+// DockerReference checks if the given string is a valid docker image
+// reference
+func (v *Validator) DockerReference(field string, value string) {
+	v.Assert(field, IsDockerReference(value), "should be a valid docker image reference")
+}
@@ -0,0 +1,72 @@
+package gova
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDockerGrammar(t *testing.T) {
+	tests := []struct {
+		check func(string) bool
+		value string
+		valid bool
+	}{
+		{IsDockerRepository, "pullr", true},
+		{IsDockerRepository, "mobingilabs/pullr-api", true},
+		{IsDockerRepository, "a__b.c", true},
+		{IsDockerRepository, "Pullr", false},
+		{IsDockerRepository, "pullr:latest", false},
+		{IsDockerRepository, "-pullr", false},
+		{IsDockerRepository, "pullr/", false},
+		{IsDockerRepository, strings.Repeat("a", 256), false},
+		{IsDockerTag, "v1.0.0-rc.1", true},
+		{IsDockerTag, "_latest", true},
+		{IsDockerTag, ".latest", false},
+		{IsDockerTag, strings.Repeat("a", 129), false},
+		{IsDockerReference, "ubuntu", true},
+		{IsDockerReference, "localhost:5000/base:1", true},
+		{IsDockerReference, "quay.io/org/image@sha256:0123456789abcdef0123456789abcdef", true},
+		{IsDockerReference, "quay.io/Org/image", false},
+	}
+
+	for _, tt := range tests {
+		if valid := tt.check(tt.value); valid != tt.valid {
+			t.Errorf("%q: expected valid=%v, got %v", tt.value, tt.valid, valid)
+		}
+	}
+}
+
+func TestValidatorRules(t *testing.T) {
+	v := &Validator{}
+	ref := "master"
+	v.RelativePath("a", "docker/Dockerfile")
+	v.MaxLength("b", "abc", 3)
+	v.NotNil("h", &ref)
+	if re := v.Regexp("c", `^v(\d+)$`); re == nil {
+		t.Error("expected compiled regexp")
+	}
+	if !v.Valid() {
+		t.Fatalf("expected valid, got %v", v.Errors())
+	}
+
+	v.RelativePath("d", "../Dockerfile")
+	v.RelativePath("e", "/Dockerfile")
+	v.MaxLength("f", "abcd", 3)
+	if re := v.Regexp("g", `^v(\d+$`); re != nil {
+		t.Error("expected nil regexp")
+	}
+
+	var missing *string
+	v.NotNil("i", missing)
+	v.NotNil("j", nil)
+
+	errs := v.Errors()
+	if len(errs) != 6 {
+		t.Fatalf("expected 6 errors, got %v", errs)
+	}
+	for i, field := range []string{"d", "e", "f", "g", "i", "j"} {
+		if errs[i].Field != field {
+			t.Errorf("expected error for %s, got %s", field, errs[i].Field)
+		}
+	}
+}
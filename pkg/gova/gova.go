@@ -2,6 +2,9 @@ package gova
 
 import (
 	"fmt"
+	"path"
+	"reflect"
+	"regexp"
 	"strings"
 )
 
@@ -62,9 +65,11 @@ func (v *Validator) NotEmpty(field string, nitems int) {
 	}
 }
 
-// NotNil checks if the given pointer is nil or not
+// NotNil checks if the given pointer is nil or not. Typed nil pointers like
+// a nil *string are nil too.
 func (v *Validator) NotNil(field string, val interface{}) {
-	if val == nil {
+	rv := reflect.ValueOf(val)
+	if val == nil || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
 		v.errors = append(v.errors, ValidationError{field, "shouldn't be nil"})
 	}
 }
@@ -75,3 +80,46 @@ func (v *Validator) NonZero(field string, value int) {
 		v.errors = append(v.errors, ValidationError{field, "can not be zero"})
 	}
 }
+
+// Assert adds a validation error with the given message if the assertion
+// is false
+func (v *Validator) Assert(field string, assertion bool, message string) {
+	if !assertion {
+		v.errors = append(v.errors, ValidationError{field, message})
+	}
+}
+
+// MaxLength checks if the given string is at most max bytes long
+func (v *Validator) MaxLength(field string, value string, max int) {
+	if len(value) > max {
+		msg := fmt.Sprintf("can not be longer than %d characters", max)
+		v.errors = append(v.errors, ValidationError{field, msg})
+	}
+}
+
+// Regexp checks if the given string is a valid regular expression and
+// reports back the compiled expression, it is nil if the expression is
+// invalid
+func (v *Validator) Regexp(field string, expr string) *regexp.Regexp {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		msg := fmt.Sprintf("should be a valid regular expression: %v", err)
+		v.errors = append(v.errors, ValidationError{field, msg})
+		return nil
+	}
+
+	return re
+}
+
+// IsRelativePath reports whether the value is a slash separated path which
+// doesn't leave its root directory
+func IsRelativePath(value string) bool {
+	clean := path.Clean(value)
+	return value != "" && !path.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// RelativePath checks if the given string is a slash separated path which
+// doesn't leave its root directory
+func (v *Validator) RelativePath(field string, value string) {
+	v.Assert(field, IsRelativePath(value), "should be a relative path which doesn't leave its root")
+}
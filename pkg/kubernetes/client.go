@@ -0,0 +1,167 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceAccountDir is where the service account credentials are mounted in
+// the pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// client is a minimal kubernetes api client for managing the build jobs
+type client struct {
+	http      *http.Client
+	baseURL   string
+	token     string
+	namespace string
+}
+
+// newClient creates an api client for the given api server. In-cluster
+// service account credentials are used if the api server is empty, api
+// servers given explicitly like "http://localhost:8001" of a "kubectl proxy"
+// are used without credentials.
+func newClient(apiServer, namespace string) (*client, error) {
+	if namespace == "" {
+		namespace = inClusterNamespace()
+	}
+
+	if apiServer != "" {
+		return &client{http.DefaultClient, strings.TrimSuffix(apiServer, "/"), "", namespace}, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes: apiserver is required when running outside of a cluster")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: service account: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: service account: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes: service account: invalid ca certificate")
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	baseURL := fmt.Sprintf("https://%s:%s", host, port)
+	return &client{&http.Client{Transport: transport}, baseURL, strings.TrimSpace(string(token)), namespace}, nil
+}
+
+// inClusterNamespace reports back the namespace of the service account,
+// "default" if it is not running in a cluster
+func inClusterNamespace() string {
+	data, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return "default"
+	}
+
+	return string(bytes.TrimSpace(data))
+}
+
+// statusError is a kubernetes api error response
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("kubernetes: %d: %s", e.code, e.message)
+}
+
+// isNotFound reports whether the error is a not found api response
+func isNotFound(err error) bool {
+	statusErr, ok := err.(*statusError)
+	return ok && statusErr.code == http.StatusNotFound
+}
+
+// path reports back the api path of the namespaced resources like
+// "/apis/batch/v1/namespaces/default/jobs"
+func (c *client) path(group, resource string) string {
+	return fmt.Sprintf("/%s/namespaces/%s/%s", group, c.namespace, resource)
+}
+
+// stream sends a request to the api server and reports back the response
+// body. Responses with error statuses are reported back as errors.
+func (c *client) stream(ctx context.Context, method, path string, params url.Values, in interface{}) (io.ReadCloser, error) {
+	reqURL := c.baseURL + path
+	if len(params) > 0 {
+		reqURL += "?" + params.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &statusError{res.StatusCode, status.Message}
+	}
+
+	return res.Body, nil
+}
+
+// do sends a request to the api server and decodes the response into out
+// if it is not nil
+func (c *client) do(ctx context.Context, method, path string, params url.Values, in, out interface{}) error {
+	body, err := c.stream(ctx, method, path, params, in)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, body)
+		return err
+	}
+
+	return json.NewDecoder(body).Decode(out)
+}
@@ -0,0 +1,445 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+const (
+	// defaultImage is the builder image used if it is not configured
+	defaultImage = "gcr.io/kaniko-project/executor:latest"
+	// builderContainer is the name of the container running the build
+	builderContainer = "builder"
+	// workspace is where the cloned source is mounted in the builder
+	workspace = "/workspace"
+	// cleanupTimeout is the time limit for removing the build resources
+	cleanupTimeout = time.Second * 30
+)
+
+// pollInterval is the interval of checking the build pod status
+var pollInterval = time.Second * 2
+
+// ErrSecretsUnsupported is reported for the builds with secrets, kaniko
+// can't expose secrets to the builds without leaking them into the job spec
+var ErrSecretsUnsupported = errors.New("kubernetes: build secrets are not supported, use the buildkit builder")
+
+// ErrPlatformsUnsupported is reported for the multi platform builds, kaniko
+// builds for the platform of the node it runs on
+var ErrPlatformsUnsupported = errors.New("kubernetes: multi platform builds are not supported, use the buildkit builder")
+
+// podFailures are the reasons of the waiting pods which never start
+var podFailures = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Config are the options for building images as kubernetes jobs
+type Config struct {
+	// APIServer is the kubernetes api server address, in-cluster service
+	// account credentials are used if it is empty
+	APIServer string
+	// Namespace is where the build jobs are created, namespace of the
+	// service account is used if it is empty
+	Namespace string
+	// Claim is the persistent volume claim mounted at the clone directory,
+	// build jobs mount the cloned sources from it
+	Claim string
+	// Image is the kaniko executor image
+	Image string
+	// ServiceAccount is the service account of the build pods
+	ServiceAccount string
+}
+
+// ConfigFromMap transforms generic configuration into kubernetes specific
+// configuration
+func ConfigFromMap(in map[string]string) (*Config, error) {
+	var config Config
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused: true,
+		Result:      &config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(in); err != nil {
+		return nil, err
+	}
+
+	if config.Claim == "" {
+		return nil, errors.New("claim is required")
+	}
+	if config.Image == "" {
+		config.Image = defaultImage
+	}
+
+	return &config, nil
+}
+
+// Factory creates image builders running the builds as kubernetes jobs
+type Factory struct {
+	config   *Config
+	client   *client
+	cloneDir string
+	registry registryAuth
+}
+
+// registryAuth is the registry the images are pushed to
+type registryAuth struct {
+	host     string
+	username string
+	password string
+}
+
+// NewFactory creates a kubernetes image builder factory. Sources are cloned
+// into the cloneDir, which should be the mount point of the configured
+// claim. Images are pushed to the given registry by the build jobs.
+func NewFactory(config *Config, cloneDir, registry, username, password string) (*Factory, error) {
+	client, err := newClient(config.APIServer, config.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	cloneDir, err = filepath.Abs(cloneDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Factory{config, client, cloneDir, registryAuth{domain.RegistryHost(registry), username, password}}, nil
+}
+
+// Capabilities are the optional build features of the kubernetes builders,
+// kaniko supports none of them
+var Capabilities = domain.BuilderCapabilities{}
+
+// Capabilities reports back the optional build features of the builders
+func (f *Factory) Capabilities() domain.BuilderCapabilities {
+	return Capabilities
+}
+
+// Create creates a kubernetes image builder
+func (f *Factory) Create() (domain.ImageBuilder, error) {
+	return &Builder{factory: f}, nil
+}
+
+// Builder runs a kaniko build as a kubernetes job. Kaniko pushes the images
+// at the end of the build, so the build fails if the images can't be pushed.
+type Builder struct {
+	factory *Factory
+
+	// name of the job and the registry credentials secret
+	name   string
+	pushed []string
+}
+
+// BuildImage builds and pushes the image from the source located at ctxPath.
+// Output of the build pod is streamed to the out. Failing builds are reported
+// with BuildFailed status and a nil error.
+func (b *Builder) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	// Builds requiring unsupported features fail without retrying
+	if len(opts.Secrets) > 0 {
+		fmt.Fprintf(out, "Build failed: %v\n", ErrSecretsUnsupported)
+		return domain.BuildFailed, nil
+	}
+	if len(opts.Platforms) > 0 {
+		fmt.Fprintf(out, "Build failed: %v\n", ErrPlatformsUnsupported)
+		return domain.BuildFailed, nil
+	}
+	if b.name != "" {
+		return domain.BuildFailed, errors.New("kubernetes: builder is already used")
+	}
+	if opts.Cache.Strategy != "" && opts.Cache.Strategy != domain.CacheRegistry {
+		fmt.Fprintf(out, "Skipping %s cache, kaniko supports only registry cache\n", opts.Cache.Strategy)
+	}
+
+	source, err := b.factory.sourcePath(ctxPath)
+	if err != nil {
+		return domain.BuildFailed, err
+	}
+
+	b.name, err = jobName()
+	if err != nil {
+		return domain.BuildFailed, err
+	}
+
+	c := b.factory.client
+	if err := c.do(ctx, http.MethodPost, c.path("api/v1", "secrets"), nil, b.factory.registrySecret(b.name), nil); err != nil {
+		return domain.BuildFailed, fmt.Errorf("kubernetes: create secret: %v", err)
+	}
+
+	destinations := make([]string, len(opts.Tags))
+	for i, tag := range opts.Tags {
+		destinations[i] = fmt.Sprintf("%s/%s", b.factory.registry.host, tag)
+	}
+
+	buildJob := b.factory.buildJob(b.name, source, opts, destinations)
+	if err := c.do(ctx, http.MethodPost, c.path("apis/batch/v1", "jobs"), nil, buildJob, nil); err != nil {
+		return domain.BuildFailed, fmt.Errorf("kubernetes: create job: %v", err)
+	}
+
+	podName, err := b.waitStart(ctx)
+	if err != nil {
+		return domain.BuildFailed, err
+	}
+
+	logs, err := c.stream(ctx, http.MethodGet, c.path("api/v1", "pods/"+podName+"/log"), url.Values{
+		"container": {builderContainer},
+		"follow":    {"true"},
+	}, nil)
+	if err != nil {
+		return domain.BuildFailed, fmt.Errorf("kubernetes: logs: %v", err)
+	}
+	_, err = io.Copy(out, logs)
+	logs.Close()
+	if ctx.Err() != nil {
+		return domain.BuildFailed, ctx.Err()
+	} else if err != nil {
+		return domain.BuildFailed, fmt.Errorf("kubernetes: logs: %v", err)
+	}
+
+	terminated, err := b.waitExit(ctx, podName)
+	if err != nil {
+		return domain.BuildFailed, err
+	}
+
+	if terminated.ExitCode != 0 {
+		reason := terminated.Reason
+		if terminated.Message != "" {
+			reason = fmt.Sprintf("%s: %s", reason, strings.TrimSpace(terminated.Message))
+		}
+		fmt.Fprintf(out, "Build failed: exit code %d (%s)\n", terminated.ExitCode, reason)
+		return domain.BuildFailed, nil
+	}
+
+	b.pushed = destinations
+	return domain.BuildSucceed, nil
+}
+
+// PushImage reports the images pushed by the build job. Build jobs can only
+// push to the registry of the factory.
+func (b *Builder) PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error {
+	if b.pushed == nil {
+		return errors.New("kubernetes: push: image is not built")
+	}
+	if domain.RegistryHost(registry) != b.factory.registry.host {
+		return fmt.Errorf("kubernetes: push: images are pushed to %s by the build job", b.factory.registry.host)
+	}
+
+	for _, name := range b.pushed {
+		fmt.Fprintf(out, "Pushed %s\n", name)
+	}
+
+	return nil
+}
+
+// Close removes the build job along with its pods and the registry
+// credentials secret
+func (b *Builder) Close() error {
+	if b.name == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	c := b.factory.client
+	params := url.Values{"propagationPolicy": {"Background"}}
+	jobErr := c.do(ctx, http.MethodDelete, c.path("apis/batch/v1", "jobs/"+b.name), params, nil, nil)
+	secretErr := c.do(ctx, http.MethodDelete, c.path("api/v1", "secrets/"+b.name), nil, nil, nil)
+
+	if jobErr != nil && !isNotFound(jobErr) {
+		return fmt.Errorf("kubernetes: delete job: %v", jobErr)
+	}
+	if secretErr != nil && !isNotFound(secretErr) {
+		return fmt.Errorf("kubernetes: delete secret: %v", secretErr)
+	}
+
+	return nil
+}
+
+// waitStart waits until the builder container of the job's pod is started
+// and reports back the pod name
+func (b *Builder) waitStart(ctx context.Context) (string, error) {
+	c := b.factory.client
+	params := url.Values{"labelSelector": {"job-name=" + b.name}}
+	for {
+		var pods podList
+		if err := c.do(ctx, http.MethodGet, c.path("api/v1", "pods"), params, nil, &pods); err != nil {
+			return "", fmt.Errorf("kubernetes: list pods: %v", err)
+		}
+
+		for _, p := range pods.Items {
+			status := p.containerStatus(builderContainer)
+			if status == nil {
+				continue
+			}
+
+			state := status.State
+			if state.Running != nil || state.Terminated != nil {
+				return p.Metadata.Name, nil
+			}
+			if state.Waiting != nil && podFailures[state.Waiting.Reason] {
+				return "", fmt.Errorf("kubernetes: pod %s: %s: %s", p.Metadata.Name, state.Waiting.Reason, state.Waiting.Message)
+			}
+		}
+
+		if err := sleep(ctx); err != nil {
+			return "", err
+		}
+	}
+}
+
+// waitExit waits until the builder container of the pod terminates
+func (b *Builder) waitExit(ctx context.Context, podName string) (*containerStateTerminated, error) {
+	c := b.factory.client
+	for {
+		var p pod
+		if err := c.do(ctx, http.MethodGet, c.path("api/v1", "pods/"+podName), nil, nil, &p); err != nil {
+			return nil, fmt.Errorf("kubernetes: get pod: %v", err)
+		}
+
+		if status := p.containerStatus(builderContainer); status != nil && status.State.Terminated != nil {
+			return status.State.Terminated, nil
+		}
+
+		if err := sleep(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sourcePath reports back the path of the cloned source in the claim
+func (f *Factory) sourcePath(ctxPath string) (string, error) {
+	ctxPath, err := filepath.Abs(ctxPath)
+	if err != nil {
+		return "", err
+	}
+
+	source, err := filepath.Rel(f.cloneDir, ctxPath)
+	if err != nil || source == "." || strings.HasPrefix(source, "..") {
+		return "", fmt.Errorf("kubernetes: source %s is not in the clone directory %s", ctxPath, f.cloneDir)
+	}
+
+	return filepath.ToSlash(source), nil
+}
+
+// registrySecret creates the docker config secret for the kaniko executor
+func (f *Factory) registrySecret(name string) *secret {
+	auth := base64.StdEncoding.EncodeToString([]byte(f.registry.username + ":" + f.registry.password))
+	config, _ := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			f.registry.host: map[string]string{"auth": auth},
+		},
+	})
+
+	return &secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   objectMeta{Name: name, Labels: labels()},
+		Type:       "Opaque",
+		Data:       map[string][]byte{"config.json": config},
+	}
+}
+
+// buildJob creates the job running the kaniko executor. Source directory
+// is mounted from the claim and the registry credentials are mounted from
+// the secret with the same name as the job.
+func (f *Factory) buildJob(name, source string, opts domain.ImageBuildOptions, destinations []string) *job {
+	args := []string{
+		"--dockerfile=" + path.Join(workspace, filepath.ToSlash(opts.Dockerfile)),
+		"--context=dir://" + path.Join(workspace, filepath.ToSlash(opts.Context)),
+	}
+	if opts.Target != "" {
+		args = append(args, "--target="+opts.Target)
+	}
+	for _, arg := range opts.BuildArgs {
+		args = append(args, fmt.Sprintf("--build-arg=%s=%s", arg.Name, arg.Value))
+	}
+	for _, destination := range destinations {
+		args = append(args, "--destination="+destination)
+	}
+	if len(destinations) == 0 {
+		args = append(args, "--no-push")
+	}
+	if opts.Cache.Strategy == domain.CacheRegistry && opts.Cache.Ref != "" && !opts.NoCache {
+		// Kaniko keeps the cached layers in a repository by their keys, so
+		// the tag of the cache image becomes a path segment
+		repo := opts.Cache.Ref
+		if colon := strings.LastIndex(repo, ":"); colon > strings.LastIndex(repo, "/") {
+			repo = repo[:colon] + "/" + repo[colon+1:]
+		}
+		args = append(args, "--cache=true", "--cache-repo="+repo)
+	}
+
+	return &job{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata:   objectMeta{Name: name, Labels: labels()},
+		Spec: jobSpec{
+			BackoffLimit: 0,
+			Template: podTemplateSpec{
+				Metadata: objectMeta{Labels: labels()},
+				Spec: podSpec{
+					RestartPolicy:      "Never",
+					ServiceAccountName: f.config.ServiceAccount,
+					Containers: []container{{
+						Name:  builderContainer,
+						Image: f.config.Image,
+						Args:  args,
+						VolumeMounts: []volumeMount{
+							{Name: "source", MountPath: workspace, SubPath: source, ReadOnly: true},
+							{Name: "docker-config", MountPath: "/kaniko/.docker", ReadOnly: true},
+						},
+					}},
+					Volumes: []volume{
+						{Name: "source", PersistentVolumeClaim: &persistentVolumeClaim{ClaimName: f.config.Claim, ReadOnly: true}},
+						{Name: "docker-config", Secret: &secretVolume{SecretName: name}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// labels are the labels of the build resources
+func labels() map[string]string {
+	return map[string]string{"app": "pullr", "tier": "build"}
+}
+
+// jobName generates a unique name for the build resources
+func jobName() (string, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return "pullr-build-" + hex.EncodeToString(suffix), nil
+}
+
+// sleep waits for the poll interval or until the context is done
+func sleep(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(pollInterval):
+		return nil
+	}
+}
@@ -0,0 +1,212 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// fakeAPIServer keeps the created resources and runs the build pods with
+// the given logs and exit code
+type fakeAPIServer struct {
+	mu       sync.Mutex
+	jobs     map[string]*job
+	secrets  map[string]*secret
+	deleted  []string
+	polls    int
+	logs     string
+	exitCode int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	const ns = "/namespaces/builds/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1"+ns+"secrets":
+		var sec secret
+		json.NewDecoder(r.Body).Decode(&sec)
+		s.secrets[sec.Metadata.Name] = &sec
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.URL.Path == "/apis/batch/v1"+ns+"jobs":
+		var j job
+		json.NewDecoder(r.Body).Decode(&j)
+		s.jobs[j.Metadata.Name] = &j
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1"+ns+"pods":
+		// Pod is started at the second poll
+		s.polls++
+		name := strings.TrimPrefix(r.URL.Query().Get("labelSelector"), "job-name=")
+		state := containerState{Waiting: &containerStateWaiting{Reason: "ContainerCreating"}}
+		if s.polls > 1 {
+			state = containerState{Running: &struct{}{}}
+		}
+		json.NewEncoder(w).Encode(podList{Items: []pod{s.pod(name, state)}})
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/log"):
+		if r.URL.Query().Get("follow") != "true" || r.URL.Query().Get("container") != builderContainer {
+			http.Error(w, "unexpected log params", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, s.logs)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1"+ns+"pods/"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1"+ns+"pods/"), "-pod")
+		terminated := &containerStateTerminated{ExitCode: s.exitCode, Reason: "Completed"}
+		if s.exitCode != 0 {
+			terminated.Reason = "Error"
+		}
+		json.NewEncoder(w).Encode(s.pod(name, containerState{Terminated: terminated}))
+	case r.Method == http.MethodDelete:
+		if strings.Contains(r.URL.Path, "/jobs/") && r.URL.Query().Get("propagationPolicy") != "Background" {
+			http.Error(w, "job pods are orphaned", http.StatusBadRequest)
+			return
+		}
+		s.deleted = append(s.deleted, r.URL.Path)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeAPIServer) pod(jobName string, state containerState) pod {
+	return pod{
+		Metadata: objectMeta{Name: jobName + "-pod"},
+		Status:   podStatus{ContainerStatuses: []containerStatus{{Name: builderContainer, State: state}}},
+	}
+}
+
+func newTestBuilder(t *testing.T, api *fakeAPIServer) (*Builder, string, func()) {
+	pollInterval = time.Millisecond
+	api.jobs = make(map[string]*job)
+	api.secrets = make(map[string]*secret)
+	srv := httptest.NewServer(api)
+
+	cloneDir, err := ioutil.TempDir("", "pullr-kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{APIServer: srv.URL, Namespace: "builds", Claim: "clones", Image: defaultImage}
+	factory, err := NewFactory(config, cloneDir, "https://reg.pullr.io", "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, _ := factory.Create()
+
+	return builder.(*Builder), cloneDir, func() {
+		srv.Close()
+		os.RemoveAll(cloneDir)
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	api := &fakeAPIServer{logs: "INFO[0000] Building stage\nINFO[0002] Pushed image\n"}
+	builder, cloneDir, cleanup := newTestBuilder(t, api)
+	defer cleanup()
+
+	var out bytes.Buffer
+	status, err := builder.BuildImage(context.Background(), &out, filepath.Join(cloneDir, "app_1"), domain.ImageBuildOptions{
+		Dockerfile: "docker/Dockerfile",
+		Context:    "app",
+		Target:     "release",
+		BuildArgs:  []domain.BuildArg{{Name: "VERSION", Value: "1.0"}},
+		Tags:       []string{"owner/app:1.0", "owner/app:latest"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildSucceed {
+		t.Errorf("expected succeed status, got %s", status)
+	}
+	if out.String() != api.logs {
+		t.Errorf("expected pod logs in the output, got %q", out.String())
+	}
+
+	j, ok := api.jobs[builder.name]
+	if !ok {
+		t.Fatalf("expected job %s to be created", builder.name)
+	}
+	c := j.Spec.Template.Spec.Containers[0]
+	expectedArgs := []string{
+		"--dockerfile=/workspace/docker/Dockerfile",
+		"--context=dir:///workspace/app",
+		"--target=release",
+		"--build-arg=VERSION=1.0",
+		"--destination=reg.pullr.io/owner/app:1.0",
+		"--destination=reg.pullr.io/owner/app:latest",
+	}
+	if fmt.Sprint(c.Args) != fmt.Sprint(expectedArgs) {
+		t.Errorf("expected args %v, got %v", expectedArgs, c.Args)
+	}
+	if c.VolumeMounts[0].SubPath != "app_1" || j.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName != "clones" {
+		t.Errorf("expected the source to be mounted from the claim, got %+v", j.Spec.Template.Spec)
+	}
+	if j.Spec.Template.Spec.RestartPolicy != "Never" {
+		t.Errorf("expected pods not to be restarted, got %s", j.Spec.Template.Spec.RestartPolicy)
+	}
+
+	sec, ok := api.secrets[builder.name]
+	if !ok || !strings.Contains(string(sec.Data["config.json"]), `"reg.pullr.io"`) {
+		t.Errorf("expected registry credentials secret, got %+v", sec)
+	}
+
+	out.Reset()
+	if err := builder.PushImage(context.Background(), &out, []string{"owner/app:1.0"}, "https://reg.pullr.io/", "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.PushImage(context.Background(), &out, []string{"owner/app:1.0"}, "https://other.io", "user", "pass"); err == nil {
+		t.Error("expected pushing to another registry to fail")
+	}
+
+	if err := builder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deleted) != 2 {
+		t.Errorf("expected job and secret to be deleted, got %v", api.deleted)
+	}
+}
+
+func TestBuildImageFailure(t *testing.T) {
+	api := &fakeAPIServer{logs: "error building image: exit status 2\n", exitCode: 1}
+	builder, cloneDir, cleanup := newTestBuilder(t, api)
+	defer cleanup()
+	defer builder.Close()
+
+	var out bytes.Buffer
+	status, err := builder.BuildImage(context.Background(), &out, filepath.Join(cloneDir, "app_1"), domain.ImageBuildOptions{Dockerfile: "Dockerfile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != domain.BuildFailed {
+		t.Errorf("expected failed status, got %s", status)
+	}
+	if !strings.Contains(out.String(), "Build failed: exit code 1 (Error)") {
+		t.Errorf("expected exit code in the output, got %q", out.String())
+	}
+
+	if err := builder.PushImage(context.Background(), &out, nil, "https://reg.pullr.io", "", ""); err == nil {
+		t.Error("expected pushing a failed build to fail")
+	}
+}
+
+func TestBuildImageOutsideCloneDir(t *testing.T) {
+	builder, _, cleanup := newTestBuilder(t, &fakeAPIServer{})
+	defer cleanup()
+
+	_, err := builder.BuildImage(context.Background(), ioutil.Discard, "/elsewhere", domain.ImageBuildOptions{Dockerfile: "Dockerfile"})
+	if err == nil {
+		t.Error("expected sources outside of the clone directory to be rejected")
+	}
+}
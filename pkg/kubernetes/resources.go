@@ -0,0 +1,117 @@
+package kubernetes
+
+// Subsets of the kubernetes api objects used by the builder
+
+type objectMeta struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   objectMeta        `json:"metadata"`
+	Type       string            `json:"type"`
+	Data       map[string][]byte `json:"data"`
+}
+
+type job struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       jobSpec    `json:"spec"`
+}
+
+type jobSpec struct {
+	BackoffLimit int             `json:"backoffLimit"`
+	Template     podTemplateSpec `json:"template"`
+}
+
+type podTemplateSpec struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     podSpec    `json:"spec"`
+}
+
+type podSpec struct {
+	RestartPolicy      string      `json:"restartPolicy"`
+	ServiceAccountName string      `json:"serviceAccountName,omitempty"`
+	Containers         []container `json:"containers"`
+	Volumes            []volume    `json:"volumes"`
+}
+
+type container struct {
+	Name         string        `json:"name"`
+	Image        string        `json:"image"`
+	Args         []string      `json:"args"`
+	VolumeMounts []volumeMount `json:"volumeMounts"`
+}
+
+type volumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type volume struct {
+	Name                  string                 `json:"name"`
+	PersistentVolumeClaim *persistentVolumeClaim `json:"persistentVolumeClaim,omitempty"`
+	Secret                *secretVolume          `json:"secret,omitempty"`
+}
+
+type persistentVolumeClaim struct {
+	ClaimName string `json:"claimName"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type secretVolume struct {
+	SecretName string `json:"secretName"`
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+	Status   podStatus  `json:"status"`
+}
+
+type podList struct {
+	Items []pod `json:"items"`
+}
+
+type podStatus struct {
+	Phase             string            `json:"phase"`
+	ContainerStatuses []containerStatus `json:"containerStatuses"`
+}
+
+type containerStatus struct {
+	Name  string         `json:"name"`
+	State containerState `json:"state"`
+}
+
+type containerState struct {
+	Waiting    *containerStateWaiting    `json:"waiting"`
+	Running    *struct{}                 `json:"running"`
+	Terminated *containerStateTerminated `json:"terminated"`
+}
+
+type containerStateWaiting struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type containerStateTerminated struct {
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+}
+
+// containerStatus reports back the status of the named container, nil if
+// the container doesn't have a status yet
+func (p *pod) containerStatus(name string) *containerStatus {
+	for i := range p.Status.ContainerStatuses {
+		if p.Status.ContainerStatuses[i].Name == name {
+			return &p.Status.ContainerStatuses[i]
+		}
+	}
+
+	return nil
+}
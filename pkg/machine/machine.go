@@ -3,16 +3,19 @@ package machine
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"math/rand"
-	"os"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/machine/drivers/generic"
 	"github.com/docker/machine/drivers/virtualbox"
 	"github.com/docker/machine/libmachine"
+	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/host"
+	"github.com/mitchellh/mapstructure"
 	"github.com/mobingilabs/pullr/pkg/docker"
 	"github.com/mobingilabs/pullr/pkg/domain"
 )
@@ -20,121 +23,289 @@ import (
 const storePath = "/tmp/automatic"
 const certsPath = "/tmp/automatic/certs"
 
-// Machine builds docker images by provisioning docker machines
+// hostPrefix is the name prefix of the machines provisioned by pullr
+const hostPrefix = "builder"
+
+// resetTimeout is the time limit for cleaning up a machine after a build
+const resetTimeout = time.Minute
+
+// Machine builds docker images on a pool of docker machines
 type Machine struct {
+	*pool
 	client *libmachine.Client
 	config *Config
+	logger domain.Logger
+
+	mu         sync.Mutex
+	randSource rand.Source
+	// freeHosts are the generic driver hosts which are not provisioned
+	freeHosts []string
 }
 
 // Config are the options for provisioning docker-machines
 type Config struct {
-	// Number of cpus
+	// Driver is the docker machine driver, "virtualbox" or "generic"
+	Driver string
+	// Number of cpus of the virtualbox machines
 	CPU int
-	// Amount of memory in megabytes
+	// Amount of memory in megabytes of the virtualbox machines
 	Ram int
+
+	// Hosts are the comma separated addresses of the generic driver hosts
+	Hosts []string
+	// SSHUser is the ssh user of the generic driver hosts
+	SSHUser string
+	// SSHKey is the ssh private key path of the generic driver hosts
+	SSHKey string
+	// SSHPort is the ssh port of the generic driver hosts
+	SSHPort int
+
+	// Min is the number of warm machines kept in the pool
+	Min int
+	// Max is the maximum number of machines, builds wait for a machine to
+	// be released when the pool is full
+	Max int
+	// MaxBuilds is the number of builds after a machine is recycled
+	MaxBuilds int
+	// IdleTimeout is the duration after idle machines above the minimum are
+	// removed
+	IdleTimeout time.Duration
 }
 
 // ConfigFromMap transforms generic configuration into machine specific configuration
 func ConfigFromMap(in map[string]string) (*Config, error) {
-	cpuOpt, ok := in["cpu"]
-	if !ok {
-		cpuOpt = "1"
+	config := Config{
+		Driver:      "virtualbox",
+		CPU:         1,
+		Ram:         512,
+		SSHUser:     drivers.DefaultSSHUser,
+		SSHPort:     drivers.DefaultSSHPort,
+		Min:         1,
+		Max:         4,
+		MaxBuilds:   20,
+		IdleTimeout: time.Minute * 10,
 	}
 
-	cpu, err := strconv.ParseInt(cpuOpt, 10, strconv.IntSize)
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToSliceHookFunc(","),
+			mapstructure.StringToTimeDurationHookFunc(),
+		),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           &config,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	ramOpt, ok := in["ram"]
-	if !ok {
-		ramOpt = "512"
+	if err := decoder.Decode(in); err != nil {
+		return nil, err
 	}
 
-	ram, err := strconv.ParseInt(ramOpt, 10, strconv.IntSize)
-	if err != nil {
-		return nil, err
+	switch config.Driver {
+	case "virtualbox":
+		if config.CPU < 1 {
+			return nil, errors.New("cpu should be at least 1")
+		}
+		if config.Ram < 512 {
+			return nil, errors.New("ram should be at least 512 megabytes")
+		}
+	case "generic":
+		for i := range config.Hosts {
+			config.Hosts[i] = strings.TrimSpace(config.Hosts[i])
+		}
+		if len(config.Hosts) == 0 {
+			return nil, errors.New("hosts are required for the generic driver")
+		}
+		// Each generic host can be provisioned once
+		if config.Max > len(config.Hosts) {
+			config.Max = len(config.Hosts)
+		}
+	default:
+		return nil, fmt.Errorf("driver %q is not supported, use virtualbox or generic", config.Driver)
 	}
 
-	return &Config{int(cpu), int(ram)}, nil
+	if config.Max < 1 {
+		return nil, errors.New("max should be at least 1")
+	}
+	if config.Min < 0 || config.Min > config.Max {
+		return nil, errors.New("min should be between 0 and max")
+	}
+	if config.MaxBuilds < 1 {
+		return nil, errors.New("maxbuilds should be at least 1")
+	}
+
+	return &config, nil
 }
 
-// New creates a new machine instance. Machine provision docker-machines to
-// build docker images
-func New(config *Config) (*Machine, error) {
+// New creates a new machine instance. Machine keeps a pool of warm
+// docker-machines to build docker images. Machines left over from the
+// previous runs are removed.
+func New(config *Config, logger domain.Logger) (*Machine, error) {
 	client := libmachine.NewClient(storePath, certsPath)
+	m := &Machine{
+		client:     client,
+		config:     config,
+		logger:     logger,
+		randSource: rand.NewSource(time.Now().UnixNano()),
+		freeHosts:  append([]string(nil), config.Hosts...),
+	}
 
-	return &Machine{client, config}, nil
+	if err := m.removeStale(); err != nil {
+		return nil, err
+	}
+
+	m.pool = newPool(config, logger, m.provision)
+	return m, nil
 }
 
-// Create, creates a new image builder by provisioning a new docker-machine
-func (m *Machine) Create() (domain.ImageBuilder, error) {
+// Capabilities are the optional build features of the machine builders,
+// machines build with their docker daemons
+var Capabilities = docker.Capabilities
+
+// Capabilities reports back the optional build features of the builders
+func (m *Machine) Capabilities() domain.BuilderCapabilities {
+	return Capabilities
+}
+
+// removeStale removes the machines in the store provisioned by pullr
+func (m *Machine) removeStale() error {
+	names, err := m.client.List()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, hostPrefix) {
+			continue
+		}
+
+		machineHost, err := m.client.Load(name)
+		if err == nil {
+			err = machineHost.Driver.Remove()
+		}
+		if err != nil {
+			m.logger.Errorf("machine: remove stale %s: %v", name, err)
+		}
+		if err := m.client.Remove(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newDriver creates the configured machine driver
+func (m *Machine) newDriver(hostname string) (drivers.Driver, error) {
+	if m.config.Driver == "virtualbox" {
+		driver := virtualbox.NewDriver(hostname, storePath)
+		driver.CPU = m.config.CPU
+		driver.Memory = m.config.Ram
+		driver.NoVTXCheck = true
+		return driver, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.freeHosts) == 0 {
+		return nil, errors.New("no free generic hosts")
+	}
+
+	driver := generic.NewDriver(hostname, storePath).(*generic.Driver)
+	driver.IPAddress = m.freeHosts[0]
+	driver.SSHUser = m.config.SSHUser
+	driver.SSHPort = m.config.SSHPort
+	driver.SSHKey = m.config.SSHKey
+	m.freeHosts = m.freeHosts[1:]
+	return driver, nil
+}
+
+// releaseDriver gives the generic host of the driver back
+func (m *Machine) releaseDriver(driver drivers.Driver) {
+	if generic, ok := driver.(*generic.Driver); ok {
+		m.mu.Lock()
+		m.freeHosts = append(m.freeHosts, generic.IPAddress)
+		m.mu.Unlock()
+	}
+}
+
+// provision creates a new docker-machine for the pool
+func (m *Machine) provision() (*instance, error) {
 	start := time.Now()
-	hostname := fmt.Sprintf("builder%d", rand.NewSource(time.Now().UnixNano()).Int63()%10000)
+	m.mu.Lock()
+	hostname := fmt.Sprintf("%s%d", hostPrefix, m.randSource.Int63()%100000000)
+	m.mu.Unlock()
 	if !host.ValidateHostName(hostname) {
 		return nil, fmt.Errorf("invalid hostname: %s", hostname)
 	}
 
-	driver := virtualbox.NewDriver(hostname, storePath)
-	driver.CPU = m.config.CPU
-	driver.Memory = m.config.Ram
-	driver.NoVTXCheck = true
-	data, err := json.Marshal(driver)
+	driver, err := m.newDriver(hostname)
 	if err != nil {
 		return nil, err
 	}
 
-	machineHost, err := m.client.NewHost("virtualbox", data)
+	machineHost, err := m.createHost(driver)
 	if err != nil {
+		m.client.Remove(hostname)
+		m.releaseDriver(driver)
 		return nil, err
 	}
 
-	machineHost.HostOptions.EngineOptions.StorageDriver = "overlay"
-	if err := m.client.Create(machineHost); err != nil {
-		return nil, err
+	inst := &instance{name: hostname}
+	inst.destroy = func() error {
+		defer m.releaseDriver(driver)
+		if inst.builder != nil {
+			inst.builder.Close()
+		}
+		if err := machineHost.Driver.Remove(); err != nil {
+			return err
+		}
+		return m.client.Remove(hostname)
 	}
 
-	if err := m.client.Save(machineHost); err != nil {
+	dockerHost, err := machineHost.URL()
+	if err != nil {
+		inst.destroy()
 		return nil, err
 	}
 
-	fmt.Fprintf(os.Stderr, "Provisioning took: %v", time.Since(start))
-
-	dockerHost, err := machineHost.URL()
+	d, err := docker.New(dockerHost, certsPath, true)
 	if err != nil {
+		inst.destroy()
 		return nil, err
 	}
 
-	d := docker.New(dockerHost, certsPath, true)
-	return &Builder{m.client, machineHost, d}, nil
-}
+	inst.builder = d
+	inst.reset = func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+		defer cancel()
+		return d.Prune(ctx)
+	}
 
-// Builder, builds and pushes docker images.
-type Builder struct {
-	client *libmachine.Client
-	host   *host.Host
-	d      *docker.Docker
+	m.logger.Infof("machine: provisioning %s took %v", hostname, time.Since(start))
+	return inst, nil
 }
 
-// Close, destroys the docker-machine
-func (b *Builder) Close() error {
-	if err := b.host.Stop(); err != nil {
-		return err
+func (m *Machine) createHost(driver drivers.Driver) (*host.Host, error) {
+	data, err := json.Marshal(driver)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := b.host.Driver.Remove(); err != nil {
-		return err
+	machineHost, err := m.client.NewHost(driver.DriverName(), data)
+	if err != nil {
+		return nil, err
 	}
 
-	return b.client.Remove(b.host.Name)
-}
+	machineHost.HostOptions.EngineOptions.StorageDriver = "overlay"
+	if err := m.client.Create(machineHost); err != nil {
+		return nil, err
+	}
 
-// PushImage pushes a docker image to given docker registry
-func (b *Builder) PushImage(ctx context.Context, out io.Writer, tag, registry, username, password string) error {
-	return b.d.PushImage(ctx, out, tag, registry, username, password)
-}
+	if err := m.client.Save(machineHost); err != nil {
+		return nil, err
+	}
 
-// BuildImage builds a docker image from given context and dockerfile
-func (b *Builder) BuildImage(ctx context.Context, out io.Writer, ctxPath, dockerfile, tag string) (domain.BuildStatus, error) {
-	return b.d.BuildImage(ctx, out, ctxPath, dockerfile, tag)
+	return machineHost, nil
 }
@@ -0,0 +1,269 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// maintainInterval is the interval of scaling the pool down to its idle
+// demand and up to its minimum size
+var maintainInterval = time.Second * 10
+
+// errPoolClosed is returned for the builders requested after the pool is
+// closed
+var errPoolClosed = errors.New("machine: pool is closed")
+
+// instance is a provisioned machine
+type instance struct {
+	name    string
+	builder domain.ImageBuilder
+	// reset cleans up the machine after a failing build
+	reset func() error
+	// destroy removes the machine
+	destroy func() error
+
+	builds    int
+	idleSince time.Time
+}
+
+// pool keeps warm machines and hands them out to the builds. Pool grows on
+// demand up to its maximum size while the builds are waiting for machines,
+// and shrinks back to its minimum size as the machines stay idle.
+type pool struct {
+	min         int
+	max         int
+	maxBuilds   int
+	idleTimeout time.Duration
+	provision   func() (*instance, error)
+	logger      domain.Logger
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   []*instance
+	size   int
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newPool(config *Config, logger domain.Logger, provision func() (*instance, error)) *pool {
+	p := &pool{
+		min:         config.Min,
+		max:         config.Max,
+		maxBuilds:   config.MaxBuilds,
+		idleTimeout: config.IdleTimeout,
+		provision:   provision,
+		logger:      logger,
+		done:        make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.wg.Add(1)
+	go p.maintainLoop()
+
+	return p
+}
+
+// Create hands out a warm machine, or provisions a new one if the pool
+// can grow. It waits for a machine to be released if the pool is full.
+func (p *pool) Create() (domain.ImageBuilder, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			// Most recently used machine has the warmest build cache
+			inst := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			return &pooledBuilder{pool: p, inst: inst}, nil
+		}
+
+		if p.size < p.max {
+			p.size++
+			p.mu.Unlock()
+
+			inst, err := p.provision()
+			if err != nil {
+				p.mu.Lock()
+				p.size--
+				p.cond.Broadcast()
+				p.mu.Unlock()
+				return nil, err
+			}
+			return &pooledBuilder{pool: p, inst: inst}, nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// release puts the machine back to the pool. Machines are reset after a
+// failing build and recycled after the maximum number of builds or if they
+// can't be reset.
+func (p *pool) release(inst *instance, failed bool) {
+	inst.builds++
+	recycle := inst.builds >= p.maxBuilds
+	if failed && !recycle {
+		if err := inst.reset(); err != nil {
+			p.logger.Errorf("machine: reset %s: %v", inst.name, err)
+			recycle = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if recycle || p.closed {
+		p.removeLocked(inst)
+		return
+	}
+
+	inst.idleSince = time.Now()
+	p.idle = append(p.idle, inst)
+	p.cond.Signal()
+}
+
+// removeLocked destroys the machine in the background, p.mu should be held
+func (p *pool) removeLocked(inst *instance) {
+	p.size--
+	p.cond.Broadcast()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := inst.destroy(); err != nil {
+			p.logger.Errorf("machine: destroy %s: %v", inst.name, err)
+		}
+	}()
+}
+
+func (p *pool) maintainLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+
+	for {
+		p.maintain()
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maintain removes the machines idle for longer than the idle timeout and
+// provisions machines until the pool reaches its minimum size
+func (p *pool) maintain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Idle machines are ordered by their release time
+	for len(p.idle) > 0 && p.size > p.min && time.Since(p.idle[0].idleSince) > p.idleTimeout {
+		p.removeLocked(p.idle[0])
+		p.idle = p.idle[1:]
+	}
+
+	for ; p.size < p.min && !p.closed; p.size++ {
+		p.wg.Add(1)
+		go p.warm()
+	}
+}
+
+// warm provisions an idle machine
+func (p *pool) warm() {
+	defer p.wg.Done()
+
+	inst, err := p.provision()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.logger.Errorf("machine: provision: %v", err)
+		p.size--
+		p.cond.Broadcast()
+		return
+	}
+
+	if p.closed {
+		p.removeLocked(inst)
+		return
+	}
+
+	inst.idleSince = time.Now()
+	p.idle = append(p.idle, inst)
+	p.cond.Signal()
+}
+
+// Close destroys the idle machines, machines in use are destroyed as they
+// are released
+func (p *pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	p.closed = true
+	close(p.done)
+	for _, inst := range p.idle {
+		p.removeLocked(inst)
+	}
+	p.idle = nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// pooledBuilder builds with a pooled machine and puts it back to the pool
+// when it is closed
+type pooledBuilder struct {
+	pool   *pool
+	inst   *instance
+	failed bool
+	closed bool
+}
+
+// BuildImage builds a docker image from given context and dockerfile
+func (b *pooledBuilder) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	status, err := b.inst.builder.BuildImage(ctx, out, ctxPath, opts)
+	if err != nil || status != domain.BuildSucceed {
+		b.failed = true
+	}
+
+	return status, err
+}
+
+// PushImage pushes the tags of a docker image to given docker registry
+func (b *pooledBuilder) PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error {
+	err := b.inst.builder.PushImage(ctx, out, tags, registry, username, password)
+	if err != nil {
+		b.failed = true
+	}
+
+	return err
+}
+
+// Close puts the machine back to the pool
+func (b *pooledBuilder) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.pool.release(b.inst, b.failed)
+	}
+
+	return nil
+}
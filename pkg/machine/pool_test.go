@@ -0,0 +1,173 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// fakeBuilder reports back the given build status
+type fakeBuilder struct {
+	status domain.BuildStatus
+}
+
+func (b *fakeBuilder) Close() error { return nil }
+
+func (b *fakeBuilder) BuildImage(ctx context.Context, out io.Writer, ctxPath string, opts domain.ImageBuildOptions) (domain.BuildStatus, error) {
+	return b.status, nil
+}
+
+func (b *fakeBuilder) PushImage(ctx context.Context, out io.Writer, tags []string, registry, username, password string) error {
+	return nil
+}
+
+// fakeMachines provisions fake machines and records their lifecycle
+type fakeMachines struct {
+	mu          sync.Mutex
+	provisioned int
+	resets      int
+	destroyed   []string
+	resetErr    error
+	status      domain.BuildStatus
+}
+
+func (f *fakeMachines) provision() (*instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.provisioned++
+
+	inst := &instance{name: fmt.Sprintf("builder%d", f.provisioned), builder: &fakeBuilder{f.status}}
+	inst.reset = func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.resets++
+		return f.resetErr
+	}
+	inst.destroy = func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.destroyed = append(f.destroyed, inst.name)
+		return nil
+	}
+
+	return inst, nil
+}
+
+func build(t *testing.T, p *pool) string {
+	builder, err := p.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+
+	if _, err := builder.BuildImage(context.Background(), ioutil.Discard, "", domain.ImageBuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return builder.(*pooledBuilder).inst.name
+}
+
+func TestPoolReusesMachines(t *testing.T) {
+	machines := &fakeMachines{status: domain.BuildSucceed}
+	p := newPool(&Config{Min: 0, Max: 2, MaxBuilds: 3, IdleTimeout: time.Hour}, &domain.TestLogger{}, machines.provision)
+
+	var names []string
+	for i := 0; i < 4; i++ {
+		names = append(names, build(t, p))
+	}
+	p.Close()
+	sort.Strings(machines.destroyed)
+
+	expected := []string{"builder1", "builder1", "builder1", "builder2"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected builds on %v, got %v", expected, names)
+	}
+	if fmt.Sprint(machines.destroyed) != "[builder1 builder2]" {
+		t.Errorf("expected machines to be recycled and closed, got %v", machines.destroyed)
+	}
+}
+
+func TestPoolResetsFailedMachines(t *testing.T) {
+	machines := &fakeMachines{status: domain.BuildFailed}
+	p := newPool(&Config{Min: 0, Max: 1, MaxBuilds: 10, IdleTimeout: time.Hour}, &domain.TestLogger{}, machines.provision)
+	defer p.Close()
+
+	build(t, p)
+	if name := build(t, p); name != "builder1" || machines.resets != 2 {
+		t.Errorf("expected reset machine to be reused, got %s with %d resets", name, machines.resets)
+	}
+
+	machines.resetErr = errors.New("docker is not responding")
+	build(t, p)
+	if name := build(t, p); name != "builder2" {
+		t.Errorf("expected machine failing to reset to be recycled, got %s", name)
+	}
+}
+
+func TestPoolWaitsForMachines(t *testing.T) {
+	machines := &fakeMachines{status: domain.BuildSucceed}
+	p := newPool(&Config{Min: 0, Max: 1, MaxBuilds: 10, IdleTimeout: time.Hour}, &domain.TestLogger{}, machines.provision)
+	defer p.Close()
+
+	first, err := p.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan domain.ImageBuilder)
+	go func() {
+		builder, _ := p.Create()
+		acquired <- builder
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected build to wait while the pool is full")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	first.Close()
+	second := <-acquired
+	defer second.Close()
+	if second.(*pooledBuilder).inst.name != "builder1" || machines.provisioned != 1 {
+		t.Errorf("expected released machine to be handed out, provisioned %d", machines.provisioned)
+	}
+}
+
+func TestPoolScaling(t *testing.T) {
+	maintainInterval = time.Millisecond * 5
+	machines := &fakeMachines{status: domain.BuildSucceed}
+	p := newPool(&Config{Min: 1, Max: 3, MaxBuilds: 10, IdleTimeout: time.Millisecond * 20}, &domain.TestLogger{}, machines.provision)
+	defer p.Close()
+
+	// Warm machine is provisioned before the first build
+	time.Sleep(time.Millisecond * 20)
+	builders := make([]domain.ImageBuilder, 3)
+	for i := range builders {
+		builders[i], _ = p.Create()
+	}
+	for _, builder := range builders {
+		builder.Close()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	p.mu.Lock()
+	size, idle := p.size, len(p.idle)
+	p.mu.Unlock()
+	machines.mu.Lock()
+	defer machines.mu.Unlock()
+	if size != 1 || idle != 1 {
+		t.Errorf("expected pool to shrink to its minimum, got %d machines (%d idle)", size, idle)
+	}
+	if machines.provisioned != 3 {
+		t.Errorf("expected pool to grow to its maximum, provisioned %d", machines.provisioned)
+	}
+}
@@ -0,0 +1,68 @@
+package mongodb
+
+import (
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BaseImageStorage stores and queries base images of the images from mongodb
+type BaseImageStorage struct {
+	d *Driver
+}
+
+func (s *BaseImageStorage) col() *mgo.Collection {
+	return s.d.db.C(basesC)
+}
+
+// List, lists base images of an image by matching username and image key
+func (s *BaseImageStorage) List(username string, imgKey string) ([]domain.BaseImage, error) {
+	var bases []domain.BaseImage
+	err := s.col().Find(bson.M{"owner": username, "image_key": imgKey}).All(&bases)
+	return bases, toStorageErr(err)
+}
+
+// Put, replaces base images of an image by matching username and image key
+func (s *BaseImageStorage) Put(username string, imgKey string, bases []domain.BaseImage) error {
+	if err := s.Delete(username, imgKey); err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(bases))
+	for i := range bases {
+		docs[i] = bases[i]
+	}
+
+	return toStorageErr(s.col().Insert(docs...))
+}
+
+// Delete, deletes base images of an image by matching username and image key
+func (s *BaseImageStorage) Delete(username string, imgKey string) error {
+	_, err := s.col().RemoveAll(bson.M{"owner": username, "image_key": imgKey})
+	return toStorageErr(err)
+}
+
+// Refs, lists distinct base image references of all users
+func (s *BaseImageStorage) Refs() ([]string, error) {
+	var refs []string
+	err := s.col().Find(nil).Distinct("ref", &refs)
+	return refs, toStorageErr(err)
+}
+
+// Dependents, lists base image records of all users by matching reference
+func (s *BaseImageStorage) Dependents(ref string) ([]domain.BaseImage, error) {
+	var bases []domain.BaseImage
+	err := s.col().Find(bson.M{"ref": ref}).All(&bases)
+	return bases, toStorageErr(err)
+}
+
+// Update, updates digest and trigger time of a base image record by matching
+// owner, image key and reference
+func (s *BaseImageStorage) Update(base domain.BaseImage) error {
+	query := bson.M{"owner": base.Owner, "image_key": base.ImageKey, "ref": base.Ref}
+	update := bson.M{"$set": bson.M{"digest": base.Digest, "triggered_at": base.TriggeredAt}}
+	return toStorageErr(s.col().Update(query, update))
+}
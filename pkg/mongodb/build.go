@@ -43,6 +43,21 @@ func (s *BuildStorage) GetLast(username string, imgKey string) (domain.BuildReco
 	return build.Records[0], nil
 }
 
+// Get, gets a build record by matching username, image key and record id
+func (s *BuildStorage) Get(username string, imgKey string, id string) (domain.BuildRecord, error) {
+	var build domain.Build
+	query := bson.M{"owner": username, "image_key": imgKey, "records.id": id}
+	err := s.col().Find(query).Select(bson.M{"records.$": 1}).One(&build)
+	if err != nil {
+		return domain.BuildRecord{}, toStorageErr(err)
+	}
+	if len(build.Records) == 0 {
+		return domain.BuildRecord{}, domain.ErrNotFound
+	}
+
+	return build.Records[0], nil
+}
+
 // GetLastBy retrieves last build records for matching image keys
 func (s *BuildStorage) GetLastBy(username string, imgKeys []string) (map[string]domain.BuildRecord, error) {
 	var builds []domain.Build
@@ -86,10 +101,11 @@ func (s *BuildStorage) List(username string, opts domain.ListOptions) ([]domain.
 	return builds, pagination, toStorageErr(err)
 }
 
-// UpdateLast, updates the latest record of a build by matching username and image key
-func (s *BuildStorage) UpdateLast(username string, imgKey string, record domain.BuildRecord) error {
-	query := bson.M{"owner": username, "image_key": imgKey}
-	update := bson.M{"$set": bson.M{"records.0": record}}
+// Update replaces the build record by matching username, image key and
+// record id
+func (s *BuildStorage) Update(username string, imgKey string, id string, record domain.BuildRecord) error {
+	query := bson.M{"owner": username, "image_key": imgKey, "records.id": id}
+	update := bson.M{"$set": bson.M{"records.$": record}}
 	err := s.col().Update(query, update)
 	return toStorageErr(err)
 }
@@ -17,6 +17,12 @@ const (
 	buildsC = "builds"
 	authC   = "user_creds"
 	oauthC  = "oauth"
+
+	schedulesC = "schedules"
+	leasesC    = "leases"
+	basesC     = "base_images"
+	versionsC  = "versions"
+	secretsC   = "secrets"
 )
 
 // Config is a structure of necessary information needed to run this
@@ -93,6 +99,31 @@ func (d *Driver) BuildStorage() domain.BuildStorage {
 	return &BuildStorage{d}
 }
 
+// ScheduleStorage creates a mongodb baked ScheduleStorage
+func (d *Driver) ScheduleStorage() domain.ScheduleStorage {
+	return &ScheduleStorage{d}
+}
+
+// LeaseStorage creates a mongodb baked LeaseStorage
+func (d *Driver) LeaseStorage() domain.LeaseStorage {
+	return &LeaseStorage{d}
+}
+
+// BaseImageStorage creates a mongodb baked BaseImageStorage
+func (d *Driver) BaseImageStorage() domain.BaseImageStorage {
+	return &BaseImageStorage{d}
+}
+
+// VersionStorage creates a mongodb baked VersionStorage
+func (d *Driver) VersionStorage() domain.VersionStorage {
+	return &VersionStorage{d}
+}
+
+// SecretStorage creates a mongodb baked SecretStorage
+func (d *Driver) SecretStorage() domain.SecretStorage {
+	return &SecretStorage{d}
+}
+
 func toStorageErr(err error) error {
 	switch err {
 	case nil:
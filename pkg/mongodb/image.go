@@ -56,6 +56,27 @@ func (s *ImageStorage) List(username string, opts domain.ListOptions) ([]domain.
 	return images, pagination, toStorageErr(err)
 }
 
+// All reports back all the images which belongs to a user
+func (s *ImageStorage) All(username string) ([]domain.Image, error) {
+	var images []domain.Image
+	err := s.col().Find(bson.M{"owner": username}).All(&images)
+	return images, toStorageErr(err)
+}
+
+// FindByRepository reports back the images of a user built from the
+// repository
+func (s *ImageStorage) FindByRepository(username string, repo domain.SourceRepository) ([]domain.Image, error) {
+	var images []domain.Image
+	query := bson.M{
+		"owner":               username,
+		"repository.provider": repo.Provider,
+		"repository.owner":    repo.Owner,
+		"repository.name":     repo.Name,
+	}
+	err := s.col().Find(query).All(&images)
+	return images, toStorageErr(err)
+}
+
 // Put puts an image record to mongodb database
 func (s *ImageStorage) Put(image domain.Image) error {
 	err := s.col().Insert(image)
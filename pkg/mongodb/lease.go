@@ -0,0 +1,52 @@
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LeaseStorage grants leases by using mongodb documents
+type LeaseStorage struct {
+	d *Driver
+}
+
+func (s *LeaseStorage) col() *mgo.Collection {
+	return s.d.db.C(leasesC)
+}
+
+// Acquire, acquires or renews a lease by matching name. Lease documents use
+// the lease name as their id, so if the lease is owned by someone else the
+// upsert fails with a duplicate key error.
+func (s *LeaseStorage) Acquire(name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	query := bson.M{
+		"_id": name,
+		"$or": []bson.M{
+			{"holder": holder},
+			{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"holder": holder, "expires_at": now.Add(ttl)}}
+
+	_, err := s.col().Upsert(query, update)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, toStorageErr(err)
+	}
+
+	return true, nil
+}
+
+// Release, releases a lease by matching name and holder
+func (s *LeaseStorage) Release(name string, holder string) error {
+	err := s.col().Remove(bson.M{"_id": name, "holder": holder})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return toStorageErr(err)
+}
@@ -0,0 +1,62 @@
+package mongodb
+
+import (
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ScheduleStorage stores and queries scheduled builds from mongodb
+type ScheduleStorage struct {
+	d *Driver
+}
+
+func (s *ScheduleStorage) col() *mgo.Collection {
+	return s.d.db.C(schedulesC)
+}
+
+// List, lists schedules of an image by matching username and image key
+func (s *ScheduleStorage) List(username string, imgKey string) ([]domain.Schedule, error) {
+	var schedules []domain.Schedule
+	err := s.col().Find(bson.M{"owner": username, "image_key": imgKey}).All(&schedules)
+	return schedules, toStorageErr(err)
+}
+
+// Put, replaces schedules of an image by matching username and image key
+func (s *ScheduleStorage) Put(username string, imgKey string, schedules []domain.Schedule) error {
+	if err := s.Delete(username, imgKey); err != nil {
+		return err
+	}
+	if len(schedules) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(schedules))
+	for i := range schedules {
+		docs[i] = schedules[i]
+	}
+
+	return toStorageErr(s.col().Insert(docs...))
+}
+
+// Delete, deletes schedules of an image by matching username and image key
+func (s *ScheduleStorage) Delete(username string, imgKey string) error {
+	_, err := s.col().RemoveAll(bson.M{"owner": username, "image_key": imgKey})
+	return toStorageErr(err)
+}
+
+// Due, lists schedules of all users which should run at or before the given time
+func (s *ScheduleStorage) Due(now time.Time) ([]domain.Schedule, error) {
+	var schedules []domain.Schedule
+	err := s.col().Find(bson.M{"next_run": bson.M{"$lte": now}}).All(&schedules)
+	return schedules, toStorageErr(err)
+}
+
+// Update, updates run times of a schedule by matching owner, image key and branch
+func (s *ScheduleStorage) Update(schedule domain.Schedule) error {
+	query := bson.M{"owner": schedule.Owner, "image_key": schedule.ImageKey, "branch": schedule.Branch}
+	update := bson.M{"$set": bson.M{"next_run": schedule.NextRun, "last_run": schedule.LastRun}}
+	return toStorageErr(s.col().Update(query, update))
+}
@@ -0,0 +1,43 @@
+package mongodb
+
+import (
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SecretStorage stores and queries encrypted image secrets from mongodb
+type SecretStorage struct {
+	d *Driver
+}
+
+func (s *SecretStorage) col() *mgo.Collection {
+	return s.d.db.C(secretsC)
+}
+
+// List, lists secrets of an image by matching username and image key
+func (s *SecretStorage) List(username string, imgKey string) ([]domain.ImageSecret, error) {
+	var secrets []domain.ImageSecret
+	err := s.col().Find(bson.M{"owner": username, "image_key": imgKey}).Sort("name").All(&secrets)
+	return secrets, toStorageErr(err)
+}
+
+// Put, inserts or replaces a secret of an image by its name
+func (s *SecretStorage) Put(secret domain.ImageSecret) error {
+	query := bson.M{"owner": secret.Owner, "image_key": secret.ImageKey, "name": secret.Name}
+	_, err := s.col().Upsert(query, secret)
+	return toStorageErr(err)
+}
+
+// Delete, deletes a secret of an image by matching username, image key and
+// name
+func (s *SecretStorage) Delete(username string, imgKey string, name string) error {
+	err := s.col().Remove(bson.M{"owner": username, "image_key": imgKey, "name": name})
+	return toStorageErr(err)
+}
+
+// DeleteAll, deletes secrets of an image by matching username and image key
+func (s *SecretStorage) DeleteAll(username string, imgKey string) error {
+	_, err := s.col().RemoveAll(bson.M{"owner": username, "image_key": imgKey})
+	return toStorageErr(err)
+}
@@ -0,0 +1,54 @@
+package mongodb
+
+import (
+	"time"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// VersionStorage stores and queries published image versions from mongodb
+type VersionStorage struct {
+	d *Driver
+}
+
+func (s *VersionStorage) col() *mgo.Collection {
+	return s.d.db.C(versionsC)
+}
+
+// List, lists published versions of an image by matching username and image
+// key
+func (s *VersionStorage) List(username string, imgKey string) ([]string, error) {
+	var versions []domain.PublishedVersion
+	err := s.col().Find(bson.M{"owner": username, "image_key": imgKey}).All(&versions)
+	if err != nil {
+		return nil, toStorageErr(err)
+	}
+
+	list := make([]string, len(versions))
+	for i, v := range versions {
+		list[i] = v.Version
+	}
+
+	return list, nil
+}
+
+// Put, records a published version of an image
+func (s *VersionStorage) Put(username string, imgKey string, version string) error {
+	query := bson.M{"owner": username, "image_key": imgKey, "version": version}
+	_, err := s.col().Upsert(query, domain.PublishedVersion{
+		Owner:       username,
+		ImageKey:    imgKey,
+		Version:     version,
+		PublishedAt: time.Now(),
+	})
+	return toStorageErr(err)
+}
+
+// Delete, deletes published versions of an image by matching username and
+// image key
+func (s *VersionStorage) Delete(username string, imgKey string) error {
+	_, err := s.col().RemoveAll(bson.M{"owner": username, "image_key": imgKey})
+	return toStorageErr(err)
+}
@@ -0,0 +1,317 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mobingilabs/pullr/pkg/domain"
+)
+
+// manifestTypes are the accepted manifest media types. Manifest lists are
+// preferred, so multi platform images report the digest of the list.
+var manifestTypes = []string{
+	ManifestListType,
+	"application/vnd.oci.image.index.v1+json",
+	ManifestType,
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+type credentials struct {
+	username string
+	password string
+}
+
+// Client queries docker registries with the registry http api v2. It
+// implements domain.ImageRegistry.
+type Client struct {
+	http        *http.Client
+	scheme      string
+	credentials map[string]credentials
+}
+
+// NewClient creates a registry client. If httpClient is nil, the default
+// http client is used.
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{httpClient, "https", make(map[string]credentials)}
+}
+
+// Login sets the credentials used for the registry at the given host.
+// Registry urls like "https://registry.example.com/" are accepted too.
+func (c *Client) Login(host, username, password string) {
+	host = domain.RegistryHost(host)
+	if slash := strings.Index(host, "/"); slash >= 0 {
+		host = host[:slash]
+	}
+	c.credentials[host] = credentials{username, password}
+}
+
+// Digest reports back the content digest of the manifest the reference
+// points to. Digest of the references pinned with a digest is reported back
+// without querying the registry.
+func (c *Client) Digest(ctx context.Context, ref string) (string, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	if r.Digest != "" {
+		return r.Digest, nil
+	}
+
+	manifestURL := c.manifestURL(r)
+	res, err := c.do(ctx, http.MethodHead, manifestURL, r, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// Some registries doesn't report the digest header for HEAD requests
+	res, err = c.do(ctx, http.MethodGet, manifestURL, r, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+// PlatformDigests reports back the digests of the platform images listed in
+// the manifest list of the reference by their platforms like "linux/arm64"
+func (c *Client) PlatformDigests(ctx context.Context, ref string) (map[string]string, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(ctx, http.MethodGet, c.manifestURL(r), r, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var list ManifestList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("registry: %s: %v", r, err)
+	}
+	if list.MediaType != ManifestListType && list.MediaType != "application/vnd.oci.image.index.v1+json" {
+		return nil, fmt.Errorf("registry: %s: not a manifest list", r)
+	}
+
+	digests := make(map[string]string, len(list.Manifests))
+	for _, manifest := range list.Manifests {
+		digests[manifest.Platform.String()] = manifest.Digest
+	}
+
+	return digests, nil
+}
+
+// PutManifestList pushes a manifest list of the given platform images with
+// the reference's tag. Platform images should be already pushed to the same
+// repository.
+func (c *Client) PutManifestList(ctx context.Context, ref string, manifests []Descriptor) error {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(ManifestList{SchemaVersion: 2, MediaType: ManifestListType, Manifests: manifests})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(ctx, http.MethodPut, c.manifestURL(r), r, body)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *Client) manifestURL(r Reference) string {
+	return fmt.Sprintf("%s://%s/v2/%s/manifests/%s", c.scheme, r.apiHost(), r.Repository, r.manifestRef())
+}
+
+// do makes an authenticated request to the registry. If the registry
+// challenges with an authentication method, request is retried once with
+// the required authentication. Bodies are sent as manifest lists.
+func (c *Client) do(ctx context.Context, method, reqURL string, ref Reference, body []byte) (*http.Response, error) {
+	res, err := c.request(ctx, method, reqURL, "", body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		auth, err := c.authorize(ctx, ref, res.Header.Get("WWW-Authenticate"), body != nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err = c.request(ctx, method, reqURL, auth, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, fmt.Errorf("registry: %s: not found", ref)
+	case res.StatusCode >= 300:
+		res.Body.Close()
+		return nil, fmt.Errorf("registry: %s: unexpected status: %s", ref, res.Status)
+	}
+
+	return res, nil
+}
+
+func (c *Client) request(ctx context.Context, method, reqURL, auth string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if body != nil {
+		req.Header.Set("Content-Type", ManifestListType)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return c.http.Do(req)
+}
+
+// authorize reports the authorization header value for the given challenge,
+// push access is requested if push is true
+func (c *Client) authorize(ctx context.Context, ref Reference, challenge string, push bool) (string, error) {
+	creds, hasCreds := c.credentials[ref.Host]
+
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCreds {
+			return "", fmt.Errorf("registry: %s: credentials required", ref.Host)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(creds.username, creds.password)
+		return req.Header.Get("Authorization"), nil
+
+	case "bearer":
+		realm := params["realm"]
+		if realm == "" {
+			return "", errors.New("registry: bearer challenge without realm")
+		}
+
+		query := url.Values{}
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		scope := params["scope"]
+		if scope == "" && push {
+			scope = fmt.Sprintf("repository:%s:pull,push", ref.Repository)
+		} else if scope == "" {
+			scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+		}
+		query.Set("scope", scope)
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s?%s", realm, query.Encode()), nil)
+		if err != nil {
+			return "", err
+		}
+		req = req.WithContext(ctx)
+		if hasCreds {
+			req.SetBasicAuth(creds.username, creds.password)
+		}
+
+		res, err := c.http.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("registry: token request failed: %s", res.Status)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+			return "", err
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+
+		return fmt.Sprintf("Bearer %s", token.Token), nil
+	}
+
+	return "", fmt.Errorf("registry: unsupported authentication challenge: %q", challenge)
+}
+
+// parseChallenge parses a WWW-Authenticate header value like
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	for _, param := range splitParams(parts[1]) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+
+	return parts[0], params
+}
+
+// splitParams splits challenge parameters by commas which are not quoted
+func splitParams(in string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i, ch := range in {
+		switch {
+		case ch == '"':
+			quoted = !quoted
+		case ch == ',' && !quoted:
+			params = append(params, in[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(params, in[start:])
+}
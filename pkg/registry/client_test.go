@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected string
+	}{
+		{"golang", "docker.io/library/golang:latest"},
+		{"golang:1.10", "docker.io/library/golang:1.10"},
+		{"mobingi/base:dev", "docker.io/mobingi/base:dev"},
+		{"reg.pullr.io/mobingi/base", "reg.pullr.io/mobingi/base:latest"},
+		{"localhost:5000/base:1", "localhost:5000/base:1"},
+		{"alpine@sha256:abc", "docker.io/library/alpine@sha256:abc"},
+	}
+
+	for _, tt := range tests {
+		ref, err := ParseReference(tt.ref)
+		if err != nil {
+			t.Errorf("%s: %v", tt.ref, err)
+			continue
+		}
+
+		if ref.String() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.ref, tt.expected, ref)
+		}
+	}
+
+	if _, err := ParseReference("Golang"); err == nil {
+		t.Error("expected uppercase repository to be rejected")
+	}
+}
+
+func TestClient_Digest(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:owner/base:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"token": "secret"}`)
+
+		case "/v2/owner/base/manifests/latest":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				challenge := fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:owner/base:pull"`, srv.URL)
+				w.Header().Set("WWW-Authenticate", challenge)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !strings.Contains(r.Header.Get("Accept"), "manifest.list.v2") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:123")
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	client := NewClient(srv.Client())
+	client.Login(host, "user", "pass")
+
+	digest, err := client.Digest(context.Background(), host+"/owner/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:123" {
+		t.Errorf("expected digest sha256:123, got %s", digest)
+	}
+
+	if _, err := client.Digest(context.Background(), host+"/owner/missing"); err == nil {
+		t.Error("expected an error for missing image")
+	}
+}
+
+func TestClient_ManifestList(t *testing.T) {
+	var stored []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/owner/app/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			if r.Header.Get("Content-Type") != ManifestListType {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			stored, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet:
+			w.Write(stored)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	client := NewClient(srv.Client())
+	client.Login(srv.URL+"/", "user", "pass")
+
+	arm, err := ParsePlatform("linux/arm/v7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := []Descriptor{
+		{MediaType: ManifestType, Size: 528, Digest: "sha256:amd", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+		{MediaType: ManifestType, Size: 528, Digest: "sha256:arm", Platform: arm},
+	}
+	if err := client.PutManifestList(context.Background(), host+"/owner/app:1.0", manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	digests, err := client.PlatformDigests(context.Background(), host+"/owner/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 2 || digests["linux/amd64"] != "sha256:amd" || digests["linux/arm/v7"] != "sha256:arm" {
+		t.Errorf("unexpected platform digests: %v", digests)
+	}
+
+	for _, in := range []string{"linux", "linux/", "linux/arm/v7/x"} {
+		if _, err := ParsePlatform(in); err == nil {
+			t.Errorf("expected %q to be invalid", in)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Manifest media types
+const (
+	ManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+	ManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ManifestList lists the images of a multi platform image
+type ManifestList struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Descriptor is a platform image listed in a manifest list
+type Descriptor struct {
+	MediaType string   `json:"mediaType"`
+	Size      int64    `json:"size"`
+	Digest    string   `json:"digest"`
+	Platform  Platform `json:"platform"`
+}
+
+// Platform is the platform an image runs on
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses a platform like "linux/amd64" or "linux/arm/v7"
+func ParsePlatform(platform string) (Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("registry: invalid platform: %s", platform)
+	}
+
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+// String reports back the platform like "linux/arm/v7"
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
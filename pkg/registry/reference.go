@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultHost is the registry used for references without a registry host
+const DefaultHost = "docker.io"
+
+// Reference is a parsed docker image reference
+type Reference struct {
+	Host       string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses a docker image reference like "golang:1.10",
+// "reg.pullr.io/owner/name:tag" or "alpine@sha256:...". Missing parts are
+// filled with the docker defaults.
+func ParseReference(ref string) (Reference, error) {
+	var r Reference
+	if ref == "" {
+		return r, fmt.Errorf("registry: empty reference")
+	}
+
+	if i := strings.Index(ref, "@"); i >= 0 {
+		r.Digest = ref[i+1:]
+		ref = ref[:i]
+	}
+
+	if i := strings.LastIndex(ref, ":"); i >= 0 && !strings.Contains(ref[i:], "/") {
+		r.Tag = ref[i+1:]
+		ref = ref[:i]
+	}
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.Host = parts[0]
+		r.Repository = parts[1]
+	} else {
+		r.Host = DefaultHost
+		r.Repository = ref
+	}
+
+	if r.Host == DefaultHost && !strings.Contains(r.Repository, "/") {
+		r.Repository = "library/" + r.Repository
+	}
+
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+
+	if r.Repository == "" || r.Repository != strings.ToLower(r.Repository) {
+		return r, fmt.Errorf("registry: invalid repository name: %s", r.Repository)
+	}
+
+	return r, nil
+}
+
+// String reports back the fully qualified reference
+func (r Reference) String() string {
+	ref := fmt.Sprintf("%s/%s", r.Host, r.Repository)
+	if r.Tag != "" {
+		ref = fmt.Sprintf("%s:%s", ref, r.Tag)
+	}
+	if r.Digest != "" {
+		ref = fmt.Sprintf("%s@%s", ref, r.Digest)
+	}
+
+	return ref
+}
+
+// apiHost reports the host serving the registry api
+func (r Reference) apiHost() string {
+	if r.Host == DefaultHost {
+		return "registry-1.docker.io"
+	}
+
+	return r.Host
+}
+
+// manifestRef reports the tag or digest to query the manifest with
+func (r Reference) manifestRef() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+
+	return r.Tag
+}
@@ -0,0 +1,177 @@
+// Package semver parses and compares semantic versions as described in
+// https://semver.org. Versions can be prefixed with "v" like the git tags
+// usually are.
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semantic version
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	PreRelease []string
+	Build      string
+}
+
+// Parse parses a semantic version like "1.4.2", "v1.5.0-rc.1" or
+// "1.0.0+build.5"
+func Parse(in string) (Version, error) {
+	var v Version
+	s := strings.TrimPrefix(in, "v")
+
+	if i := strings.Index(s, "+"); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+		if !validIdentifiers(v.Build, false) {
+			return v, fmt.Errorf("semver: invalid build metadata: %s", in)
+		}
+	}
+
+	if i := strings.Index(s, "-"); i >= 0 {
+		pre := s[i+1:]
+		s = s[:i]
+		if !validIdentifiers(pre, true) {
+			return v, fmt.Errorf("semver: invalid pre-release: %s", in)
+		}
+		v.PreRelease = strings.Split(pre, ".")
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("semver: invalid version: %s", in)
+	}
+
+	nums := make([]uint64, 3)
+	for i, part := range parts {
+		if !isNumeric(part) || (len(part) > 1 && part[0] == '0') {
+			return v, fmt.Errorf("semver: invalid version: %s", in)
+		}
+
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("semver: invalid version: %s", in)
+		}
+		nums[i] = n
+	}
+
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, nil
+}
+
+// IsPreRelease reports whether the version is a pre-release version
+func (v Version) IsPreRelease() bool {
+	return len(v.PreRelease) > 0
+}
+
+// Compare compares the versions by their precedence. It reports back -1, 0
+// or 1 if v is lower, equal or higher than other. Build metadata is ignored.
+func (v Version) Compare(other Version) int {
+	if c := compareUint(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+
+	// A pre-release version has lower precedence than the normal version
+	switch {
+	case !v.IsPreRelease() && !other.IsPreRelease():
+		return 0
+	case !v.IsPreRelease():
+		return 1
+	case !other.IsPreRelease():
+		return -1
+	}
+
+	for i := 0; i < len(v.PreRelease) && i < len(other.PreRelease); i++ {
+		if c := compareIdentifier(v.PreRelease[i], other.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareUint(uint64(len(v.PreRelease)), uint64(len(other.PreRelease)))
+}
+
+// String reports back the version without the "v" prefix
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.IsPreRelease() {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+
+	return s
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+// compareIdentifier compares pre-release identifiers. Numeric identifiers
+// are compared numerically and have lower precedence than the others.
+func compareIdentifier(a, b string) int {
+	an, bn := isNumeric(a), isNumeric(b)
+	switch {
+	case an && bn:
+		ai, _ := strconv.ParseUint(a, 10, 64)
+		bi, _ := strconv.ParseUint(b, 10, 64)
+		return compareUint(ai, bi)
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+func validIdentifiers(in string, noLeadingZero bool) bool {
+	for _, ident := range strings.Split(in, ".") {
+		if ident == "" {
+			return false
+		}
+
+		for _, ch := range ident {
+			if !(ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '-') {
+				return false
+			}
+		}
+
+		if noLeadingZero && isNumeric(ident) && len(ident) > 1 && ident[0] == '0' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+
+	return true
+}
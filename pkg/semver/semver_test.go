@@ -0,0 +1,73 @@
+package semver
+
+import "testing"
+
+func TestParse_Invalid(t *testing.T) {
+	versions := []string{
+		"",
+		"1",
+		"1.4",
+		"1.4.2.1",
+		"01.4.2",
+		"1.4.x",
+		"1.5.0-",
+		"1.5.0-rc..1",
+		"1.5.0-01",
+		"1.5.0+",
+		"latest",
+	}
+
+	for _, version := range versions {
+		if _, err := Parse(version); err == nil {
+			t.Errorf("expected %q to be rejected", version)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	v, err := Parse("v1.5.0-rc.1+build.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Major != 1 || v.Minor != 5 || v.Patch != 0 {
+		t.Errorf("unexpected version numbers: %d.%d.%d", v.Major, v.Minor, v.Patch)
+	}
+	if !v.IsPreRelease() {
+		t.Error("expected a pre-release version")
+	}
+	if v.String() != "1.5.0-rc.1+build.5" {
+		t.Errorf("unexpected string representation: %s", v)
+	}
+}
+
+func TestVersion_Compare(t *testing.T) {
+	// Ordered by precedence, from semver.org
+	versions := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.4.2",
+		"1.10.0",
+		"2.0.0",
+	}
+
+	for i := 0; i < len(versions)-1; i++ {
+		a, _ := Parse(versions[i])
+		b, _ := Parse(versions[i+1])
+		if a.Compare(b) != -1 || b.Compare(a) != 1 {
+			t.Errorf("expected %s < %s", a, b)
+		}
+	}
+
+	a, _ := Parse("1.0.0+build.1")
+	b, _ := Parse("v1.0.0")
+	if a.Compare(b) != 0 {
+		t.Errorf("expected build metadata to be ignored")
+	}
+}